@@ -6,6 +6,7 @@ import (
 	"os/exec"
 	"runtime"
 	"strconv"
+	"strings"
 
 	"github.com/alecthomas/kingpin"
 	log "github.com/sirupsen/logrus"
@@ -26,6 +27,9 @@ type commandOptions struct {
 	updateForced  bool
 	extractPath   string
 	interactive   bool
+	dryRun        bool
+	manifestPath  string
+	dbPrefix      string
 }
 
 func parseCommand() commandOptions {
@@ -37,6 +41,20 @@ func parseCommand() commandOptions {
 	cmdInit.Flag("interactive", "interactive help to initial config file").Default("false").Short('i').BoolVar(&cmd.interactive)
 	cmdExtract := app.Command("extract-web", "extract web assets from gypsum")
 	cmdExtract.Arg("path", "path to save web assets").Default(".").StringVar(&cmd.extractPath)
+	cmdMigrate := app.Command("migrate", "upgrade records in database to current version")
+	cmdMigrate.Flag("dry-run", "only report what would be upgraded").Short('n').Default("false").BoolVar(&cmd.dryRun)
+	cmdExport := app.Command("export", "export all items as a directory of yaml files")
+	cmdExport.Arg("dir", "directory to write into").Required().StringVar(&cmd.manifestPath)
+	cmdImport := app.Command("import", "create, update and delete items to match a directory of yaml files")
+	cmdImport.Arg("dir", "directory exported by export").Required().StringVar(&cmd.manifestPath)
+	cmdImport.Flag("dry-run", "only report what would be changed").Short('n').Default("false").BoolVar(&cmd.dryRun)
+	cmdDb := app.Command("db", "inspect and maintain the database")
+	cmdDb.Command("stats", "count keys of each kind")
+	cmdDb.Command("compact", "compact the database to reclaim disk space")
+	cmdDb.Command("verify", "check that every record can be read")
+	cmdDb.Command("repair", "recover a corrupted database")
+	cmdDbDump := cmdDb.Command("dump", "print keys and values")
+	cmdDbDump.Arg("prefix", "only print keys with this prefix").StringVar(&cmd.dbPrefix)
 	cmdUpdate := app.Command("update", "update gypsum")
 	cmdUpdate.Arg("version", "new version to fetch").Default("stable").StringVar(&cmd.updateVersion)
 	cmdUpdate.Flag("mirror", "mirror to replace github.com for downloading").Short('m').StringVar(&cmd.githubMirror)
@@ -66,6 +84,39 @@ func Entry(v, c string) {
 			fmt.Println("error when extracting: ", err)
 			os.Exit(1)
 		}
+	case "migrate":
+		loadOfflineConfig()
+		err := gypsum.MigrateDatabase(cmd.dryRun, func(s ...interface{}) {
+			fmt.Println(s...)
+		})
+		if err != nil {
+			fmt.Println("error when migrating: ", err)
+			os.Exit(1)
+		}
+	case "export":
+		loadOfflineConfig()
+		if err := gypsum.ExportManifest(cmd.manifestPath); err != nil {
+			fmt.Println("error when exporting: ", err)
+			os.Exit(1)
+		}
+	case "import":
+		loadOfflineConfig()
+		err := gypsum.ImportManifest(cmd.manifestPath, cmd.dryRun, func(s ...interface{}) {
+			fmt.Println(s...)
+		})
+		if err != nil {
+			fmt.Println("error when importing: ", err)
+			os.Exit(1)
+		}
+	case "db stats", "db compact", "db verify", "db repair", "db dump":
+		loadOfflineConfig()
+		err := gypsum.MaintainDatabase(strings.TrimPrefix(cmd.action, "db "), cmd.dbPrefix, func(s ...interface{}) {
+			fmt.Println(s...)
+		})
+		if err != nil {
+			fmt.Println("error: ", err)
+			os.Exit(1)
+		}
 	case "update":
 		err := gypsum.UpdateGypsum(cmd.updateVersion, cmd.githubMirror, cmd.updateForced, func(s ...interface{}) {
 			fmt.Println(s...)
@@ -102,6 +153,19 @@ func daemon() {
 	}
 }
 
+// loadOfflineConfig prepares gypsum for commands working on gypsum_data while gypsum is not running
+func loadOfflineConfig() {
+	conf, err := readConfig()
+	if err != nil {
+		fmt.Println(err.Error())
+		os.Exit(1)
+	}
+	log.SetLevel(log.WarnLevel)
+	gypsum.BuildVersion = version
+	gypsum.BuildCommit = commit
+	gypsum.Config = &conf.Gypsum
+}
+
 func run() {
 	fmt.Printf("gypsum %s, commit %s\n\n", version, commit)
 	conf, err := readConfig()
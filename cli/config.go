@@ -72,11 +72,34 @@ func initialConfig(interactive bool) {
 			SuperUsers:    []string{},
 		},
 		Gypsum: gypsum.ConfigType{
-			Listen:         "http://0.0.0.0:9900",
-			Password:       "",
-			ExternalAssets: "",
-			ResourceShare:  "file",
-			HttpBackRef:    "",
+			Listen:              "http://0.0.0.0:9900",
+			Password:            "",
+			ExternalAssets:      "",
+			ResourceShare:       "file",
+			HttpBackRef:         "",
+			Storage:             "leveldb",
+			MaxRevisions:        20,
+			TrashRetentionDays:  30,
+			IntegrityAutoRepair: false,
+			Sandbox: gypsum.SandboxConfig{
+				FileRoots:           []string{"resources"},
+				UrlHosts:            []string{"*"},
+				AllowPrivateNetwork: false,
+				HttpTimeout:         10,
+				MaxResponseSize:     10 << 20,
+				LuaLibraries:        []string{"base", "table", "string", "math", "coroutine", "channel"},
+			},
+			Limits: gypsum.ExecutionLimits{
+				Timeout:          60,
+				LuaInstructions:  50000000,
+				LuaRegistrySize:  256 * 20,
+				LuaCallStackSize: 256,
+			},
+			RateLimit: gypsum.RateLimitConfig{
+				MessagesPerMinute: 30,
+				Burst:             10,
+				MaxWait:           10,
+			},
 		},
 	}
 	if interactive {
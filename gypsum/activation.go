@@ -0,0 +1,332 @@
+package gypsum
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+)
+
+// activeAt tells whether the group itself is active at the time, regardless of its parents
+func (g *Group) activeAt(now time.Time) bool {
+	if !g.Active {
+		return false
+	}
+	if g.StartAt != nil && now.Before(*g.StartAt) {
+		return false
+	}
+	if g.EndAt != nil && !now.Before(*g.EndAt) {
+		return false
+	}
+	return true
+}
+
+func checkActivation(startAt, endAt *time.Time) error {
+	if startAt != nil && endAt != nil && !endAt.After(*startAt) {
+		return errors.New("end_at must be after start_at")
+	}
+	return nil
+}
+
+// inactiveAncestor finds the nearest group, the group itself included, which is not active at the time.
+// The root group is always active. The registry must be locked.
+func inactiveAncestor(gid uint64, now time.Time) (uint64, bool) {
+	visited := make(map[uint64]bool)
+	for gid != 0 && !visited[gid] {
+		visited[gid] = true
+		g, ok := registry.groups[gid]
+		if !ok {
+			return 0, false
+		}
+		if !g.activeAt(now) {
+			return gid, true
+		}
+		gid = g.ParentGroup
+	}
+	return 0, false
+}
+
+// groupEffective tells whether items in the group should be registered now
+func groupEffective(gid uint64) bool {
+	_, inactive := inactiveAncestor(gid, time.Now())
+	return !inactive
+}
+
+// registerItem registers an item to the bot if it is effective
+func registerItem(itemType ItemType, id uint64) {
+	record, ok := findItem(itemType, id)
+	if !ok {
+		return
+	}
+	var err error
+	switch r := record.(type) {
+	case *Rule:
+		err = r.Register(id)
+	case *Trigger:
+		err = r.Register(id)
+	case *ScheduledJob:
+		err = r.Register(id)
+	}
+	if err != nil {
+		log.Errorf("无法注册%s %d：%s", itemType, id, err)
+	}
+}
+
+// reregisterItem registers an item again after its group changed
+func reregisterItem(itemType ItemType, id uint64) {
+	unregisterItem(itemType, id)
+	registerItem(itemType, id)
+}
+
+// groupWakeUp is sent when groups are changed, so the watcher recalculates the next start or end time
+var groupWakeUp = make(chan struct{}, 1)
+
+// groupState is what items of a group are registered with
+type groupState struct {
+	effective bool
+	defaults  ItemFilters
+}
+
+// syncGroups registers items again in groups whose effective state or defaults changed.
+// It does nothing until the watcher starts. The registry must be locked for writing.
+func syncGroups() {
+	if registry.groupStates == nil {
+		return
+	}
+	now := time.Now()
+	for gid, g := range registry.groups {
+		_, inactive := inactiveAncestor(gid, now)
+		state := groupState{
+			effective: !inactive,
+			defaults:  inheritedDefaults(gid),
+		}
+		old, known := registry.groupStates[gid]
+		registry.groupStates[gid] = state
+		if !known || old.effective == state.effective && old.defaults.equal(&state.defaults) {
+			continue
+		}
+		if old.effective != state.effective {
+			if state.effective {
+				log.Infof("组%d已生效", gid)
+			} else {
+				log.Infof("组%d已停用", gid)
+			}
+		}
+		for _, item := range g.Items {
+			if item.ItemType != GroupItem {
+				reregisterItem(item.ItemType, item.ItemID)
+			}
+		}
+	}
+	for gid := range registry.groupStates {
+		if _, ok := registry.groups[gid]; !ok {
+			delete(registry.groupStates, gid)
+		}
+	}
+}
+
+func wakeGroupWatcher() {
+	select {
+	case groupWakeUp <- struct{}{}:
+	default:
+	}
+}
+
+// nextGroupChange is the nearest start or end time of groups after now
+func nextGroupChange(now time.Time) (next time.Time, ok bool) {
+	for _, g := range registry.groups {
+		for _, t := range []*time.Time{g.StartAt, g.EndAt} {
+			if t != nil && t.After(now) && (!ok || t.Before(next)) {
+				next, ok = *t, true
+			}
+		}
+	}
+	return
+}
+
+// groupCheckInterval is the longest time between two checks of group states
+const groupCheckInterval = time.Minute
+
+func initGroupWatcher() {
+	registry.Lock()
+	registry.groupStates = make(map[uint64]groupState)
+	syncGroups()
+	registry.Unlock()
+	go watchGroups()
+}
+
+func watchGroups() {
+	for {
+		registry.Lock()
+		syncGroups()
+		now := time.Now()
+		wait := groupCheckInterval
+		if next, ok := nextGroupChange(now); ok && next.Sub(now) < wait {
+			wait = next.Sub(now)
+		}
+		registry.Unlock()
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-groupWakeUp:
+			timer.Stop()
+		}
+	}
+}
+
+// activateGroups upgrades groups saved before groups had an active state, they were all active
+func activateGroups(payload []byte) ([]byte, error) {
+	g := &Group{}
+	if err := gob.NewDecoder(bytes.NewReader(payload)).Decode(g); err != nil {
+		return nil, err
+	}
+	g.Active = true
+	buffer := bytes.Buffer{}
+	if err := gob.NewEncoder(&buffer).Encode(g); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+type groupActivation struct {
+	Active  bool       `json:"active"`
+	StartAt *time.Time `json:"start_at"`
+	EndAt   *time.Time `json:"end_at"`
+}
+
+func activateGroup(c *gin.Context) {
+	groupIDStr := c.Param("gid")
+	groupID, err := strconv.ParseUint(groupIDStr, 10, 64)
+	if err != nil {
+		c.JSON(404, gin.H{
+			"code":    1000,
+			"message": "no such group",
+		})
+		return
+	}
+	if groupID == 0 {
+		c.JSON(403, gin.H{
+			"code":    2000,
+			"message": "root group is always active",
+		})
+		return
+	}
+	var activation groupActivation
+	if err = c.BindJSON(&activation); err != nil {
+		c.JSON(400, gin.H{
+			"code":    2000,
+			"message": fmt.Sprintf("converting error: %s", err),
+		})
+		return
+	}
+	if err = checkActivation(activation.StartAt, activation.EndAt); err != nil {
+		c.JSON(422, gin.H{
+			"code":    2048,
+			"message": fmt.Sprintf("activation error: %s", err),
+		})
+		return
+	}
+	registry.Lock()
+	defer registry.Unlock()
+	group, ok := registry.groups[groupID]
+	if !ok {
+		c.JSON(404, gin.H{
+			"code":    1000,
+			"message": "no such group",
+		})
+		return
+	}
+	tx := newTransaction()
+	if err = tx.SaveRevision(GroupItem, groupID, group); err != nil {
+		log.Errorf("error when saving revision of group %d: %s", groupID, err)
+	}
+	staged, _ := tx.Group(groupID)
+	staged.Active = activation.Active
+	staged.StartAt = activation.StartAt
+	staged.EndAt = activation.EndAt
+	if err = tx.Commit(); err != nil {
+		c.JSON(500, gin.H{
+			"code":    3000,
+			"message": fmt.Sprintf("Server got itself into trouble: %s", err),
+		})
+		return
+	}
+	c.JSON(200, gin.H{
+		"code":      0,
+		"message":   "ok",
+		"effective": groupEffective(groupID),
+	})
+}
+
+// itemActive is the active flag of an item itself, resources have no such flag
+func itemActive(record UserRecord, now time.Time) bool {
+	switch r := record.(type) {
+	case *Rule:
+		return r.Active
+	case *Trigger:
+		return r.Active
+	case *ScheduledJob:
+		return r.Active
+	case *Group:
+		return r.activeAt(now)
+	default:
+		return true
+	}
+}
+
+func getEffectiveState(c *gin.Context) {
+	itemType := ItemType(c.Param("type"))
+	itemID, err := strconv.ParseUint(c.Param("iid"), 10, 64)
+	if err != nil {
+		c.JSON(404, gin.H{
+			"code":    1000,
+			"message": "no such item",
+		})
+		return
+	}
+	registry.RLock()
+	defer registry.RUnlock()
+	record, ok := findItem(itemType, itemID)
+	if !ok {
+		c.JSON(404, gin.H{
+			"code":    1000,
+			"message": "no such item",
+		})
+		return
+	}
+	now := time.Now()
+	active := itemActive(record, now)
+	var inactiveGroup interface{}
+	parentID := record.GetParentID()
+	if itemType == GroupItem && itemID == 0 {
+		active = true
+	} else if gid, inactive := inactiveAncestor(parentID, now); inactive {
+		inactiveGroup = gid
+	}
+	var filters interface{}
+	switch r := record.(type) {
+	case *Rule:
+		filters = r.filters()
+	case *Trigger:
+		filters = r.filters()
+	}
+	c.JSON(200, gin.H{
+		"code":           0,
+		"active":         active,
+		"effective":      active && inactiveGroup == nil,
+		"inactive_group": inactiveGroup,
+		"filters":        filters,
+	})
+}
+
+func sameTime(a, b *time.Time) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.Equal(*b)
+}
@@ -0,0 +1,100 @@
+package gypsum
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+
+	zero "github.com/wdvxdr1123/ZeroBot"
+)
+
+// roles of the sender a rule or trigger can be limited to
+const (
+	OwnerRole     = "owner"
+	AdminRole     = "admin"
+	MemberRole    = "member"
+	SuperUserRole = "superuser" // users in SuperUsers of ZeroBot config
+)
+
+func excludedGroupsRule(groupsID []int64) zero.Rule {
+	return func(event *zero.Event, _ zero.State) bool {
+		if event.GroupID == 0 {
+			return true
+		}
+		for _, i := range groupsID {
+			if i == event.GroupID {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+func excludedUsersRule(usersID []int64) zero.Rule {
+	return func(event *zero.Event, _ zero.State) bool {
+		for _, i := range usersID {
+			if i == event.UserID {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+func isSuperUser(userID int64) bool {
+	id := strconv.FormatInt(userID, 10)
+	for _, su := range zero.BotConfig.SuperUsers {
+		if su == id {
+			return true
+		}
+	}
+	return false
+}
+
+// rolesRule passes if the sender has any of the roles.
+// group roles are only known in group messages, superuser is known everywhere
+func rolesRule(roles []string) zero.Rule {
+	return func(event *zero.Event, _ zero.State) bool {
+		for _, role := range roles {
+			if role == SuperUserRole {
+				if event.UserID != 0 && isSuperUser(event.UserID) {
+					return true
+				}
+				continue
+			}
+			if event.Sender != nil && event.Sender.Role == role {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+func checkRoles(roles []string) error {
+	for _, role := range roles {
+		switch role {
+		case OwnerRole, AdminRole, MemberRole, SuperUserRole:
+		default:
+			return errors.New(fmt.Sprintf("unknown role: %s", role))
+		}
+	}
+	return nil
+}
+
+// excludeTargets removes excluded ids from targets
+func excludeTargets(targets []int64, excluded []int64) []int64 {
+	if len(excluded) == 0 {
+		return targets
+	}
+	result := make([]int64, 0, len(targets))
+Next:
+	for _, target := range targets {
+		for _, e := range excluded {
+			if e == target {
+				continue Next
+			}
+		}
+		result = append(result, target)
+	}
+	return result
+}
@@ -0,0 +1,153 @@
+package gypsum
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/flosch/pongo2"
+	zero "github.com/wdvxdr1123/ZeroBot"
+)
+
+// Cooldown is the least interval in seconds between two executions of a rule or trigger, 0 means no cooldown.
+// Cooldowns are kept in memory, they are cleared when gypsum restarts.
+type Cooldown struct {
+	// User is the cooldown for each user
+	User int `json:"user" yaml:"user"`
+	// Group is the cooldown for each group, private messages are not limited by it
+	Group int `json:"group" yaml:"group"`
+	// Global is the cooldown for everyone
+	Global int `json:"global" yaml:"global"`
+	// Reply is a template sent in cooldown, once in each cooldown. If it is empty, messages in cooldown are passed to other rules.
+	Reply string `json:"reply" yaml:"reply"`
+}
+
+func (c *Cooldown) enabled() bool {
+	return c.User > 0 || c.Group > 0 || c.Global > 0
+}
+
+func (c *Cooldown) check() error {
+	if c.User < 0 || c.Group < 0 || c.Global < 0 {
+		return errors.New("cooldown cannot be negative")
+	}
+	if c.Reply != "" {
+		if err := checkTemplate(c.Reply); err != nil {
+			return errors.New(fmt.Sprintf("cooldown reply: %s", err))
+		}
+	}
+	return nil
+}
+
+type cooldownScope byte
+
+const (
+	userCooldown cooldownScope = iota
+	groupCooldown
+	globalCooldown
+)
+
+type cooldownKey struct {
+	item  string
+	scope cooldownScope
+	id    int64
+}
+
+type cooldownEntry struct {
+	until   time.Time
+	replied bool
+}
+
+// cooldownSweepInterval is how often expired cooldowns are removed
+const cooldownSweepInterval = time.Minute
+
+var cooldowns = struct {
+	sync.Mutex
+	entries   map[cooldownKey]*cooldownEntry
+	lastSweep time.Time
+}{
+	entries: map[cooldownKey]*cooldownEntry{},
+}
+
+// take starts the cooldowns of the item if none of them is running.
+// Otherwise it returns the running cooldown, and whether the cooldown reply should be sent.
+func (c *Cooldown) take(item string, event *zero.Event) (cooling bool, reply bool) {
+	type scoped struct {
+		key      cooldownKey
+		duration int
+	}
+	var scopes []scoped
+	if c.User > 0 {
+		scopes = append(scopes, scoped{cooldownKey{item, userCooldown, event.UserID}, c.User})
+	}
+	if c.Group > 0 && event.GroupID != 0 {
+		scopes = append(scopes, scoped{cooldownKey{item, groupCooldown, event.GroupID}, c.Group})
+	}
+	if c.Global > 0 {
+		scopes = append(scopes, scoped{cooldownKey{item, globalCooldown, 0}, c.Global})
+	}
+	now := time.Now()
+	cooldowns.Lock()
+	defer cooldowns.Unlock()
+	if now.Sub(cooldowns.lastSweep) > cooldownSweepInterval {
+		for key, entry := range cooldowns.entries {
+			if now.After(entry.until) {
+				delete(cooldowns.entries, key)
+			}
+		}
+		cooldowns.lastSweep = now
+	}
+	for _, s := range scopes {
+		if entry, ok := cooldowns.entries[s.key]; ok && now.Before(entry.until) {
+			reply = !entry.replied
+			entry.replied = true
+			return true, reply
+		}
+	}
+	for _, s := range scopes {
+		cooldowns.entries[s.key] = &cooldownEntry{until: now.Add(time.Duration(s.duration) * time.Second)}
+	}
+	return false, false
+}
+
+// cooldownState marks in the state of a matcher that the cooldown reply should be sent instead of the response
+const cooldownState = "_gypsum_cooldown"
+
+// rule must be the last rule of a matcher, so that only executions are counted.
+// In cooldown, it does not match, unless there is a cooldown reply to send.
+func (c *Cooldown) rule(item string) zero.Rule {
+	return func(event *zero.Event, state zero.State) bool {
+		cooling, reply := c.take(item, event)
+		if !cooling {
+			return true
+		}
+		if c.Reply == "" {
+			return false
+		}
+		// the matcher still matches to block other rules, the reply is sent only once in a cooldown
+		state[cooldownState] = reply
+		return true
+	}
+}
+
+// handler sends the cooldown reply instead of the response in cooldown
+func (c *Cooldown) handler(handler zero.Handler, newHandler func(tmpl pongo2.Template) zero.Handler) (zero.Handler, error) {
+	if c.Reply == "" {
+		return handler, nil
+	}
+	tmpl, err := pongo2.FromString(c.Reply)
+	if err != nil {
+		return nil, err
+	}
+	replyHandler := newHandler(*tmpl)
+	return func(matcher *zero.Matcher, event zero.Event, state zero.State) zero.Response {
+		reply, cooling := state[cooldownState].(bool)
+		if !cooling {
+			return handler(matcher, event, state)
+		}
+		if !reply {
+			return zero.FinishResponse
+		}
+		return replyHandler(matcher, event, state)
+	}, nil
+}
@@ -1,40 +1,61 @@
 package gypsum
 
 import (
+	"errors"
 	"math/rand"
 
 	log "github.com/sirupsen/logrus"
-	"github.com/syndtr/goleveldb/leveldb"
 
 	"github.com/yuudi/gypsum/gypsum/helper"
-	"github.com/yuudi/gypsum/gypsum/luatag"
-	"github.com/yuudi/gypsum/gypsum/template"
+	"github.com/yuudi/gypsum/gypsum/storage"
+	"github.com/yuudi/gypsum/gypsum/userdata"
 )
 
-var db *leveldb.DB
-var itemCursor uint64
+var db storage.Storage
+
+var metaCursorKey = []byte("gypsum-$meta-cursor")
+
+// newMemoryStorage creates the store of the "memory" backend, tests replace it to keep data between openings
+var newMemoryStorage = func() storage.Storage {
+	return storage.NewMemory()
+}
+
+func openDb() (err error) {
+	backend := ""
+	if Config != nil {
+		backend = Config.Storage
+	}
+	switch backend {
+	case "", "leveldb":
+		db, err = storage.OpenLevelDB(databasePath)
+	case "memory":
+		// nothing is persisted, useful for trying out and debugging
+		db = newMemoryStorage()
+	default:
+		err = errors.New("unknown Storage: " + backend)
+	}
+	return
+}
 
 func initDb() error {
-	var err error
-	db, err = leveldb.OpenFile("gypsum_data/data", nil)
-	if err != nil {
+	if err := openDb(); err != nil {
 		return err
 	}
-	data, err := db.Get([]byte("gypsum-$meta-cursor"), nil)
+	data, err := db.Get(metaCursorKey)
 	if err != nil {
-		if err == leveldb.ErrNotFound {
-			itemCursor = 0
+		if err == storage.ErrNotFound {
+			registry.cursor = 0
 		} else {
 			return err
 		}
 	} else {
-		itemCursor = helper.ToUint(data)
+		registry.cursor = helper.ToUint(data)
 	}
-	coldSalt, err = db.Get([]byte("gypsum-$meta-coldsalt"), nil)
+	coldSalt, err = db.Get([]byte("gypsum-$meta-coldsalt"))
 	if err != nil {
-		if err == leveldb.ErrNotFound {
+		if err == storage.ErrNotFound {
 			rand.Read(coldSalt)
-			err = db.Put([]byte("gypsum-$meta-coldsalt"), coldSalt, nil)
+			err = db.Put([]byte("gypsum-$meta-coldsalt"), coldSalt)
 			if err != nil {
 				log.Warnf("error when write database: %s", err)
 			}
@@ -42,16 +63,149 @@ func initDb() error {
 			return err
 		}
 	}
-	luatag.SetDB(db)
-	template.SetDB(db)
+	userdata.SetDB(db)
 	return nil
 }
 
 func loadData() error {
+	registry.Lock()
+	defer registry.Unlock()
+	report, err := migrateRecords(false)
+	logMigrationReport(report)
+	if err != nil {
+		return err
+	}
+	loadItems(true)
+	return nil
+}
+
+// loadItems reads all items into registry, with register the matchers and jobs are handed to the bot
+func loadItems(register bool) {
 	loadGroups()
-	loadRules()
-	loadTriggers()
-	loadJobs()
+	loadRules(register)
+	loadTriggers(register)
+	loadJobs(register)
 	loadResources()
+}
+
+// openOffline loads all items without serving them, for cli commands working on gypsum_data while gypsum is not running.
+// The database must be closed by the caller.
+func openOffline() error {
+	// templates are parsed when checking items
+	if err := initTemplating(); err != nil {
+		return err
+	}
+	if err := initDb(); err != nil {
+		return err
+	}
+	registry.Lock()
+	defer registry.Unlock()
+	loadItems(false)
+	return nil
+}
+
+// transaction collects all writes of one operation into a single leveldb batch.
+// Changes to in-memory data are registered by OnCommit and applied only after the batch is written.
+// A transaction must be built and committed while holding the write lock of registry.
+type transaction struct {
+	batch    *storage.Batch
+	groups   map[uint64]*Group   // staged copies of groups changed in this transaction
+	deleted  map[uint64]struct{} // groups deleted in this transaction
+	cursor   uint64              // the last item id allocated or reserved in this transaction
+	onCommit []func()
+}
+
+func newTransaction() *transaction {
+	return &transaction{
+		batch:   new(storage.Batch),
+		groups:  make(map[uint64]*Group),
+		deleted: make(map[uint64]struct{}),
+	}
+}
+
+// NewItemID allocates a new item id. The cursor of registry is moved only when the transaction is committed,
+// so a failed transaction gives its ids out again. The registry must be locked for writing.
+func (tx *transaction) NewItemID() uint64 {
+	if tx.cursor < registry.cursor {
+		tx.cursor = registry.cursor
+	}
+	tx.cursor++
+	tx.batch.Put(metaCursorKey, helper.U64ToBytes(tx.cursor))
+	return tx.cursor
+}
+
+// Group returns a staged copy of a group, it will be saved when the transaction is committed
+func (tx *transaction) Group(gid uint64) (*Group, bool) {
+	if _, ok := tx.deleted[gid]; ok {
+		return nil, false
+	}
+	if g, ok := tx.groups[gid]; ok {
+		return g, true
+	}
+	g, ok := registry.groups[gid]
+	if !ok {
+		return nil, false
+	}
+	staged := *g
+	staged.Items = append([]Item{}, g.Items...)
+	tx.groups[gid] = &staged
+	return &staged, true
+}
+
+// PutGroup stages a new group
+func (tx *transaction) PutGroup(gid uint64, g *Group) {
+	delete(tx.deleted, gid)
+	tx.groups[gid] = g
+}
+
+// ReserveItemID makes sure an item id given from outside will never be allocated again
+func (tx *transaction) ReserveItemID(id uint64) {
+	if id <= registry.cursor || id <= tx.cursor {
+		return
+	}
+	tx.cursor = id
+	tx.batch.Put(metaCursorKey, helper.U64ToBytes(tx.cursor))
+}
+
+// DeleteGroup stages the removal of a group
+func (tx *transaction) DeleteGroup(gid uint64) {
+	delete(tx.groups, gid)
+	tx.deleted[gid] = struct{}{}
+	tx.batch.Delete(groupKey(gid))
+}
+
+func (tx *transaction) OnCommit(fn func()) {
+	tx.onCommit = append(tx.onCommit, fn)
+}
+
+func (tx *transaction) Commit() error {
+	for gid, g := range tx.groups {
+		if err := g.SaveToBatch(tx.batch, gid); err != nil {
+			return err
+		}
+	}
+	if err := db.Write(tx.batch); err != nil {
+		return err
+	}
+	if tx.cursor > registry.cursor {
+		registry.cursor = tx.cursor
+	}
+	for gid, staged := range tx.groups {
+		if g, ok := registry.groups[gid]; ok {
+			*g = *staged
+		} else {
+			registry.groups[gid] = staged
+		}
+	}
+	for gid := range tx.deleted {
+		delete(registry.groups, gid)
+	}
+	for _, fn := range tx.onCommit {
+		fn()
+	}
+	if len(tx.groups) != 0 || len(tx.deleted) != 0 {
+		syncGroups()
+		wakeGroupWatcher()
+	}
 	return nil
 }
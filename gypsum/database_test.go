@@ -0,0 +1,161 @@
+package gypsum
+
+import (
+	"errors"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/yuudi/gypsum/gypsum/helper"
+	"github.com/yuudi/gypsum/gypsum/storage"
+)
+
+var errTestWrite = errors.New("test: write failed")
+
+var (
+	templatingOnce sync.Once
+	templatingErr  error
+)
+
+// testMemory keeps its data when closed, so that a test can open the database again
+type testMemory struct {
+	*storage.Memory
+	failWrite bool
+}
+
+func (m *testMemory) Write(batch *storage.Batch) error {
+	if m.failWrite {
+		return errTestWrite
+	}
+	return m.Memory.Write(batch)
+}
+
+func (m *testMemory) Close() error {
+	return nil
+}
+
+// useTestMemory makes the "memory" backend return the same store every time it is opened
+func useTestMemory(t *testing.T) *testMemory {
+	t.Helper()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	mem := &testMemory{Memory: storage.NewMemory()}
+	previous := newMemoryStorage
+	newMemoryStorage = func() storage.Storage {
+		return mem
+	}
+	t.Cleanup(func() {
+		newMemoryStorage = previous
+		os.Chdir(wd)
+	})
+	Config = &ConfigType{ResourceShare: "file", Storage: "memory"}
+	return mem
+}
+
+// openTestRegistry loads everything in the store into a new registry, the way gypsum starts
+func openTestRegistry(t *testing.T) {
+	t.Helper()
+	// templating registers filters and tags globally, it can be initialized only once
+	templatingOnce.Do(func() {
+		templatingErr = initTemplating()
+	})
+	if templatingErr != nil {
+		t.Fatal(templatingErr)
+	}
+	registry = newItemRegistry()
+	if err := initDb(); err != nil {
+		t.Fatal(err)
+	}
+	if err := loadData(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// callHandler runs an api handler and returns the status and the body of the response.
+// target is the request uri, it only matters for handlers reading the query.
+func callHandler(h gin.HandlerFunc, method, target, body string, params ...string) (int, string) {
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest(method, target, strings.NewReader(body))
+	c.Request.Header.Set("Content-Type", "application/json")
+	for i := 0; i+1 < len(params); i += 2 {
+		c.Params = append(c.Params, gin.Param{Key: params[i], Value: params[i+1]})
+	}
+	h(c)
+	return w.Code, w.Body.String()
+}
+
+func TestMain(m *testing.M) {
+	gin.SetMode(gin.TestMode)
+	os.Exit(m.Run())
+}
+
+func TestFailedTransactionLeavesRegistryUnchanged(t *testing.T) {
+	mem := useTestMemory(t)
+	openTestRegistry(t)
+	if code, body := callHandler(createGroup, "POST", "/", `{"display_name":"kept","active":true}`); code != 201 {
+		t.Fatalf("create group: %d %s", code, body)
+	}
+	groupsBefore := len(registry.groups)
+	rootItemsBefore := len(registry.groups[0].Items)
+	rulesBefore := len(registry.rules)
+	cursorBefore := registry.cursor
+
+	mem.failWrite = true
+	code, body := callHandler(createRule, "POST", "/", `{"display_name":"lost","active":true,"patterns":["hi"],"response":"hello"}`)
+	if code < 400 {
+		t.Fatalf("rule is created while the write fails: %s", body)
+	}
+	if code, body := callHandler(createGroup, "POST", "/", `{"display_name":"lost","active":true}`); code < 400 {
+		t.Fatalf("group is created while the write fails: %s", body)
+	}
+
+	if len(registry.groups) != groupsBefore {
+		t.Errorf("groups: got %d, want %d", len(registry.groups), groupsBefore)
+	}
+	if len(registry.groups[0].Items) != rootItemsBefore {
+		t.Errorf("items of root group: got %d, want %d", len(registry.groups[0].Items), rootItemsBefore)
+	}
+	if len(registry.rules) != rulesBefore {
+		t.Errorf("rules: got %d, want %d", len(registry.rules), rulesBefore)
+	}
+	for _, item := range registry.groups[0].Items {
+		if item.DisplayName == "lost" {
+			t.Errorf("root group lists an item that was never saved: %+v", item)
+		}
+	}
+	if registry.cursor != cursorBefore {
+		t.Errorf("cursor: got %d, want %d", registry.cursor, cursorBefore)
+	}
+
+	// ids of failed transactions are given out again
+	mem.failWrite = false
+	code, body = callHandler(createRule, "POST", "/", `{"display_name":"saved","active":true,"patterns":["hi"],"response":"hello"}`)
+	if code != 201 {
+		t.Fatalf("create rule: %d %s", code, body)
+	}
+	if _, ok := registry.rules[cursorBefore+1]; !ok {
+		t.Errorf("rule is not created with id %d: %s", cursorBefore+1, body)
+	}
+	saved, err := mem.Get(metaCursorKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := helper.ToUint(saved); got != registry.cursor {
+		t.Errorf("saved cursor: got %d, want %d", got, registry.cursor)
+	}
+}
+
+func itoa(id uint64) string {
+	return strconv.FormatUint(id, 10)
+}
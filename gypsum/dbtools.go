@@ -0,0 +1,453 @@
+package gypsum
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/yuudi/gypsum/gypsum/helper"
+	"github.com/yuudi/gypsum/gypsum/storage"
+	"github.com/yuudi/gypsum/gypsum/userdata"
+)
+
+const databasePath = "gypsum_data/data"
+
+// databasePrefixes are all kinds of keys kept in database, keys matching none of them are counted as "other"
+var databasePrefixes = []struct {
+	prefix      string
+	description string
+}{
+	{"gypsum-$meta-", "metadata"},
+	{"gypsum-groups-", "groups"},
+	{"gypsum-rules-", "rules"},
+	{"gypsum-triggers-", "triggers"},
+	{"gypsum-jobs-", "jobs"},
+	{"gypsum-resources-", "resources"},
+	{"gypsum-resources_hash-", "resource hash index"},
+	{"gypsum-revisions-", "revisions"},
+	{"gypsum-trash-", "trash"},
+	{"gypsum-userDB-p-", "userdata"},
+	{"gypsum-userDB-lua-", "legacy lua userdata"},
+	{"gypsum-userDB-p@", "plugin userdata"},
+	{"gypsum-userDB-lua@", "legacy plugin lua userdata"},
+}
+
+func databasePrefixOf(key []byte) (string, bool) {
+	for _, p := range databasePrefixes {
+		if bytes.HasPrefix(key, []byte(p.prefix)) {
+			return p.prefix, true
+		}
+	}
+	return "", false
+}
+
+// itemTypeOfPrefix tells which kind of item is saved under the prefix
+func itemTypeOfPrefix(prefix string) (ItemType, bool) {
+	for _, kind := range recordPrefixes {
+		if kind.prefix == prefix {
+			return kind.itemType, true
+		}
+	}
+	return "", false
+}
+
+type PrefixStats struct {
+	Prefix      string `json:"prefix"`
+	Description string `json:"description"`
+	Keys        int    `json:"keys"`
+	Bytes       int    `json:"bytes"`
+}
+
+type DatabaseStats struct {
+	Storage  string        `json:"storage"`
+	Keys     int           `json:"keys"`
+	Bytes    int           `json:"bytes"`
+	Prefixes []PrefixStats `json:"prefixes"`
+	LevelDB  string        `json:"leveldb,omitempty"`
+}
+
+func (s *DatabaseStats) Lines() []string {
+	lines := make([]string, 0, len(s.Prefixes)+3)
+	lines = append(lines, "storage: "+s.Storage)
+	for _, p := range s.Prefixes {
+		lines = append(lines, fmt.Sprintf("%-24s %8d keys %12d bytes  %s", p.Prefix, p.Keys, p.Bytes, p.Description))
+	}
+	lines = append(lines, fmt.Sprintf("%-24s %8d keys %12d bytes", "total", s.Keys, s.Bytes))
+	if s.LevelDB != "" {
+		lines = append(lines, s.LevelDB)
+	}
+	return lines
+}
+
+func storageName() string {
+	if Config == nil || Config.Storage == "" {
+		return "leveldb"
+	}
+	return Config.Storage
+}
+
+// databaseStats counts keys and bytes under every known prefix
+func databaseStats() (*DatabaseStats, error) {
+	stats := &DatabaseStats{
+		Storage:  storageName(),
+		Prefixes: make([]PrefixStats, 0, len(databasePrefixes)+1),
+	}
+	index := make(map[string]int, len(databasePrefixes))
+	for i, p := range databasePrefixes {
+		index[p.prefix] = i
+		stats.Prefixes = append(stats.Prefixes, PrefixStats{
+			Prefix:      p.prefix,
+			Description: p.description,
+		})
+	}
+	stats.Prefixes = append(stats.Prefixes, PrefixStats{
+		Prefix:      "(other)",
+		Description: "unknown keys",
+	})
+	iter := db.NewIterator(nil)
+	defer iter.Release()
+	for iter.Next() {
+		i := len(databasePrefixes)
+		if prefix, ok := databasePrefixOf(iter.Key()); ok {
+			i = index[prefix]
+		}
+		size := len(iter.Key()) + len(iter.Value())
+		stats.Prefixes[i].Keys++
+		stats.Prefixes[i].Bytes += size
+		stats.Keys++
+		stats.Bytes += size
+	}
+	if l, ok := db.(*storage.LevelDB); ok {
+		stats.LevelDB, _ = l.Property("leveldb.stats")
+	}
+	return stats, iter.Error()
+}
+
+func compactDatabase() error {
+	c, ok := db.(storage.Compactor)
+	if !ok {
+		return errors.New(fmt.Sprintf("storage %s does not support compaction", storageName()))
+	}
+	return c.Compact()
+}
+
+type VerifyReport struct {
+	Scanned  int      `json:"scanned"`
+	Problems []string `json:"problems"`
+}
+
+func (r *VerifyReport) Lines() []string {
+	lines := make([]string, 0, len(r.Problems)+1)
+	lines = append(lines, r.Problems...)
+	lines = append(lines, fmt.Sprintf("%d keys scanned, %d problems found", r.Scanned, len(r.Problems)))
+	return lines
+}
+
+// verifyDatabase decodes every record gypsum saved itself and reports the ones that cannot be read.
+// Userdata is only counted, its content belongs to plugins.
+func verifyDatabase() (*VerifyReport, error) {
+	report := &VerifyReport{
+		Problems: []string{},
+	}
+	problem := func(key []byte, format string, a ...interface{}) {
+		report.Problems = append(report.Problems, formatDatabaseKey(key)+": "+fmt.Sprintf(format, a...))
+	}
+	var cursor uint64
+	if v, err := db.Get(metaCursorKey); err == nil {
+		cursor = helper.ToUint(v)
+	} else if err != storage.ErrNotFound {
+		return report, err
+	}
+	iter := db.NewIterator(nil)
+	defer iter.Release()
+	for iter.Next() {
+		report.Scanned++
+		key, value := iter.Key(), iter.Value()
+		prefix, ok := databasePrefixOf(key)
+		if !ok {
+			problem(key, "unknown key")
+			continue
+		}
+		rest := key[len(prefix):]
+		if itemType, ok := itemTypeOfPrefix(prefix); ok {
+			if len(rest) != 8 {
+				problem(key, "malformed key")
+				continue
+			}
+			if _, err := itemFromBytes(itemType, value); err != nil {
+				problem(key, "cannot decode %s: %s", itemType, err)
+			}
+			if id := helper.ToUint(rest); id > cursor {
+				problem(key, "id %d is beyond cursor %d", id, cursor)
+			}
+			continue
+		}
+		switch prefix {
+		case "gypsum-resources_hash-":
+			if len(value) != 8 {
+				problem(key, "malformed resource id")
+				continue
+			}
+			if has, err := db.Has(resourceKey(helper.ToUint(value))); err == nil && !has {
+				problem(key, "resource %d does not exist", helper.ToUint(value))
+			}
+		case "gypsum-revisions-":
+			if len(rest) != 16 {
+				problem(key, "malformed key")
+				continue
+			}
+			r, err := RevisionFromBytes(value)
+			if err != nil {
+				problem(key, "cannot decode revision: %s", err)
+				continue
+			}
+			if _, err = itemFromBytes(r.ItemType, r.ItemBytes); err != nil {
+				problem(key, "cannot decode %s: %s", r.ItemType, err)
+			}
+		case "gypsum-trash-":
+			if len(rest) != 8 {
+				problem(key, "malformed key")
+				continue
+			}
+			e, err := TrashEntryFromBytes(value)
+			if err != nil {
+				problem(key, "cannot decode trash entry: %s", err)
+				continue
+			}
+			if e.ItemID != helper.ToUint(rest) {
+				problem(key, "trash entry holds item %d", e.ItemID)
+			}
+			for _, item := range append([]TrashItem{e.TrashItem}, e.Children...) {
+				if _, err = itemFromBytes(item.ItemType, item.ItemBytes); err != nil {
+					problem(key, "cannot decode %s %d: %s", item.ItemType, item.ItemID, err)
+				}
+			}
+		}
+	}
+	return report, iter.Error()
+}
+
+// formatDatabaseKey shows ids in keys as numbers and other binary parts as hex
+func formatDatabaseKey(key []byte) string {
+	prefix, ok := databasePrefixOf(key)
+	if !ok {
+		return printableBytes(key)
+	}
+	rest := key[len(prefix):]
+	if _, ok := itemTypeOfPrefix(prefix); ok && len(rest) == 8 {
+		return prefix + strconv.FormatUint(helper.ToUint(rest), 10)
+	}
+	switch {
+	case prefix == "gypsum-trash-" && len(rest) == 8:
+		return prefix + strconv.FormatUint(helper.ToUint(rest), 10)
+	case prefix == "gypsum-revisions-" && len(rest) == 16:
+		return fmt.Sprintf("%s%d-%d", prefix, helper.ToUint(rest[:8]), binary.BigEndian.Uint64(rest[8:]))
+	case prefix == "gypsum-resources_hash-":
+		return prefix + hex.EncodeToString(rest)
+	case strings.HasSuffix(prefix, "@"):
+		// plugin namespace and key are separated by a zero byte
+		if i := bytes.IndexByte(rest, 0); i >= 0 {
+			return prefix + printableBytes(rest[:i]) + "/" + printableBytes(rest[i+1:])
+		}
+	}
+	return prefix + printableBytes(rest)
+}
+
+func printableBytes(b []byte) string {
+	if utf8.Valid(b) && strings.IndexFunc(string(b), func(r rune) bool { return r < 0x20 }) < 0 {
+		return string(b)
+	}
+	return "0x" + hex.EncodeToString(b)
+}
+
+// formatDatabaseValue shows records as json and other values as text or hex
+func formatDatabaseValue(key, value []byte) string {
+	prefix, _ := databasePrefixOf(key)
+	var decoded interface{}
+	if itemType, ok := itemTypeOfPrefix(prefix); ok {
+		if item, err := itemFromBytes(itemType, value); err == nil {
+			decoded = item
+		}
+	}
+	switch prefix {
+	case "gypsum-resources_hash-":
+		if len(value) == 8 {
+			return strconv.FormatUint(helper.ToUint(value), 10)
+		}
+	case "gypsum-revisions-":
+		if r, err := RevisionFromBytes(value); err == nil {
+			if item, err := itemFromBytes(r.ItemType, r.ItemBytes); err == nil {
+				decoded = gin.H{"item_type": r.ItemType, "item": item}
+			}
+		}
+	case "gypsum-trash-":
+		if e, err := TrashEntryFromBytes(value); err == nil {
+			decoded = gin.H{
+				"item_type":    e.ItemType,
+				"item_id":      e.ItemID,
+				"parent_group": e.ParentGroup,
+				"deleted_at":   e.DeletedAt,
+				"items":        len(e.Children),
+			}
+		}
+	case "gypsum-userDB-p-", "gypsum-userDB-p@":
+		v := userdata.ValueFromBytes(value)
+		if data, err := userdata.DecodeValue(v); err == nil {
+			h := gin.H{"value": data}
+			if !v.ExpiresAt.IsZero() {
+				h["expires_at"] = v.ExpiresAt
+			}
+			decoded = h
+		}
+	}
+	if bytes.Equal(key, metaCursorKey) && len(value) == 8 {
+		return strconv.FormatUint(helper.ToUint(value), 10)
+	}
+	if decoded != nil {
+		if b, err := json.Marshal(decoded); err == nil {
+			return string(b)
+		}
+	}
+	return printableBytes(value)
+}
+
+type dumpEntry struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+// dumpDatabase lists keys with the prefix and their readable values
+func dumpDatabase(prefix string) ([]dumpEntry, error) {
+	entries := make([]dumpEntry, 0)
+	iter := db.NewIterator([]byte(prefix))
+	defer iter.Release()
+	for iter.Next() {
+		entries = append(entries, dumpEntry{
+			Key:   formatDatabaseKey(iter.Key()),
+			Value: formatDatabaseValue(iter.Key(), iter.Value()),
+		})
+	}
+	return entries, iter.Error()
+}
+
+// MaintainDatabase runs a database command on gypsum_data while gypsum is not running
+func MaintainDatabase(action, prefix string, logger func(...interface{})) error {
+	if action == "repair" {
+		if storageName() != "leveldb" {
+			return errors.New(fmt.Sprintf("storage %s cannot be repaired", storageName()))
+		}
+		if err := storage.RepairLevelDB(databasePath); err != nil {
+			return err
+		}
+		logger("database recovered, run `gypsum db verify` to check the records")
+		return nil
+	}
+	if err := openDb(); err != nil {
+		return err
+	}
+	defer db.Close()
+	switch action {
+	case "stats":
+		stats, err := databaseStats()
+		for _, line := range stats.Lines() {
+			logger(line)
+		}
+		return err
+	case "compact":
+		if err := compactDatabase(); err != nil {
+			return err
+		}
+		logger("database compacted")
+		return nil
+	case "verify":
+		report, err := verifyDatabase()
+		for _, line := range report.Lines() {
+			logger(line)
+		}
+		if err == nil && len(report.Problems) != 0 {
+			err = errors.New(fmt.Sprintf("%d problems found", len(report.Problems)))
+		}
+		return err
+	case "dump":
+		entries, err := dumpDatabase(prefix)
+		for _, e := range entries {
+			logger(e.Key, e.Value)
+		}
+		return err
+	default:
+		return errors.New("unknown database command: " + action)
+	}
+}
+
+func getDatabaseStats(c *gin.Context) {
+	stats, err := databaseStats()
+	if err != nil {
+		c.JSON(500, gin.H{
+			"code":    3000,
+			"message": fmt.Sprintf("Server got itself into trouble: %s", err),
+		})
+		return
+	}
+	c.JSON(200, stats)
+}
+
+func compactDatabaseHandler(c *gin.Context) {
+	if _, ok := db.(storage.Compactor); !ok {
+		c.JSON(422, gin.H{
+			"code":    3040,
+			"message": fmt.Sprintf("storage %s does not support compaction", storageName()),
+		})
+		return
+	}
+	if err := compactDatabase(); err != nil {
+		c.JSON(500, gin.H{
+			"code":    3000,
+			"message": fmt.Sprintf("Server got itself into trouble: %s", err),
+		})
+		return
+	}
+	c.JSON(200, gin.H{
+		"code":    0,
+		"message": "compacted",
+	})
+}
+
+func verifyDatabaseHandler(c *gin.Context) {
+	registry.RLock()
+	defer registry.RUnlock()
+	report, err := verifyDatabase()
+	if err != nil {
+		c.JSON(500, gin.H{
+			"code":     3000,
+			"message":  fmt.Sprintf("Server got itself into trouble: %s", err),
+			"problems": report.Problems,
+		})
+		return
+	}
+	c.JSON(200, gin.H{
+		"code":     0,
+		"message":  "ok",
+		"scanned":  report.Scanned,
+		"problems": report.Problems,
+	})
+}
+
+func dumpDatabaseHandler(c *gin.Context) {
+	entries, err := dumpDatabase(c.Query("prefix"))
+	if err != nil {
+		c.JSON(500, gin.H{
+			"code":    3000,
+			"message": fmt.Sprintf("Server got itself into trouble: %s", err),
+		})
+		return
+	}
+	c.JSON(200, entries)
+}
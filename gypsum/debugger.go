@@ -12,17 +12,24 @@ import (
 	"github.com/tidwall/gjson"
 	zero "github.com/wdvxdr1123/ZeroBot"
 	zeroMessage "github.com/wdvxdr1123/ZeroBot/message"
-	lua "github.com/yuin/gopher-lua"
+
+	"github.com/yuudi/gypsum/gypsum/normalize"
 )
 
 type testCase struct {
 	Event       gjson.Result
 	DebugType   string
 	MatcherType RuleType
-	Pattern     string
+	Patterns    []string
+	Threshold   float64
+	Normalize   normalize.Options
 	Response    string
+	Limits      ExecutionLimits
 }
 
+// debuggerItem names renders of the debugger in logs
+const debuggerItem = "debugger"
+
 type responseReceiver struct {
 	contents strings.Builder
 }
@@ -40,29 +47,16 @@ func (r *responseReceiver) String() string {
 }
 
 func (t *testCase) TestMessage() (string, bool, error) {
-	var zeroRule zero.Rule
-	switch t.MatcherType {
-	case FullMatch:
-		zeroRule = zero.FullMatchRule(t.Pattern)
-	case Keyword:
-		zeroRule = zero.KeywordRule(t.Pattern)
-	case Prefix:
-		zeroRule = zero.PrefixRule(t.Pattern)
-	case Suffix:
-		zeroRule = zero.SuffixRule(t.Pattern)
-	case Command:
-		zeroRule = zero.CommandRule(t.Pattern)
-	case Regex:
-		if err := checkRegex(t.Pattern); err != nil {
-			return "", false, errors.New("正则语法错误：" + err.Error())
-		}
-		zeroRule = zero.RegexRule(t.Pattern)
-	default:
-		return "", false, errors.New(fmt.Sprintf("Unknown type %#v", t.MatcherType))
+	if _, err := checkPatterns(t.MatcherType, t.Patterns, t.Threshold); err != nil {
+		return "", false, err
+	}
+	zeroRule, err := messageRule(t.MatcherType, t.Patterns, t.Threshold, t.Normalize)
+	if err != nil {
+		return "", false, err
 	}
 	var event zero.Event
 	var state zero.State = make(map[string]interface{})
-	err := jsoniter.UnmarshalFromString(t.Event.String(), &event)
+	err = jsoniter.UnmarshalFromString(t.Event.String(), &event)
 	if err != nil {
 		return "", false, errors.New("json解析出错：" + err.Error())
 	}
@@ -77,7 +71,7 @@ func (t *testCase) TestMessage() (string, bool, error) {
 		return "", true, errors.New("模板预处理出错：" + err.Error())
 	}
 	var receiver responseReceiver
-	handler := templateRuleHandler(*tmpl, receiver.ReceiveSend, receiver.ReceiveLogger)
+	handler := templateRuleHandler(*tmpl, debuggerItem, t.Limits, globalNamespace, receiver.ReceiveSend, receiver.ReceiveLogger)
 	handler(nil, event, state)
 	return receiver.String(), true, nil
 }
@@ -91,7 +85,7 @@ func (t *testCase) TestNotice() (string, error) {
 	var state zero.State
 	event.RawEvent = t.Event
 	var receiver responseReceiver
-	handler := templateTriggerHandler(*tmpl, receiver.ReceiveSend, receiver.ReceiveLogger)
+	handler := templateTriggerHandler(*tmpl, debuggerItem, t.Limits, globalNamespace, receiver.ReceiveSend, receiver.ReceiveLogger)
 	handler(nil, event, state)
 	return receiver.String(), nil
 }
@@ -101,16 +95,10 @@ func (t *testCase) TestTemplate() (string, error) {
 	if err != nil {
 		return "", errors.New("模板预处理出错：" + err.Error())
 	}
-	var luaState *lua.LState
-	defer func() {
-		if luaState != nil {
-			luaState.Close()
-		}
-	}()
-	msg, err := tmpl.Execute(pongo2.Context{
-		"_lua": luaState,
-	})
-	if err != nil {
+	exe := newExecution(debuggerItem, t.Limits)
+	defer exe.Close()
+	msg, err := tmpl.Execute(exe.Context(globalNamespace()))
+	if err = exe.Check(err); err != nil {
 		return "", errors.New("渲染模板出错：" + err.Error())
 	}
 	msg = strings.TrimSpace(msg)
@@ -147,9 +135,34 @@ func userTest(c *gin.Context) {
 		Event:       req["event"],
 		DebugType:   req["debug_type"].String(),
 		MatcherType: RuleType(req["matcher_type"].Int()),
-		Pattern:     req["pattern"].String(),
+		Threshold:   req["threshold"].Float(),
 		Response:    req["response"].String(),
 	}
+	if patterns, ok := req["patterns"]; ok {
+		for _, pattern := range patterns.Array() {
+			t.Patterns = append(t.Patterns, pattern.String())
+		}
+	} else {
+		t.Patterns = []string{req["pattern"].String()}
+	}
+	if normalization, ok := req["normalize"]; ok {
+		if err := jsoniter.UnmarshalFromString(normalization.Raw, &t.Normalize); err != nil {
+			c.JSON(400, gin.H{
+				"code":    2000,
+				"message": fmt.Sprintf("converting error: %s", err),
+			})
+			return
+		}
+	}
+	if limits, ok := req["limits"]; ok {
+		if err := jsoniter.UnmarshalFromString(limits.Raw, &t.Limits); err != nil {
+			c.JSON(400, gin.H{
+				"code":    2000,
+				"message": fmt.Sprintf("converting error: %s", err),
+			})
+			return
+		}
+	}
 	reply, matched, err := t.RunTest()
 	if err != nil {
 		c.JSON(200, gin.H{
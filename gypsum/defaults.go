@@ -0,0 +1,191 @@
+package gypsum
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+)
+
+// ItemFilters are the filters of rules and triggers which can be given as defaults of a group.
+// A zero value is not set: an item inherits it from its group, and a group inherits it from its parent group,
+// unless it is marked in Overrides.
+type ItemFilters struct {
+	MessageType MessageType     `json:"message_type" yaml:"message_type,omitempty"` // rules only
+	GroupsID    []int64         `json:"groups_id" yaml:"groups_id,omitempty"`
+	UsersID     []int64         `json:"users_id" yaml:"users_id,omitempty"`
+	Priority    int             `json:"priority" yaml:"priority,omitempty"`
+	Overrides   FilterOverrides `json:"overrides" yaml:"overrides,omitempty"`
+}
+
+// FilterOverrides marks filters that are used even if they are empty or 0, instead of being inherited.
+// An empty list then means all groups or all users, as if no group set a default.
+type FilterOverrides struct {
+	GroupsID bool `json:"groups_id" yaml:"groups_id,omitempty"`
+	UsersID  bool `json:"users_id" yaml:"users_id,omitempty"`
+	Priority bool `json:"priority" yaml:"priority,omitempty"`
+}
+
+// fill sets the unset filters from defaults
+func (f ItemFilters) fill(defaults ItemFilters) ItemFilters {
+	if f.MessageType == NoMessage {
+		f.MessageType = defaults.MessageType
+	}
+	if len(f.GroupsID) == 0 && !f.Overrides.GroupsID {
+		f.GroupsID = defaults.GroupsID
+		f.Overrides.GroupsID = defaults.Overrides.GroupsID
+	}
+	if len(f.UsersID) == 0 && !f.Overrides.UsersID {
+		f.UsersID = defaults.UsersID
+		f.Overrides.UsersID = defaults.Overrides.UsersID
+	}
+	if f.Priority == 0 && !f.Overrides.Priority {
+		f.Priority = defaults.Priority
+		f.Overrides.Priority = defaults.Overrides.Priority
+	}
+	return f
+}
+
+// knownMessageTypes are all bits of message types
+const knownMessageTypes = PrivateMessage | GroupMessage | DiscussMessage | OfficialMessage
+
+func (f ItemFilters) check() error {
+	if f.MessageType != AllMessage && f.MessageType&^knownMessageTypes != 0 {
+		return errors.New(fmt.Sprintf("unknown message type: %d", f.MessageType))
+	}
+	for _, id := range f.GroupsID {
+		if id <= 0 {
+			return errors.New(fmt.Sprintf("invalid group id: %d", id))
+		}
+	}
+	for _, id := range f.UsersID {
+		if id <= 0 {
+			return errors.New(fmt.Sprintf("invalid user id: %d", id))
+		}
+	}
+	return nil
+}
+
+func sameIDs(a, b []int64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func (f *ItemFilters) equal(other *ItemFilters) bool {
+	return f.MessageType == other.MessageType && f.Priority == other.Priority && f.Overrides == other.Overrides &&
+		sameIDs(f.GroupsID, other.GroupsID) && sameIDs(f.UsersID, other.UsersID)
+}
+
+// inheritedDefaults merges the defaults of a group and all its parents, the nearest one wins.
+// The registry must be locked.
+func inheritedDefaults(gid uint64) ItemFilters {
+	var defaults ItemFilters
+	visited := make(map[uint64]bool)
+	for !visited[gid] {
+		visited[gid] = true
+		g, ok := registry.groups[gid]
+		if !ok {
+			break
+		}
+		defaults = defaults.fill(g.Defaults)
+		if gid == 0 {
+			break
+		}
+		gid = g.ParentGroup
+	}
+	return defaults
+}
+
+func (r *Rule) ownFilters() ItemFilters {
+	return ItemFilters{
+		MessageType: r.MessageType,
+		GroupsID:    r.GroupsID,
+		UsersID:     r.UsersID,
+		Priority:    r.Priority,
+		Overrides:   r.Overrides,
+	}
+}
+
+// filters returns the filters the rule is registered with, unset ones are taken from its groups
+func (r *Rule) filters() ItemFilters {
+	return r.ownFilters().fill(inheritedDefaults(r.ParentGroup))
+}
+
+func (t *Trigger) ownFilters() ItemFilters {
+	return ItemFilters{
+		GroupsID:  t.GroupsID,
+		UsersID:   t.UsersID,
+		Priority:  t.Priority,
+		Overrides: t.Overrides,
+	}
+}
+
+// filters returns the filters the trigger is registered with, triggers have no message type
+func (t *Trigger) filters() ItemFilters {
+	f := t.ownFilters().fill(inheritedDefaults(t.ParentGroup))
+	f.MessageType = NoMessage
+	return f
+}
+
+func setGroupDefaults(c *gin.Context) {
+	groupIDStr := c.Param("gid")
+	groupID, err := strconv.ParseUint(groupIDStr, 10, 64)
+	if err != nil {
+		c.JSON(404, gin.H{
+			"code":    1000,
+			"message": "no such group",
+		})
+		return
+	}
+	var defaults ItemFilters
+	if err = c.BindJSON(&defaults); err != nil {
+		c.JSON(400, gin.H{
+			"code":    2000,
+			"message": fmt.Sprintf("converting error: %s", err),
+		})
+		return
+	}
+	if err = defaults.check(); err != nil {
+		c.JSON(422, gin.H{
+			"code":    2049,
+			"message": fmt.Sprintf("filters error: %s", err),
+		})
+		return
+	}
+	registry.Lock()
+	defer registry.Unlock()
+	group, ok := registry.groups[groupID]
+	if !ok {
+		c.JSON(404, gin.H{
+			"code":    1000,
+			"message": "no such group",
+		})
+		return
+	}
+	tx := newTransaction()
+	if err = tx.SaveRevision(GroupItem, groupID, group); err != nil {
+		log.Errorf("error when saving revision of group %d: %s", groupID, err)
+	}
+	staged, _ := tx.Group(groupID)
+	staged.Defaults = defaults
+	if err = tx.Commit(); err != nil {
+		c.JSON(500, gin.H{
+			"code":    3000,
+			"message": fmt.Sprintf("Server got itself into trouble: %s", err),
+		})
+		return
+	}
+	c.JSON(200, gin.H{
+		"code":    0,
+		"message": "ok",
+	})
+}
@@ -14,12 +14,14 @@ import (
 	"path"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	log "github.com/sirupsen/logrus"
-	"github.com/syndtr/goleveldb/leveldb/util"
 
 	"github.com/yuudi/gypsum/gypsum/helper"
+	"github.com/yuudi/gypsum/gypsum/storage"
+	"github.com/yuudi/gypsum/gypsum/userdata"
 )
 
 type Item struct {
@@ -29,11 +31,15 @@ type Item struct {
 }
 
 type Group struct {
-	DisplayName   string `json:"display_name"`
-	PluginName    string `json:"plugin_name"`
-	PluginVersion int64  `json:"plugin_version"`
-	Items         []Item `json:"items"`
-	ParentGroup   uint64 `json:"-"`
+	DisplayName   string      `json:"display_name" yaml:"display_name"`
+	PluginName    string      `json:"plugin_name" yaml:"plugin_name"`
+	PluginVersion int64       `json:"plugin_version" yaml:"plugin_version"`
+	Active        bool        `json:"active" yaml:"active"`
+	StartAt       *time.Time  `json:"start_at" yaml:"start_at,omitempty"` // items are registered from then on
+	EndAt         *time.Time  `json:"end_at" yaml:"end_at,omitempty"`     // items are unregistered from then on
+	Defaults      ItemFilters `json:"defaults" yaml:"defaults,omitempty"`
+	Items         []Item      `json:"items" yaml:"-"`
+	ParentGroup   uint64      `json:"-" yaml:"-"`
 }
 
 type ArchiveItem struct {
@@ -48,28 +54,35 @@ type GroupArchive struct {
 	PluginVersion int64
 	GypsumVersion string
 	GypsumCommit  string
+	Inactive      bool // inverted, so that archives exported by older versions are active
+	StartAt       *time.Time
+	EndAt         *time.Time
+	Defaults      ItemFilters
 	ArchiveItems  []ArchiveItem
+	UserData      []ArchiveUserData // only when exported with data
 }
 
-var groups map[uint64]*Group
-
 func (g *Group) ToBytes() ([]byte, error) {
 	buffer := bytes.Buffer{}
 	encoder := gob.NewEncoder(&buffer)
 	if err := encoder.Encode(g); err != nil {
 		return nil, err
 	}
-	return buffer.Bytes(), nil
+	return sealRecord(GroupItem, buffer.Bytes()), nil
 }
 
 func GroupFromBytes(b []byte) (*Group, error) {
 	g := &Group{
 		Items: []Item{},
 	}
+	payload, err := openRecord(GroupItem, b)
+	if err != nil {
+		return g, err
+	}
 	buffer := bytes.Buffer{}
-	buffer.Write(b)
+	buffer.Write(payload)
 	decoder := gob.NewDecoder(&buffer)
-	err := decoder.Decode(g)
+	err = decoder.Decode(g)
 	return g, err
 }
 
@@ -83,27 +96,39 @@ func (g *GroupArchive) ToBytes() ([]byte, error) {
 }
 
 func (g Group) ExportToArchive(name string, version int64) *GroupArchive {
-	archiveItems := make([]ArchiveItem, len(g.Items))
-	for i, item := range g.Items {
-		if item.ItemType == GroupItem {
-			log.Warnf("group in group are not supported yet, exporting would ignore group %d", item.ItemID)
-			continue
-		}
+	return g.exportToArchive(name, version, make(map[uint64]bool))
+}
+
+// exportToArchive exports the group with all its items, subgroups are exported as archives in the archive
+func (g *Group) exportToArchive(name string, version int64, visited map[uint64]bool) *GroupArchive {
+	archiveItems := make([]ArchiveItem, 0, len(g.Items))
+	for _, item := range g.Items {
 		it, ok := findItem(item.ItemType, item.ItemID)
 		if !ok {
 			log.Errorf("cannot find item: type:%s, id: %d", item.ItemType, item.ItemID)
 			continue
 		}
-		itBytes, err := it.ToBytes()
+		var itBytes []byte
+		var err error
+		if sub, ok := it.(*Group); ok {
+			if visited[item.ItemID] {
+				log.Errorf("group %d is in a cycle, exporting would ignore it", item.ItemID)
+				continue
+			}
+			visited[item.ItemID] = true
+			itBytes, err = sub.exportToArchive(sub.PluginName, sub.PluginVersion, visited).ToBytes()
+		} else {
+			itBytes, err = it.ToBytes()
+		}
 		if err != nil {
 			log.Error(err)
 			continue
 		}
-		archiveItems[i] = ArchiveItem{
+		archiveItems = append(archiveItems, ArchiveItem{
 			ItemType:    item.ItemType,
 			DisplayName: item.DisplayName,
 			ItemBytes:   itBytes,
-		}
+		})
 	}
 	return &GroupArchive{
 		DisplayName:   g.DisplayName,
@@ -111,11 +136,15 @@ func (g Group) ExportToArchive(name string, version int64) *GroupArchive {
 		PluginVersion: version,
 		GypsumVersion: BuildVersion,
 		GypsumCommit:  BuildCommit,
+		Inactive:      !g.Active,
+		StartAt:       g.StartAt,
+		EndAt:         g.EndAt,
+		Defaults:      g.Defaults,
 		ArchiveItems:  archiveItems,
 	}
 }
 
-func GroupFromArchiveReader(reader io.Reader, newGroupID uint64) (*Group, error) {
+func GroupFromArchiveReader(tx *transaction, reader io.Reader, newGroupID uint64) (*Group, error) {
 	ga := &GroupArchive{
 		DisplayName:   "",
 		PluginName:    "",
@@ -128,32 +157,49 @@ func GroupFromArchiveReader(reader io.Reader, newGroupID uint64) (*Group, error)
 	if err := decoder.Decode(ga); err != nil {
 		return nil, err
 	}
+	if ga.PluginName != "" && len(ga.UserData) != 0 {
+		if err := tx.restorePluginUserData(ga.PluginName, ga.UserData); err != nil {
+			return nil, err
+		}
+	}
+	return groupFromArchive(tx, ga, newGroupID), nil
+}
+
+// groupFromArchive restores all items of an archive into a new group, subgroups are restored recursively
+func groupFromArchive(tx *transaction, ga *GroupArchive, newGroupID uint64) *Group {
 	g := &Group{
 		DisplayName:   ga.DisplayName,
 		PluginName:    ga.PluginName,
 		PluginVersion: ga.PluginVersion,
+		Active:        !ga.Inactive,
+		StartAt:       ga.StartAt,
+		EndAt:         ga.EndAt,
+		Defaults:      ga.Defaults,
 		Items:         nil,
 		ParentGroup:   0,
 	}
-	g.Items = make([]Item, len(ga.ArchiveItems))
-	for i, item := range ga.ArchiveItems {
-		idx, err := RestoreFromUserRecord(item.ItemType, item.ItemBytes, newGroupID)
+	g.Items = make([]Item, 0, len(ga.ArchiveItems))
+	for _, item := range ga.ArchiveItems {
+		if item.ItemType == "" {
+			// skipped when exported by older version
+			continue
+		}
+		idx, err := RestoreFromUserRecord(tx, item.ItemType, item.ItemBytes, newGroupID)
 		if err != nil {
 			log.Error(err)
 			continue
 		}
-		g.Items[i] = Item{
+		g.Items = append(g.Items, Item{
 			ItemType:    item.ItemType,
 			DisplayName: item.DisplayName,
 			ItemID:      idx,
-		}
+		})
 	}
-	return g, nil
+	return g
 }
 
 func loadGroups() {
-	groups = make(map[uint64]*Group)
-	iter := db.NewIterator(util.BytesPrefix([]byte("gypsum-groups-")), nil)
+	iter := db.NewIterator([]byte("gypsum-groups-"))
 	defer func() {
 		iter.Release()
 		if err := iter.Error(); err != nil {
@@ -169,7 +215,7 @@ func loadGroups() {
 			log.Errorf("无法加载组%d：%s", key, e)
 			continue
 		}
-		groups[key] = g
+		registry.groups[key] = g
 		if key == 0 {
 			rootGroupInitialized = true
 		}
@@ -180,33 +226,47 @@ func loadGroups() {
 			DisplayName:   "root group",
 			PluginName:    "",
 			PluginVersion: 0,
+			Active:        true,
 			Items:         []Item{},
 			ParentGroup:   0,
 		}
-		groups[0] = &rootGroup
+		registry.groups[0] = &rootGroup
 	}
 }
 
+func groupKey(gid uint64) []byte {
+	return append([]byte("gypsum-groups-"), helper.U64ToBytes(gid)...)
+}
+
 func (g *Group) SaveToDB(gid uint64) error {
 	v, err := g.ToBytes()
 	if err != nil {
 		return err
 	}
-	return db.Put(append([]byte("gypsum-groups-"), helper.U64ToBytes(gid)...), v, nil)
+	return db.Put(groupKey(gid), v)
+}
+
+func (g *Group) SaveToBatch(batch *storage.Batch, gid uint64) error {
+	v, err := g.ToBytes()
+	if err != nil {
+		return err
+	}
+	batch.Put(groupKey(gid), v)
+	return nil
 }
 
 func findItem(itemType ItemType, itemID uint64) (item UserRecord, ok bool) {
 	switch itemType {
 	case RuleItem:
-		item, ok = rules[itemID]
+		item, ok = registry.rules[itemID]
 	case TriggerItem:
-		item, ok = triggers[itemID]
+		item, ok = registry.triggers[itemID]
 	case SchedulerItem:
-		item, ok = jobs[itemID]
+		item, ok = registry.jobs[itemID]
 	case ResourceItem:
-		item, ok = resources[itemID]
+		item, ok = registry.resources[itemID]
 	case GroupItem:
-		item, ok = groups[itemID]
+		item, ok = registry.groups[itemID]
 	default:
 		ok = false
 	}
@@ -221,14 +281,53 @@ func (g *Group) GetDisplayName() string {
 	return g.DisplayName
 }
 
-func (g *Group) NewParent(selfID, parentID uint64) error {
-	g.ParentGroup = parentID
-	err := g.SaveToDB(selfID)
-	return err
+func (g *Group) NewParent(tx *transaction, selfID, parentID uint64) error {
+	staged, ok := tx.Group(selfID)
+	if !ok {
+		return errors.New(fmt.Sprintf("group not found: %d", selfID))
+	}
+	staged.ParentGroup = parentID
+	return nil
+}
+
+// groupWithin tells whether a group is the ancestor itself or one of its subgroups, at any depth
+func groupWithin(gid, ancestor uint64) bool {
+	visited := make(map[uint64]bool)
+	for !visited[gid] {
+		if gid == ancestor {
+			return true
+		}
+		visited[gid] = true
+		g, ok := registry.groups[gid]
+		if !ok || gid == 0 {
+			return false
+		}
+		gid = g.ParentGroup
+	}
+	return false
+}
+
+// groupResources lists resources in a group and all its subgroups
+func groupResources(g *Group, visited map[uint64]bool) []uint64 {
+	var resources []uint64
+	for _, item := range g.Items {
+		switch item.ItemType {
+		case ResourceItem:
+			resources = append(resources, item.ItemID)
+		case GroupItem:
+			sub, ok := registry.groups[item.ItemID]
+			if !ok || visited[item.ItemID] {
+				continue
+			}
+			visited[item.ItemID] = true
+			resources = append(resources, groupResources(sub, visited)...)
+		}
+	}
+	return resources
 }
 
-func DeleteFromParent(parentID, selfID uint64) error {
-	parentGroup, ok := groups[parentID]
+func DeleteFromParent(tx *transaction, parentID, selfID uint64) error {
+	parentGroup, ok := tx.Group(parentID)
 	if !ok {
 		return errors.New(fmt.Sprintf("parent not found: %d", parentID))
 	}
@@ -237,34 +336,35 @@ func DeleteFromParent(parentID, selfID uint64) error {
 			// remove the index-th element in a slice
 			copy(parentGroup.Items[index:], parentGroup.Items[index+1:])
 			parentGroup.Items = parentGroup.Items[:len(parentGroup.Items)-1]
-
-			err := parentGroup.SaveToDB(parentID)
-			return err
+			return nil
 		}
 	}
 	return errors.New(fmt.Sprintf("item %d not found in parent: %d", selfID, parentID))
 }
 
-func ChangeNameForParent(parentID, selfID uint64, newName string) error {
-	parentGroup, ok := groups[parentID]
+func ChangeNameForParent(tx *transaction, parentID, selfID uint64, newName string) error {
+	parentGroup, ok := tx.Group(parentID)
 	if !ok {
 		return errors.New(fmt.Sprintf("parent not found: %d", parentID))
 	}
 	for index := range parentGroup.Items {
 		if parentGroup.Items[index].ItemID == selfID {
 			parentGroup.Items[index].DisplayName = newName
-			err := parentGroup.SaveToDB(parentID)
-			return err
+			return nil
 		}
 	}
 	return errors.New(fmt.Sprintf("item %d not found in parent: %d", selfID, parentID))
 }
 
 func getGroups(c *gin.Context) {
-	c.JSON(200, groups)
+	registry.RLock()
+	defer registry.RUnlock()
+	c.JSON(200, registry.groups)
 }
 
 func getGroupByID(c *gin.Context) {
+	registry.RLock()
+	defer registry.RUnlock()
 	groupIDStr := c.Param("gid")
 	groupID, err := strconv.ParseUint(groupIDStr, 10, 64)
 	if err != nil {
@@ -274,7 +374,7 @@ func getGroupByID(c *gin.Context) {
 		})
 		return
 	}
-	g, ok := groups[groupID]
+	g, ok := registry.groups[groupID]
 	if ok {
 		c.JSON(200, g)
 		return
@@ -290,7 +390,7 @@ func createGroup(c *gin.Context) {
 		importGroup(c)
 		return
 	}
-	var group Group
+	group := Group{Active: true}
 	if err := c.BindJSON(&group); err != nil {
 		c.JSON(400, gin.H{
 			"code":    2000,
@@ -298,6 +398,13 @@ func createGroup(c *gin.Context) {
 		})
 		return
 	}
+	if err := checkActivation(group.StartAt, group.EndAt); err != nil {
+		c.JSON(422, gin.H{
+			"code":    2048,
+			"message": fmt.Sprintf("activation error: %s", err),
+		})
+		return
+	}
 	parentStr := c.Param("gid")
 	var parentID uint64
 	if len(parentStr) == 0 {
@@ -312,15 +419,11 @@ func createGroup(c *gin.Context) {
 			})
 			return
 		}
-		if parentID != 0 {
-			c.JSON(400, gin.H{
-				"code":    1400,
-				"message": "group in group are not supported yet",
-			})
-			return
-		}
 	}
-	parentGroup, ok := groups[parentID]
+	registry.Lock()
+	defer registry.Unlock()
+	tx := newTransaction()
+	parentGroup, ok := tx.Group(parentID)
 	if !ok {
 		c.JSON(404, gin.H{
 			"code":    1000,
@@ -330,14 +433,14 @@ func createGroup(c *gin.Context) {
 	}
 	group.ParentGroup = parentID
 
-	itemCursor++
-	cursor := itemCursor
+	cursor := tx.NewItemID()
 	parentGroup.Items = append(parentGroup.Items, Item{
 		ItemType:    GroupItem,
 		DisplayName: group.DisplayName,
 		ItemID:      cursor,
 	})
-	if err := parentGroup.SaveToDB(parentID); err != nil {
+	tx.PutGroup(cursor, &group)
+	if err := tx.Commit(); err != nil {
 		log.Error(err)
 		c.JSON(500, gin.H{
 			"code":    3000,
@@ -345,22 +448,6 @@ func createGroup(c *gin.Context) {
 		})
 		return
 	}
-	if err := db.Put([]byte("gypsum-$meta-cursor"), helper.U64ToBytes(cursor), nil); err != nil {
-		c.JSON(500, gin.H{
-			"code":    3031,
-			"message": fmt.Sprintf("Server got itself into trouble: %s", err),
-		})
-		return
-	}
-	err := group.SaveToDB(cursor)
-	if err != nil {
-		c.JSON(500, gin.H{
-			"code":    3032,
-			"message": fmt.Sprintf("Server got itself into trouble: item does not exist in its parent group"),
-		})
-		return
-	}
-	groups[cursor] = &group
 	c.JSON(201, gin.H{
 		"code":     0,
 		"message":  "ok",
@@ -388,7 +475,10 @@ func addGroupItem(c *gin.Context) {
 		})
 		return
 	}
-	group, ok := groups[groupID]
+	registry.Lock()
+	defer registry.Unlock()
+	tx := newTransaction()
+	group, ok := tx.Group(groupID)
 	if !ok {
 		c.JSON(404, gin.H{
 			"code":    1001,
@@ -399,11 +489,20 @@ func addGroupItem(c *gin.Context) {
 	var item UserRecord
 	iType := ItemType(c.Param("type"))
 	if iType == GroupItem {
-		c.JSON(422, gin.H{
-			"code":    3010,
-			"message": "not supported yet",
-		})
-		return
+		if itemID == 0 {
+			c.JSON(403, gin.H{
+				"code":    3010,
+				"message": "root group cannot be moved",
+			})
+			return
+		}
+		if groupWithin(groupID, itemID) {
+			c.JSON(422, gin.H{
+				"code":    3011,
+				"message": "cannot move a group into itself or its subgroups",
+			})
+			return
+		}
 	}
 	item, ok = findItem(iType, itemID)
 	if !ok {
@@ -414,11 +513,11 @@ func addGroupItem(c *gin.Context) {
 		return
 	}
 	// remove item from old group
-	if err := DeleteFromParent(item.GetParentID(), itemID); err != nil {
+	if err := DeleteFromParent(tx, item.GetParentID(), itemID); err != nil {
 		log.Warnf("error when delete group %d from parent group %d: %s", groupID, group.ParentGroup, err)
 	}
 	// add item to new group
-	if err = item.NewParent(itemID, groupID); err != nil {
+	if err = item.NewParent(tx, itemID, groupID); err != nil {
 		log.Error(err)
 		c.JSON(500, gin.H{
 			"code":    3000,
@@ -431,10 +530,13 @@ func addGroupItem(c *gin.Context) {
 		DisplayName: item.GetDisplayName(),
 		ItemID:      itemID,
 	})
-	if err = group.SaveToDB(groupID); err != nil {
+	tx.OnCommit(func() {
+		reregisterItem(iType, itemID)
+	})
+	if err = tx.Commit(); err != nil {
 		c.JSON(500, gin.H{
 			"code":    3053,
-			"message": fmt.Sprintf("Server got itself into trouble: item does not exist in its parent group"),
+			"message": fmt.Sprintf("Server got itself into trouble: %s", err),
 		})
 		return
 	}
@@ -461,7 +563,9 @@ func exportGroup(c *gin.Context) {
 		c.String(400, "400 Bad Request\nplugin_version must be an integer")
 		return
 	}
-	group, ok := groups[groupID]
+	registry.RLock()
+	defer registry.RUnlock()
+	group, ok := registry.groups[groupID]
 	if !ok {
 		c.String(404, "404: group not found")
 		return
@@ -474,7 +578,25 @@ func exportGroup(c *gin.Context) {
 		c.String(500, fmt.Sprintf("500 Internal Server Error\nerror when create plugin zipfile: %s", err))
 		return
 	}
-	groupData, err := group.ExportToArchive(pluginName, pluginVersion).ToBytes()
+	archive := group.ExportToArchive(pluginName, pluginVersion)
+	if c.Query("with_data") == "true" {
+		namespace := pluginNamespace(groupID)
+		if namespace == userdata.Global {
+			c.String(422, "422 Unprocessable Entity\ngroup is not in a plugin, its data is shared by all items")
+			return
+		}
+		// data is restored under the plugin name of the archive, it must be the namespace the data is read from
+		if pluginName != namespace {
+			c.String(422, fmt.Sprintf("422 Unprocessable Entity\nplugin_name must be %q, the plugin the data belongs to", namespace))
+			return
+		}
+		archive.UserData, err = pluginUserData(namespace)
+		if err != nil {
+			c.String(500, fmt.Sprintf("500 Internal Server Error\nServer got itself into trouble: %s", err))
+			return
+		}
+	}
+	groupData, err := archive.ToBytes()
 	if err != nil {
 		c.String(500, fmt.Sprintf("500 Internal Server Error\nServer got itself into trouble: %s", err))
 		return
@@ -485,28 +607,31 @@ func exportGroup(c *gin.Context) {
 		c.String(500, fmt.Sprintf("500 Internal Server Error\nServer got itself into trouble: %s", err))
 		return
 	}
-	for _, item := range group.Items {
-		if item.ItemType == ResourceItem {
-			// attach all resources
-			res := resources[item.ItemID]
-			fileData, err := os.ReadFile(path.Join(resDir, res.Sha256Sum+res.Ext))
-			if err != nil {
-				log.Error(err)
-				c.String(500, fmt.Sprintf("500 Internal Server Error\nServer got itself into trouble: %s", err))
-				return
-			}
-			f, err := zipWriter.Create(res.Sha256Sum + res.Ext)
-			if err != nil {
-				log.Error(err)
-				c.String(500, fmt.Sprintf("500 Internal Server Error\nServer got itself into trouble: %s", err))
-				return
-			}
-			_, err = f.Write(fileData)
-			if err != nil {
-				log.Error(err)
-				c.String(500, fmt.Sprintf("500 Internal Server Error\nServer got itself into trouble: %s", err))
-				return
-			}
+	attached := make(map[string]bool)
+	for _, resID := range groupResources(group, map[uint64]bool{groupID: true}) {
+		// attach all resources, including those in subgroups
+		res, ok := registry.resources[resID]
+		if !ok || attached[res.Sha256Sum+res.Ext] {
+			continue
+		}
+		attached[res.Sha256Sum+res.Ext] = true
+		fileData, err := os.ReadFile(path.Join(resDir, res.Sha256Sum+res.Ext))
+		if err != nil {
+			log.Error(err)
+			c.String(500, fmt.Sprintf("500 Internal Server Error\nServer got itself into trouble: %s", err))
+			return
+		}
+		f, err := zipWriter.Create(res.Sha256Sum + res.Ext)
+		if err != nil {
+			log.Error(err)
+			c.String(500, fmt.Sprintf("500 Internal Server Error\nServer got itself into trouble: %s", err))
+			return
+		}
+		_, err = f.Write(fileData)
+		if err != nil {
+			log.Error(err)
+			c.String(500, fmt.Sprintf("500 Internal Server Error\nServer got itself into trouble: %s", err))
+			return
 		}
 	}
 	err = zipWriter.Close()
@@ -533,6 +658,22 @@ func importGroup(c *gin.Context) {
 			"code":    5000,
 			"message": fmt.Sprintf("request type do not meet application/zip: %s", c.ContentType()),
 		})
+		return
+	}
+	parentStr := c.Param("gid")
+	var parentID uint64
+	if len(parentStr) == 0 {
+		parentID = 0
+	} else {
+		var err error
+		parentID, err = strconv.ParseUint(parentStr, 10, 64)
+		if err != nil {
+			c.JSON(404, gin.H{
+				"code":    1000,
+				"message": "no such group",
+			})
+			return
+		}
 	}
 	bodyReader := c.Request.Body
 	body, err := io.ReadAll(bodyReader)
@@ -543,16 +684,27 @@ func importGroup(c *gin.Context) {
 		})
 		return
 	}
-	zipReader, err := zip.NewReader(bytes.NewReader(body), c.Request.ContentLength)
+	zipReader, err := zip.NewReader(bytes.NewReader(body), int64(len(body)))
 	if err != nil {
 		c.JSON(400, gin.H{
 			"code":    5000,
 			"message": fmt.Sprintf("cannot read body as zipfile: %s", err),
 		})
+		return
+	}
+	registry.Lock()
+	defer registry.Unlock()
+	tx := newTransaction()
+	parentGroup, ok := tx.Group(parentID)
+	if !ok {
+		c.JSON(404, gin.H{
+			"code":    1000,
+			"message": "group not found",
+		})
+		return
 	}
 	var newGroup *Group
-	itemCursor++
-	cursor := itemCursor
+	cursor := tx.NewItemID()
 	for _, file := range zipReader.File {
 		if file.Name == "gypsum-plugin.dat" {
 			fr, err := file.Open()
@@ -564,7 +716,7 @@ func importGroup(c *gin.Context) {
 				})
 				return
 			}
-			newGroup, err = GroupFromArchiveReader(fr, cursor)
+			newGroup, err = GroupFromArchiveReader(tx, fr, cursor)
 			if err != nil {
 				log.Error(err)
 				c.JSON(500, gin.H{
@@ -625,36 +777,6 @@ func importGroup(c *gin.Context) {
 		})
 		return
 	}
-	parentStr := c.Param("gid")
-	var parentID uint64
-	if len(parentStr) == 0 {
-		parentID = 0
-	} else {
-		var err error
-		parentID, err = strconv.ParseUint(parentStr, 10, 64)
-		if err != nil {
-			c.JSON(404, gin.H{
-				"code":    1000,
-				"message": "no such group",
-			})
-			return
-		}
-		if parentID != 0 {
-			c.JSON(400, gin.H{
-				"code":    1400,
-				"message": "group in group are not supported yet",
-			})
-			return
-		}
-	}
-	parentGroup, ok := groups[parentID]
-	if !ok {
-		c.JSON(404, gin.H{
-			"code":    1000,
-			"message": "group not found",
-		})
-		return
-	}
 	newGroup.ParentGroup = parentID
 
 	parentGroup.Items = append(parentGroup.Items, Item{
@@ -662,22 +784,8 @@ func importGroup(c *gin.Context) {
 		DisplayName: newGroup.DisplayName,
 		ItemID:      cursor,
 	})
-	if err = parentGroup.SaveToDB(parentID); err != nil {
-		c.JSON(500, gin.H{
-			"code":    3000,
-			"message": fmt.Sprintf("Server got itself into trouble: %s", err),
-		})
-		return
-	}
-	if err := db.Put([]byte("gypsum-$meta-cursor"), helper.U64ToBytes(cursor), nil); err != nil {
-		c.JSON(500, gin.H{
-			"code":    3000,
-			"message": fmt.Sprintf("Server got itself into trouble: %s", err),
-		})
-		return
-	}
-	groups[cursor] = newGroup
-	if err = newGroup.SaveToDB(cursor); err != nil {
+	tx.PutGroup(cursor, newGroup)
+	if err = tx.Commit(); err != nil {
 		log.Error(err)
 		c.JSON(500, gin.H{
 			"code":    3000,
@@ -694,7 +802,8 @@ func importGroup(c *gin.Context) {
 }
 
 type groupMoveTo struct {
-	MoveTo uint64 `json:"move_to"`
+	MoveTo  uint64 `json:"move_to"`
+	Cascade bool   `json:"cascade"` // delete items together with the group instead of moving them
 }
 
 func deleteGroup(c *gin.Context) {
@@ -714,7 +823,9 @@ func deleteGroup(c *gin.Context) {
 		})
 		return
 	}
-	group, ok := groups[groupID]
+	registry.Lock()
+	defer registry.Unlock()
+	group, ok := registry.groups[groupID]
 	if !ok {
 		c.JSON(404, gin.H{
 			"code":    1000,
@@ -730,42 +841,59 @@ func deleteGroup(c *gin.Context) {
 		})
 		return
 	}
-	newGroup, ok := groups[movePatch.MoveTo]
-	if !ok {
-		c.JSON(404, gin.H{
-			"code":    1000,
-			"message": "no such group",
+	if !movePatch.Cascade && groupWithin(movePatch.MoveTo, groupID) {
+		c.JSON(422, gin.H{
+			"code":    2001,
+			"message": "cannot move items into the group being deleted",
 		})
 		return
 	}
+	tx := newTransaction()
 	// remove self from parent
-	if err := DeleteFromParent(group.ParentGroup, groupID); err != nil {
+	if err := DeleteFromParent(tx, group.ParentGroup, groupID); err != nil {
 		log.Errorf("error when delete group %d from parent group %d: %s", groupID, group.ParentGroup, err)
 	}
-	// move items to new group
-	for _, item := range group.Items {
-		it, ok := findItem(item.ItemType, item.ItemID)
+	var children []TrashItem
+	if movePatch.Cascade {
+		// move items into trash along with the group
+		children = tx.trashGroupItems(group, map[uint64]bool{groupID: true})
+	} else {
+		newGroup, ok := tx.Group(movePatch.MoveTo)
 		if !ok {
-			log.Errorf("cannot find item: type:%s, id: %d", item.ItemType, item.ItemID)
-			continue
+			c.JSON(404, gin.H{
+				"code":    1000,
+				"message": "no such group",
+			})
+			return
 		}
-		err = it.NewParent(item.ItemID, movePatch.MoveTo)
-		if err != nil {
-			log.Error(err)
-			continue
+		// move items to new group
+		for _, item := range group.Items {
+			it, ok := findItem(item.ItemType, item.ItemID)
+			if !ok {
+				log.Errorf("cannot find item: type:%s, id: %d", item.ItemType, item.ItemID)
+				continue
+			}
+			err = it.NewParent(tx, item.ItemID, movePatch.MoveTo)
+			if err != nil {
+				log.Error(err)
+				continue
+			}
+			item := item
+			tx.OnCommit(func() {
+				reregisterItem(item.ItemType, item.ItemID)
+			})
 		}
+		newGroup.Items = append(newGroup.Items, group.Items...)
 	}
-	newGroup.Items = append(newGroup.Items, group.Items...)
-	// remove self from database
-	delete(groups, groupID)
-	if err := db.Delete(append([]byte("gypsum-groups-"), helper.U64ToBytes(groupID)...), nil); err != nil {
+	// move self into trash
+	if err := tx.MoveToTrash(GroupItem, groupID, group, children); err != nil {
 		c.JSON(500, gin.H{
 			"code":    3001,
 			"message": fmt.Sprintf("Server got itself into trouble: %s", err),
 		})
 		return
 	}
-	if err = newGroup.SaveToDB(movePatch.MoveTo); err != nil {
+	if err := tx.Commit(); err != nil {
 		c.JSON(500, gin.H{
 			"code":    3001,
 			"message": fmt.Sprintf("Server got itself into trouble: %s", err),
@@ -793,7 +921,9 @@ func renameGroup(c *gin.Context) {
 		})
 		return
 	}
-	group, ok := groups[groupID]
+	registry.Lock()
+	defer registry.Unlock()
+	group, ok := registry.groups[groupID]
 	if !ok {
 		c.JSON(404, gin.H{
 			"code":    1000,
@@ -809,11 +939,16 @@ func renameGroup(c *gin.Context) {
 		})
 		return
 	}
-	group.DisplayName = np.DisplayName
-	if err = ChangeNameForParent(group.ParentGroup, groupID, np.DisplayName); err != nil {
+	tx := newTransaction()
+	if err = tx.SaveRevision(GroupItem, groupID, group); err != nil {
+		log.Errorf("error when saving revision of group %d: %s", groupID, err)
+	}
+	staged, _ := tx.Group(groupID)
+	staged.DisplayName = np.DisplayName
+	if err = ChangeNameForParent(tx, group.ParentGroup, groupID, np.DisplayName); err != nil {
 		log.Errorf("error when change group %d from parent group %d: %s", groupID, group.ParentGroup, err)
 	}
-	if err = group.SaveToDB(groupID); err != nil {
+	if err = tx.Commit(); err != nil {
 		c.JSON(500, gin.H{
 			"code":    3000,
 			"message": fmt.Sprintf("Server got itself into trouble: %s", err),
@@ -0,0 +1,182 @@
+package gypsum
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/yuudi/gypsum/gypsum/userdata"
+)
+
+// readTestArchive decodes the group archive in an exported plugin file
+func readTestArchive(t *testing.T, body string) *GroupArchive {
+	t.Helper()
+	zipReader, err := zip.NewReader(bytes.NewReader([]byte(body)), int64(len(body)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := zipReader.Open("gypsum-plugin.dat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	ga := &GroupArchive{}
+	if err := gob.NewDecoder(io.Reader(f)).Decode(ga); err != nil {
+		t.Fatal(err)
+	}
+	return ga
+}
+
+func TestExportGroupWithData(t *testing.T) {
+	useTestMemory(t)
+	openTestRegistry(t)
+	if code, body := callHandler(createGroup, "POST", "/", `{"display_name":"plugin","plugin_name":"greeter","active":true}`); code != 201 {
+		t.Fatalf("create group: %d %s", code, body)
+	}
+	if code, body := callHandler(createGroup, "POST", "/", `{"display_name":"sub","active":true}`, "gid", "1"); code != 201 {
+		t.Fatalf("create subgroup: %d %s", code, body)
+	}
+	if code, body := callHandler(createGroup, "POST", "/", `{"display_name":"plain","active":true}`); code != 201 {
+		t.Fatalf("create group: %d %s", code, body)
+	}
+	if err := userdata.DataStore.PutValue("greeter", []byte("count"), 1, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	if code, body := callHandler(exportGroup, "GET", "/?plugin_name=plain&plugin_version=1&with_data=true", "", "gid", "3"); code != 422 {
+		t.Errorf("export data of a group outside plugins: %d %s", code, body)
+	}
+	if code, body := callHandler(exportGroup, "GET", "/?plugin_name=other&plugin_version=1&with_data=true", "", "gid", "2"); code != 422 {
+		t.Errorf("export data under another plugin name: %d %s", code, body)
+	}
+	code, body := callHandler(exportGroup, "GET", "/?plugin_name=greeter&plugin_version=1&with_data=true", "", "gid", "2")
+	if code != 200 {
+		t.Fatalf("export data of subgroup: %d %s", code, body)
+	}
+	ga := readTestArchive(t, body)
+	if ga.PluginName != "greeter" || len(ga.UserData) != 1 || string(ga.UserData[0].Key) != "count" {
+		t.Errorf("exported archive: plugin %q, data %+v", ga.PluginName, ga.UserData)
+	}
+}
+
+// mustCreate calls a create handler and returns the id in the response
+func mustCreate(t *testing.T, h gin.HandlerFunc, idField, body string, params ...string) uint64 {
+	t.Helper()
+	code, resp := callHandler(h, "POST", "/", body, params...)
+	if code != 201 {
+		t.Fatalf("create %s: %d %s", body, code, resp)
+	}
+	var created map[string]interface{}
+	if err := json.Unmarshal([]byte(resp), &created); err != nil {
+		t.Fatal(err)
+	}
+	id, ok := created[idField].(float64)
+	if !ok {
+		t.Fatalf("no %s in %s", idField, resp)
+	}
+	return uint64(id)
+}
+
+func importTestArchive(t *testing.T, archive string) uint64 {
+	t.Helper()
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest("POST", "/", strings.NewReader(archive))
+	c.Request.Header.Set("Content-Type", "application/zip")
+	createGroup(c)
+	if w.Code != 201 {
+		t.Fatalf("import: %d %s", w.Code, w.Body.String())
+	}
+	var created struct {
+		GroupID uint64 `json:"group_id"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &created); err != nil {
+		t.Fatal(err)
+	}
+	return created.GroupID
+}
+
+func equalIDs(a, b []int64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestExportImportNestedGroup(t *testing.T) {
+	useTestMemory(t)
+	openTestRegistry(t)
+	pluginID := mustCreate(t, createGroup, "group_id", `{"display_name":"plugin","plugin_name":"nest","active":true,"defaults":{"groups_id":[100]}}`)
+	mustCreate(t, createRule, "rule_id", `{"display_name":"greeting","active":true,"message_type":4294967295,"patterns":["hi"],"response":"hello"}`, "gid", itoa(pluginID))
+	subID := mustCreate(t, createGroup, "group_id", `{"display_name":"sub","active":false,"defaults":{"users_id":[200],"priority":5}}`, "gid", itoa(pluginID))
+	mustCreate(t, createTrigger, "trigger_id", `{"display_name":"welcome","active":true,"trigger_type":["notice","group_increase"],"response":"welcome"}`, "gid", itoa(subID))
+	mustCreate(t, createJob, "job_id", `{"display_name":"morning","active":true,"cron_spec":"0 9 * * *","action":"good morning"}`, "gid", itoa(subID))
+
+	code, body := callHandler(exportGroup, "GET", "/?plugin_name=nest&plugin_version=3", "", "gid", itoa(pluginID))
+	if code != 200 {
+		t.Fatalf("export: %d %s", code, body)
+	}
+	newID := importTestArchive(t, body)
+	if newID == pluginID {
+		t.Fatal("imported group got the id of the exported group")
+	}
+
+	g := registry.groups[newID]
+	if g.DisplayName != "plugin" || g.PluginName != "nest" || g.PluginVersion != 3 || !g.Active || g.ParentGroup != 0 {
+		t.Errorf("imported group: %+v", g)
+	}
+	if !equalIDs(g.Defaults.GroupsID, []int64{100}) {
+		t.Errorf("defaults of imported group: %+v", g.Defaults)
+	}
+	if len(g.Items) != 2 || g.Items[0].ItemType != RuleItem || g.Items[1].ItemType != GroupItem {
+		t.Fatalf("items of imported group: %+v", g.Items)
+	}
+	rule, ok := registry.rules[g.Items[0].ItemID]
+	if !ok || rule.DisplayName != "greeting" || rule.Response != "hello" || rule.ParentGroup != newID {
+		t.Errorf("imported rule: %+v", rule)
+	}
+	if filters := rule.filters(); !equalIDs(filters.GroupsID, []int64{100}) {
+		t.Errorf("imported rule does not inherit defaults: %+v", filters)
+	}
+
+	sub, ok := registry.groups[g.Items[1].ItemID]
+	if !ok || sub.DisplayName != "sub" || sub.Active || sub.ParentGroup != newID || g.Items[1].ItemID == subID {
+		t.Fatalf("imported subgroup: %+v", sub)
+	}
+	if !equalIDs(sub.Defaults.UsersID, []int64{200}) || sub.Defaults.Priority != 5 {
+		t.Errorf("defaults of imported subgroup: %+v", sub.Defaults)
+	}
+	if len(sub.Items) != 2 || sub.Items[0].ItemType != TriggerItem || sub.Items[1].ItemType != SchedulerItem {
+		t.Fatalf("items of imported subgroup: %+v", sub.Items)
+	}
+	trigger, ok := registry.triggers[sub.Items[0].ItemID]
+	if !ok || trigger.DisplayName != "welcome" || trigger.ParentGroup != g.Items[1].ItemID || len(trigger.TriggerType) != 2 || trigger.TriggerType[1] != "group_increase" {
+		t.Errorf("imported trigger: %+v", trigger)
+	}
+	if filters := trigger.filters(); !equalIDs(filters.GroupsID, []int64{100}) || !equalIDs(filters.UsersID, []int64{200}) || filters.Priority != 5 {
+		t.Errorf("imported trigger does not inherit defaults: %+v", filters)
+	}
+	job, ok := registry.jobs[sub.Items[1].ItemID]
+	if !ok || job.DisplayName != "morning" || job.CronSpec != "0 9 * * *" || job.Action != "good morning" || job.ParentGroup != g.Items[1].ItemID {
+		t.Errorf("imported job: %+v", job)
+	}
+	// the subgroup is inactive, so are its items
+	if _, ok := registry.zeroTrigger[sub.Items[0].ItemID]; ok {
+		t.Error("trigger in an inactive group is registered")
+	}
+	if _, ok := registry.zeroMatcher[g.Items[0].ItemID]; !ok {
+		t.Error("rule in an active group is not registered")
+	}
+}
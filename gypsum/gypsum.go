@@ -12,15 +12,33 @@ import (
 	zero "github.com/wdvxdr1123/ZeroBot"
 
 	_ "github.com/yuudi/gypsum/gypsum/helper/jsoniter_plugin_integer_interface"
+	"github.com/yuudi/gypsum/gypsum/sandbox"
 )
 
 type ConfigType struct {
-	Listen         string
-	Password       string
-	PasswordSalt   string
-	ExternalAssets string
-	ResourceShare  string
-	HttpBackRef    string
+	Listen              string
+	Password            string
+	PasswordSalt        string
+	ExternalAssets      string
+	ResourceShare       string
+	HttpBackRef         string
+	Storage             string
+	MaxRevisions        int
+	TrashRetentionDays  int
+	IntegrityAutoRepair bool
+	Sandbox             SandboxConfig
+	Limits              ExecutionLimits
+	RateLimit           RateLimitConfig
+}
+
+// SandboxConfig limits what templates and lua can reach on the host, fields left out of the config file use the defaults
+type SandboxConfig struct {
+	FileRoots           []string
+	UrlHosts            []string
+	AllowPrivateNetwork bool
+	HttpTimeout         int
+	MaxResponseSize     int64
+	LuaLibraries        []string
 }
 
 func (c *ConfigType) CheckValid() (changed bool, err error) {
@@ -34,6 +52,18 @@ func (c *ConfigType) CheckValid() (changed bool, err error) {
 	default:
 		return false, errors.New("unknown ResourceShare: " + c.ResourceShare)
 	}
+	switch c.Storage {
+	case "", "leveldb", "memory": // doing nothing
+	default:
+		return false, errors.New("unknown Storage: " + c.Storage)
+	}
+	c.Sandbox.fillDefaultLists()
+	if err := sandbox.CheckLuaLibraries(c.Sandbox.LuaLibraries); err != nil {
+		return false, err
+	}
+	if err := c.Limits.check(); err != nil {
+		return false, err
+	}
 	if len(c.Password) == 0 {
 		return false, errors.New("未设置密码")
 	}
@@ -74,6 +104,8 @@ func (_ *gypsumPlugin) GetPluginInfo() zero.PluginInfo { // 返回插件信息
 }
 
 func (_ *gypsumPlugin) Start() { // 插件主体
+	initSandbox()
+	initRateLimit()
 	if err := initTemplating(); err != nil {
 		log.Fatalf("pongo2引擎初始化错误：%s", err)
 		return
@@ -86,5 +118,9 @@ func (_ *gypsumPlugin) Start() { // 插件主体
 		log.Fatalf("数据库加载错误：%s", err)
 		return
 	}
+	checkIntegrityOnStartup()
+	initGroupWatcher()
+	initTrash()
+	initUserData()
 	initWeb()
 }
@@ -0,0 +1,270 @@
+package gypsum
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+)
+
+// IntegrityProblem is a mismatch between items and the Items lists of groups.
+// The parent id saved in an item is trusted, Group.Items is rebuilt from it when repairing.
+type IntegrityProblem struct {
+	Kind     string   `json:"kind"` // orphan, dangling, duplicate or stale_name
+	GroupID  uint64   `json:"group_id"`
+	ItemType ItemType `json:"item_type"`
+	ItemID   uint64   `json:"item_id"`
+	Message  string   `json:"message"`
+}
+
+type IntegrityReport struct {
+	Problems []IntegrityProblem `json:"problems"`
+	Repaired bool               `json:"repaired"`
+}
+
+type integrityItem struct {
+	itemType ItemType
+	itemID   uint64
+	record   UserRecord
+}
+
+func sortIDs(ids []uint64) []uint64 {
+	sort.Slice(ids, func(i, j int) bool {
+		return ids[i] < ids[j]
+	})
+	return ids
+}
+
+// allItems lists every item except the root group, ordered by type and id
+func allItems() []integrityItem {
+	var items []integrityItem
+	add := func(itemType ItemType, ids []uint64) {
+		for _, id := range sortIDs(ids) {
+			record, _ := findItem(itemType, id)
+			items = append(items, integrityItem{itemType, id, record})
+		}
+	}
+	ids := make([]uint64, 0, len(registry.groups))
+	for id := range registry.groups {
+		if id != 0 {
+			ids = append(ids, id)
+		}
+	}
+	add(GroupItem, ids)
+	ids = make([]uint64, 0, len(registry.rules))
+	for id := range registry.rules {
+		ids = append(ids, id)
+	}
+	add(RuleItem, ids)
+	ids = make([]uint64, 0, len(registry.triggers))
+	for id := range registry.triggers {
+		ids = append(ids, id)
+	}
+	add(TriggerItem, ids)
+	ids = make([]uint64, 0, len(registry.jobs))
+	for id := range registry.jobs {
+		ids = append(ids, id)
+	}
+	add(SchedulerItem, ids)
+	ids = make([]uint64, 0, len(registry.resources))
+	for id := range registry.resources {
+		ids = append(ids, id)
+	}
+	add(ResourceItem, ids)
+	return items
+}
+
+// checkIntegrity compares every item with the Items list of its parent group.
+// With a transaction the problems are also fixed in it, the registry must then be locked for writing.
+func checkIntegrity(tx *transaction) *IntegrityReport {
+	report := &IntegrityReport{
+		Problems: []IntegrityProblem{},
+	}
+	problem := func(kind string, gid uint64, itemType ItemType, id uint64, format string, a ...interface{}) {
+		report.Problems = append(report.Problems, IntegrityProblem{
+			Kind:     kind,
+			GroupID:  gid,
+			ItemType: itemType,
+			ItemID:   id,
+			Message:  fmt.Sprintf(format, a...),
+		})
+	}
+	groupIDs := make([]uint64, 0, len(registry.groups))
+	for id := range registry.groups {
+		groupIDs = append(groupIDs, id)
+	}
+	sortIDs(groupIDs)
+	items := allItems()
+
+	// find the group every item belongs to
+	home := make(map[uint64]uint64, len(items))
+	for _, item := range items {
+		parentID := item.record.GetParentID()
+		if _, ok := registry.groups[parentID]; !ok {
+			// adopted by the first group listing it, or by root group
+			newParent := uint64(0)
+		search:
+			for _, gid := range groupIDs {
+				for _, entry := range registry.groups[gid].Items {
+					if entry.ItemID == item.itemID && entry.ItemType == item.itemType && gid != item.itemID {
+						newParent = gid
+						break search
+					}
+				}
+			}
+			problem("orphan", parentID, item.itemType, item.itemID, "parent group %d does not exist, moved to group %d", parentID, newParent)
+			if tx != nil {
+				if err := item.record.NewParent(tx, item.itemID, newParent); err != nil {
+					log.Errorf("error when moving %s %d to group %d: %s", item.itemType, item.itemID, newParent, err)
+				}
+			}
+			parentID = newParent
+		}
+		home[item.itemID] = parentID
+	}
+
+	// groups in a cycle never reach the root group, the first one is moved into root group
+	for _, gid := range groupIDs {
+		visited := make(map[uint64]bool)
+		cur := home[gid]
+		for cur != 0 && cur != gid && !visited[cur] {
+			visited[cur] = true
+			cur = home[cur]
+		}
+		if gid == 0 || cur != gid {
+			continue
+		}
+		problem("cycle", home[gid], GroupItem, gid, "group %d is inside itself, moved to group 0", gid)
+		if tx != nil {
+			if err := registry.groups[gid].NewParent(tx, gid, 0); err != nil {
+				log.Errorf("error when moving group %d to group 0: %s", gid, err)
+			}
+		}
+		home[gid] = 0
+	}
+
+	// rebuild Items of every group
+	listed := make(map[uint64]bool, len(items))
+	newItems := make(map[uint64][]Item, len(groupIDs))
+	for _, gid := range groupIDs {
+		g := registry.groups[gid]
+		kept := make([]Item, 0, len(g.Items))
+		changed := false
+		for _, entry := range g.Items {
+			record, ok := findItem(entry.ItemType, entry.ItemID)
+			if !ok || (entry.ItemType == GroupItem && entry.ItemID == 0) {
+				if entry.ItemType == "" {
+					problem("dangling", gid, entry.ItemType, entry.ItemID, "empty entry")
+				} else {
+					problem("dangling", gid, entry.ItemType, entry.ItemID, "%s %d does not exist", entry.ItemType, entry.ItemID)
+				}
+				changed = true
+				continue
+			}
+			if listed[entry.ItemID] {
+				problem("duplicate", gid, entry.ItemType, entry.ItemID, "listed more than once")
+				changed = true
+				continue
+			}
+			if home[entry.ItemID] != gid {
+				problem("duplicate", gid, entry.ItemType, entry.ItemID, "listed in group %d but belongs to group %d", gid, home[entry.ItemID])
+				changed = true
+				continue
+			}
+			if entry.DisplayName != record.GetDisplayName() {
+				problem("stale_name", gid, entry.ItemType, entry.ItemID, "listed as %q but named %q", entry.DisplayName, record.GetDisplayName())
+				entry.DisplayName = record.GetDisplayName()
+				changed = true
+			}
+			listed[entry.ItemID] = true
+			kept = append(kept, entry)
+		}
+		if changed {
+			newItems[gid] = kept
+		}
+	}
+	for _, item := range items {
+		if listed[item.itemID] {
+			continue
+		}
+		gid := home[item.itemID]
+		problem("orphan", gid, item.itemType, item.itemID, "not listed in group %d", gid)
+		if _, ok := newItems[gid]; !ok {
+			newItems[gid] = append([]Item{}, registry.groups[gid].Items...)
+		}
+		newItems[gid] = append(newItems[gid], Item{
+			ItemType:    item.itemType,
+			DisplayName: item.record.GetDisplayName(),
+			ItemID:      item.itemID,
+		})
+	}
+
+	if tx != nil {
+		for gid, groupItems := range newItems {
+			if staged, ok := tx.Group(gid); ok {
+				staged.Items = groupItems
+			}
+		}
+		report.Repaired = len(report.Problems) != 0
+	}
+	return report
+}
+
+// repairIntegrity fixes all problems found by checkIntegrity.
+// The registry must be locked for writing.
+func repairIntegrity() (*IntegrityReport, error) {
+	tx := newTransaction()
+	report := checkIntegrity(tx)
+	if !report.Repaired {
+		return report, nil
+	}
+	if err := tx.Commit(); err != nil {
+		report.Repaired = false
+		return report, err
+	}
+	return report, nil
+}
+
+// checkIntegrityOnStartup logs problems of the group tree, they are repaired if IntegrityAutoRepair is set
+func checkIntegrityOnStartup() {
+	registry.Lock()
+	defer registry.Unlock()
+	var report *IntegrityReport
+	var err error
+	if Config.IntegrityAutoRepair {
+		report, err = repairIntegrity()
+	} else {
+		report = checkIntegrity(nil)
+	}
+	for _, p := range report.Problems {
+		log.Warnf("数据一致性问题：%s %d：%s", p.ItemType, p.ItemID, p.Message)
+	}
+	if err != nil {
+		log.Errorf("无法修复数据一致性问题：%s", err)
+	} else if report.Repaired {
+		log.Infof("已修复%d个数据一致性问题", len(report.Problems))
+	} else if len(report.Problems) != 0 {
+		log.Warn("可以在网页控制台中修复，或在配置文件中开启 IntegrityAutoRepair")
+	}
+}
+
+func getIntegrity(c *gin.Context) {
+	registry.RLock()
+	defer registry.RUnlock()
+	c.JSON(200, checkIntegrity(nil))
+}
+
+func repairIntegrityHandler(c *gin.Context) {
+	registry.Lock()
+	defer registry.Unlock()
+	report, err := repairIntegrity()
+	if err != nil {
+		c.JSON(500, gin.H{
+			"code":    3002,
+			"message": fmt.Sprintf("Server got itself into trouble: %s", err),
+		})
+		return
+	}
+	c.JSON(200, report)
+}
@@ -1,12 +1,13 @@
 package gypsum
 
 import (
+	"bytes"
 	"encoding/gob"
 	"errors"
 
 	log "github.com/sirupsen/logrus"
 
-	"github.com/yuudi/gypsum/gypsum/helper"
+	"github.com/yuudi/gypsum/gypsum/storage"
 )
 
 type ItemType string
@@ -23,8 +24,9 @@ type UserRecord interface {
 	ToBytes() ([]byte, error)
 	GetParentID() uint64
 	GetDisplayName() string
-	NewParent(selfID, parentID uint64) error
+	NewParent(tx *transaction, selfID, parentID uint64) error
 	SaveToDB(selfID uint64) error
+	SaveToBatch(batch *storage.Batch, selfID uint64) error
 }
 
 func init() {
@@ -35,7 +37,7 @@ func init() {
 	gob.Register(Trigger{})
 }
 
-func RestoreFromUserRecord(itemType ItemType, itemBytes []byte, newParentID uint64) (uint64, error) {
+func RestoreFromUserRecord(tx *transaction, itemType ItemType, itemBytes []byte, newParentID uint64) (uint64, error) {
 	switch itemType {
 	case RuleItem:
 		rule, err := RuleFromBytes(itemBytes)
@@ -43,15 +45,16 @@ func RestoreFromUserRecord(itemType ItemType, itemBytes []byte, newParentID uint
 			return 0, err
 		}
 		rule.ParentGroup = newParentID
-		itemCursor++
-		cursor := itemCursor
-		if err := db.Put([]byte("gypsum-$meta-cursor"), helper.U64ToBytes(cursor), nil); err != nil {
-			return 0, err
-		}
-		rules[cursor] = rule
-		if err := rule.SaveToDB(cursor); err != nil {
+		cursor := tx.NewItemID()
+		if err := rule.SaveToBatch(tx.batch, cursor); err != nil {
 			return 0, err
 		}
+		tx.OnCommit(func() {
+			registry.rules[cursor] = rule
+			if err := rule.Register(cursor); err != nil {
+				log.Errorf("无法注册规则%d：%s", cursor, err)
+			}
+		})
 		return cursor, nil
 	case TriggerItem:
 		trigger, err := TriggerFromByte(itemBytes)
@@ -59,15 +62,16 @@ func RestoreFromUserRecord(itemType ItemType, itemBytes []byte, newParentID uint
 			return 0, err
 		}
 		trigger.ParentGroup = newParentID
-		itemCursor++
-		cursor := itemCursor
-		if err := db.Put([]byte("gypsum-$meta-cursor"), helper.U64ToBytes(cursor), nil); err != nil {
-			return 0, err
-		}
-		triggers[cursor] = trigger
-		if err := trigger.SaveToDB(cursor); err != nil {
+		cursor := tx.NewItemID()
+		if err := trigger.SaveToBatch(tx.batch, cursor); err != nil {
 			return 0, err
 		}
+		tx.OnCommit(func() {
+			registry.triggers[cursor] = trigger
+			if err := trigger.Register(cursor); err != nil {
+				log.Errorf("无法注册规则%d：%s", cursor, err)
+			}
+		})
 		return cursor, nil
 	case SchedulerItem:
 		job, err := JobFromBytes(itemBytes)
@@ -75,15 +79,16 @@ func RestoreFromUserRecord(itemType ItemType, itemBytes []byte, newParentID uint
 			return 0, err
 		}
 		job.ParentGroup = newParentID
-		itemCursor++
-		cursor := itemCursor
-		if err := db.Put([]byte("gypsum-$meta-cursor"), helper.U64ToBytes(cursor), nil); err != nil {
-			return 0, err
-		}
-		jobs[cursor] = job
-		if err := job.SaveToDB(cursor); err != nil {
+		cursor := tx.NewItemID()
+		if err := job.SaveToBatch(tx.batch, cursor); err != nil {
 			return 0, err
 		}
+		tx.OnCommit(func() {
+			registry.jobs[cursor] = job
+			if err := job.Register(cursor); err != nil {
+				log.Errorf("无法注册任务%d：%s", cursor, err)
+			}
+		})
 		return cursor, nil
 	case ResourceItem:
 		resource, err := ResourceFromBytes(itemBytes)
@@ -91,23 +96,81 @@ func RestoreFromUserRecord(itemType ItemType, itemBytes []byte, newParentID uint
 			return 0, err
 		}
 		resource.ParentGroup = newParentID
-		itemCursor++
-		cursor := itemCursor
-		if err := db.Put([]byte("gypsum-$meta-cursor"), helper.U64ToBytes(cursor), nil); err != nil {
+		cursor := tx.NewItemID()
+		if err := resource.SaveToBatch(tx.batch, cursor); err != nil {
 			return 0, err
 		}
-		resources[cursor] = resource
-		if err := resource.SaveToDB(cursor); err != nil {
+		tx.OnCommit(func() {
+			registry.resources[cursor] = resource
+		})
+		return cursor, nil
+	case GroupItem:
+		ga := &GroupArchive{}
+		if err := gob.NewDecoder(bytes.NewReader(itemBytes)).Decode(ga); err != nil {
 			return 0, err
 		}
+		cursor := tx.NewItemID()
+		group := groupFromArchive(tx, ga, cursor)
+		group.ParentGroup = newParentID
+		tx.PutGroup(cursor, group)
 		return cursor, nil
-	case GroupItem:
-		err := errors.New("group in group are not supported yet")
-		log.Warn(err)
-		return 0, err
 	default:
 		err := errors.New("unexpected type of user_record")
 		log.Warnf("unknown type: %s", itemType)
 		return 0, err
 	}
 }
+
+// unregisterItem removes the matcher or the cron entry registered for an item
+func unregisterItem(itemType ItemType, id uint64) {
+	switch itemType {
+	case RuleItem:
+		if matcher, ok := registry.zeroMatcher[id]; ok {
+			matcher.Delete()
+			delete(registry.zeroMatcher, id)
+		}
+	case TriggerItem:
+		if matcher, ok := registry.zeroTrigger[id]; ok {
+			matcher.Delete()
+			delete(registry.zeroTrigger, id)
+		}
+	case SchedulerItem:
+		if entry, ok := registry.entries[id]; ok {
+			scheduler.Remove(entry)
+			delete(registry.entries, id)
+		}
+	}
+}
+
+// itemFromBytes decodes a saved record of any kind
+func itemFromBytes(itemType ItemType, b []byte) (UserRecord, error) {
+	switch itemType {
+	case RuleItem:
+		return RuleFromBytes(b)
+	case TriggerItem:
+		return TriggerFromByte(b)
+	case SchedulerItem:
+		return JobFromBytes(b)
+	case ResourceItem:
+		return ResourceFromBytes(b)
+	case GroupItem:
+		return GroupFromBytes(b)
+	default:
+		return nil, errors.New("unexpected type of user_record")
+	}
+}
+
+func itemKey(itemType ItemType, id uint64) []byte {
+	switch itemType {
+	case RuleItem:
+		return ruleKey(id)
+	case TriggerItem:
+		return triggerKey(id)
+	case SchedulerItem:
+		return jobKey(id)
+	case ResourceItem:
+		return resourceKey(id)
+	default:
+		return groupKey(id)
+	}
+}
@@ -0,0 +1,137 @@
+package gypsum
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/flosch/pongo2"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/yuudi/gypsum/gypsum/luatag"
+	"github.com/yuudi/gypsum/gypsum/template"
+)
+
+// ExecutionLimits is the budget of one render of a rule, trigger or scheduled job.
+// In the config, a field left 0 uses the default, and a negative Timeout or LuaInstructions means no limit.
+// In an item, a field left 0 uses the config, and a limit can only be tighter than the config.
+type ExecutionLimits struct {
+	// Timeout is the wall-clock time in seconds
+	Timeout int `json:"timeout" yaml:"timeout"`
+	// LuaInstructions is how many instructions all lua blocks in a render can execute
+	LuaInstructions int64 `json:"lua_instructions" yaml:"lua_instructions"`
+	// LuaRegistrySize limits the number of values on the lua data stack
+	LuaRegistrySize int `json:"lua_registry_size" yaml:"lua_registry_size"`
+	// LuaCallStackSize limits the depth of lua function calls
+	LuaCallStackSize int `json:"lua_call_stack_size" yaml:"lua_call_stack_size"`
+}
+
+var defaultExecutionLimits = ExecutionLimits{
+	Timeout:          60,
+	LuaInstructions:  50000000,
+	LuaRegistrySize:  256 * 20,
+	LuaCallStackSize: 256,
+}
+
+func (l ExecutionLimits) check() error {
+	if l.LuaRegistrySize < 0 {
+		return errors.New(fmt.Sprintf("invalid lua registry size: %d", l.LuaRegistrySize))
+	}
+	if l.LuaCallStackSize < 0 {
+		return errors.New(fmt.Sprintf("invalid lua call stack size: %d", l.LuaCallStackSize))
+	}
+	return nil
+}
+
+// globalLimits are the limits in the config with the defaults filled
+func globalLimits() ExecutionLimits {
+	var l ExecutionLimits
+	if Config != nil {
+		l = Config.Limits
+	}
+	if l.Timeout == 0 {
+		l.Timeout = defaultExecutionLimits.Timeout
+	}
+	if l.LuaInstructions == 0 {
+		l.LuaInstructions = defaultExecutionLimits.LuaInstructions
+	}
+	if l.LuaRegistrySize == 0 {
+		l.LuaRegistrySize = defaultExecutionLimits.LuaRegistrySize
+	}
+	if l.LuaCallStackSize == 0 {
+		l.LuaCallStackSize = defaultExecutionLimits.LuaCallStackSize
+	}
+	return l
+}
+
+// tighter returns the item limit if it is set and tighter than the global limit, a global limit under 0 is no limit
+func tighter(item, global int64) int64 {
+	if item > 0 && (global <= 0 || item < global) {
+		return item
+	}
+	return global
+}
+
+// within applies the limits of an item to the global limits
+func (l ExecutionLimits) within(global ExecutionLimits) ExecutionLimits {
+	return ExecutionLimits{
+		Timeout:          int(tighter(int64(l.Timeout), int64(global.Timeout))),
+		LuaInstructions:  tighter(l.LuaInstructions, global.LuaInstructions),
+		LuaRegistrySize:  int(tighter(int64(l.LuaRegistrySize), int64(global.LuaRegistrySize))),
+		LuaCallStackSize: int(tighter(int64(l.LuaCallStackSize), int64(global.LuaCallStackSize))),
+	}
+}
+
+// execution is one render of an item, Close must be called after the render
+type execution struct {
+	item   string
+	ctx    context.Context
+	cancel context.CancelFunc
+	lua    *luatag.Session
+}
+
+func newExecution(item string, limits ExecutionLimits) *execution {
+	l := limits.within(globalLimits())
+	e := &execution{item: item}
+	if l.Timeout > 0 {
+		e.ctx, e.cancel = context.WithTimeout(context.Background(), time.Duration(l.Timeout)*time.Second)
+	} else {
+		e.ctx, e.cancel = context.WithCancel(context.Background())
+	}
+	e.lua = luatag.NewSession(e.ctx, luatag.Limits{
+		Instructions:  l.LuaInstructions,
+		RegistrySize:  l.LuaRegistrySize,
+		CallStackSize: l.LuaCallStackSize,
+	})
+	return e
+}
+
+func (e *execution) Close() {
+	e.lua.Release()
+	e.cancel()
+}
+
+// Context is the execution context shared by all kinds of items
+func (e *execution) Context(namespace string) pongo2.Context {
+	return pongo2.Context{
+		"_lua":       e.lua,
+		"_namespace": namespace,
+	}.Update(template.NewDatabase(namespace).Functions("db_")).Update(template.NewExecution(e.ctx).Functions())
+}
+
+// Check is called with the result of the render.
+// If a limit is exceeded, the item is logged and the result must be dropped even if the render finished.
+func (e *execution) Check(err error) error {
+	var exceeded error
+	if e.ctx.Err() == context.DeadlineExceeded {
+		exceeded = errors.New("execution timeout")
+	} else {
+		exceeded = e.lua.Exceeded()
+	}
+	if exceeded == nil {
+		return err
+	}
+	log.Warnf("%s 超出执行限制：%s", e.item, exceeded)
+	return errors.New(fmt.Sprintf("超出执行限制：%s", exceeded))
+}
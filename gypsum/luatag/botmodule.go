@@ -8,6 +8,8 @@ import (
 	zeroMessage "github.com/wdvxdr1123/ZeroBot/message"
 	lua "github.com/yuin/gopher-lua"
 	luaJson "layeh.com/gopher-json"
+
+	"github.com/yuudi/gypsum/gypsum/outgoing"
 )
 
 func botModLoaderFunc(event *zero.Event) lua.LGFunction {
@@ -50,7 +52,7 @@ func botApi(L *lua.LState) int {
 			}
 		})
 	}
-	result := zero.CallAction(action, params)
+	result := outgoing.CallAction(action, params)
 	luaResult, _ := luaJson.Decode(L, []byte(result.Raw))
 	L.Push(luaResult)
 	return 1
@@ -74,7 +76,7 @@ func sendToEvent(event *zero.Event) lua.LGFunction {
 		if !safe {
 			msg = zeroMessage.EscapeCQCodeText(msg)
 		}
-		messageID := zero.Send(*event, msg)
+		messageID := outgoing.Send(*event, msg)
 		L.Push(lua.LNumber(messageID))
 		return 1
 	}
@@ -97,7 +99,7 @@ func sendPrivateMessage(L *lua.LState) int {
 	if !safe {
 		message = zeroMessage.EscapeCQCodeText(message)
 	}
-	messageID := zero.SendPrivateMessage(userID, message)
+	messageID := outgoing.SendPrivateMessage(userID, message)
 	L.Push(lua.LNumber(messageID))
 	return 1
 }
@@ -119,7 +121,7 @@ func sendGroupMessage(L *lua.LState) int {
 	if !safe {
 		message = zeroMessage.EscapeCQCodeText(message)
 	}
-	messageID := zero.SendGroupMessage(groupID, message)
+	messageID := outgoing.SendGroupMessage(groupID, message)
 	L.Push(lua.LNumber(messageID))
 	return 1
 }
@@ -0,0 +1,90 @@
+package luatag
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+var (
+	ErrInstructionBudget = errors.New("lua instruction budget exceeded")
+	ErrCallStackSize     = errors.New("lua call stack size exceeded")
+	ErrRegistrySize      = errors.New("lua registry size exceeded")
+)
+
+// Limits of lua in one render, 0 means the default of gopher-lua for sizes, and no limit for instructions
+type Limits struct {
+	// Instructions is how many lua instructions all blocks in a render can execute
+	Instructions int64
+	// RegistrySize is the size of the data stack, it limits the number of values on the stack
+	RegistrySize int
+	// CallStackSize limits the depth of function calls
+	CallStackSize int
+}
+
+func (l Limits) stateSize() stateSize {
+	size := stateSize{registry: l.RegistrySize, callStack: l.CallStackSize}
+	if size.registry <= 0 {
+		size.registry = lua.RegistrySize
+	}
+	if size.callStack <= 0 {
+		size.callStack = lua.CallStackSize
+	}
+	return size
+}
+
+var closedChannel = func() chan struct{} {
+	c := make(chan struct{})
+	close(c)
+	return c
+}()
+
+// instructionBudget is the context of lua states in a render.
+// gopher-lua checks Done of the context before every instruction, so it is where instructions are counted.
+type instructionBudget struct {
+	context.Context
+	limited   bool
+	remaining int64
+}
+
+func newInstructionBudget(ctx context.Context, instructions int64) *instructionBudget {
+	return &instructionBudget{
+		Context:   ctx,
+		limited:   instructions > 0,
+		remaining: instructions,
+	}
+}
+
+func (b *instructionBudget) Done() <-chan struct{} {
+	if b.limited {
+		b.remaining--
+		if b.remaining < 0 {
+			return closedChannel
+		}
+	}
+	return b.Context.Done()
+}
+
+func (b *instructionBudget) Err() error {
+	if b.limited && b.remaining < 0 {
+		return ErrInstructionBudget
+	}
+	return b.Context.Err()
+}
+
+// exceededLimit finds which limit stopped a block that failed with err
+func (s *Session) exceededLimit(err error) error {
+	if budgetErr := s.budget.Err(); budgetErr != nil {
+		return budgetErr
+	}
+	message := err.Error()
+	if strings.Contains(message, "stack overflow") {
+		return ErrCallStackSize
+	}
+	if strings.Contains(message, "registry overflow") {
+		return ErrRegistrySize
+	}
+	return nil
+}
@@ -3,10 +3,15 @@ package luatag
 import (
 	"bytes"
 	"encoding/gob"
+	"errors"
+	"fmt"
+	"time"
 
 	log "github.com/sirupsen/logrus"
-	"github.com/syndtr/goleveldb/leveldb"
 	lua "github.com/yuin/gopher-lua"
+
+	"github.com/yuudi/gypsum/gypsum/storage"
+	"github.com/yuudi/gypsum/gypsum/userdata"
 )
 
 func init() {
@@ -17,66 +22,322 @@ func init() {
 	gob.Register(lua.LTable{})
 }
 
-var db *leveldb.DB
+// dbLoader loads module `database` working in the namespace, `database.global` works in the global namespace
+func dbLoader(namespace string) lua.LGFunction {
+	return func(L *lua.LState) int {
+		mod := L.NewTable()
+		L.SetFuncs(mod, dbFunctions(namespace))
+		global := L.NewTable()
+		L.SetFuncs(global, dbFunctions(userdata.Global))
+		L.SetField(mod, "global", global)
+		L.Push(mod)
+		return 1
+	}
+}
+
+func dbFunctions(namespace string) map[string]lua.LGFunction {
+	return map[string]lua.LGFunction{
+		"get":    dbGet(namespace),
+		"put":    dbPut(namespace),
+		"delete": dbDelete(namespace),
+		"list":   dbList(namespace),
+		"incr":   dbIncr(namespace),
+		"cas":    dbCompareAndSet(namespace),
+	}
+}
+
+// decodeLegacyValue reads a value saved by lua before DataStore was shared, which is a gob encoded *lua.LValue
+func decodeLegacyValue(b []byte) (lua.LValue, error) {
+	var data *lua.LValue
+	buffer := bytes.Buffer{}
+	buffer.Write(b)
+	decoder := gob.NewDecoder(&buffer)
+	if err := decoder.Decode(&data); err != nil {
+		return lua.LNil, err
+	}
+	return *data, nil
+}
+
+// DecodeLegacyValue converts a value saved by lua before DataStore was shared into the shared value model
+func DecodeLegacyValue(b []byte) (interface{}, error) {
+	value, err := decodeLegacyValue(b)
+	if err != nil {
+		return nil, err
+	}
+	return toGoValue(value)
+}
 
-func SetDB(newDB *leveldb.DB) {
-	db = newDB
+// toGoValue converts a lua value into the shared value model.
+// A table is a list if its keys are 1..n, a map if its keys are all strings, and an empty table is an empty list.
+func toGoValue(value lua.LValue) (interface{}, error) {
+	return toGoValueVisited(value, map[*lua.LTable]bool{})
 }
 
-func dbLoader(L *lua.LState) int {
-	mod := L.NewTable()
-	L.SetFuncs(mod, map[string]lua.LGFunction{
-		"get": dbGet,
-		"put": dbPut,
-	})
-	L.Push(mod)
-	return 1
+func toGoValueVisited(value lua.LValue, visited map[*lua.LTable]bool) (interface{}, error) {
+	switch v := value.(type) {
+	case *lua.LNilType:
+		return nil, nil
+	case lua.LBool:
+		return bool(v), nil
+	case lua.LNumber:
+		return userdata.Normalize(float64(v))
+	case lua.LString:
+		return string(v), nil
+	case *lua.LTable:
+		if visited[v] {
+			return nil, errors.New("cannot save table that contains itself")
+		}
+		visited[v] = true
+		defer delete(visited, v)
+		key, item := v.Next(lua.LNil)
+		switch key.Type() {
+		case lua.LTNil:
+			return []interface{}{}, nil
+		case lua.LTNumber:
+			list := make([]interface{}, 0, v.Len())
+			for expected := lua.LNumber(1); key != lua.LNil; expected++ {
+				if key != expected {
+					return nil, errors.New("cannot save table with keys other than 1..n or strings")
+				}
+				goItem, err := toGoValueVisited(item, visited)
+				if err != nil {
+					return nil, err
+				}
+				list = append(list, goItem)
+				key, item = v.Next(key)
+			}
+			return list, nil
+		case lua.LTString:
+			m := map[string]interface{}{}
+			for key != lua.LNil {
+				if key.Type() != lua.LTString {
+					return nil, errors.New("cannot save table with mixed keys")
+				}
+				goItem, err := toGoValueVisited(item, visited)
+				if err != nil {
+					return nil, err
+				}
+				m[string(key.(lua.LString))] = goItem
+				key, item = v.Next(key)
+			}
+			return m, nil
+		default:
+			return nil, errors.New(fmt.Sprintf("cannot save table with %s keys", key.Type()))
+		}
+	default:
+		return nil, errors.New(fmt.Sprintf("cannot save %s to database", value.Type()))
+	}
 }
 
-func dbGet(L *lua.LState) int {
-	key := L.ToString(1)
-	defaultValue := L.Get(2)
-	bytesKey := []byte(key)
-	bytesData, err := db.Get(append([]byte("gypsum-userDB-lua-"), bytesKey...), nil)
+// toLuaValue converts a value in the shared value model into lua
+func toLuaValue(L *lua.LState, value interface{}) lua.LValue {
+	switch v := value.(type) {
+	case bool:
+		return lua.LBool(v)
+	case int:
+		return lua.LNumber(v)
+	case float64:
+		return lua.LNumber(v)
+	case string:
+		return lua.LString(v)
+	case []interface{}:
+		table := L.CreateTable(len(v), 0)
+		for _, item := range v {
+			table.Append(toLuaValue(L, item))
+		}
+		return table
+	case map[string]interface{}:
+		table := L.CreateTable(0, len(v))
+		for key, item := range v {
+			table.RawSetString(key, toLuaValue(L, item))
+		}
+		return table
+	default:
+		return lua.LNil
+	}
+}
+
+// encodeValue makes a value of DataStore from a lua value
+func encodeValue(value lua.LValue) (*userdata.Value, error) {
+	goValue, err := toGoValue(value)
 	if err != nil {
-		if err == leveldb.ErrNotFound {
-			L.Push(defaultValue)
+		return nil, err
+	}
+	return userdata.EncodeValue(goValue)
+}
+
+// ttlArgument reads the optional time-to-live in seconds at position n
+func ttlArgument(L *lua.LState, n int) time.Duration {
+	return time.Duration(L.OptInt64(n, 0)) * time.Second
+}
+
+func dbGet(namespace string) lua.LGFunction {
+	return func(L *lua.LState) int {
+		key := L.ToString(1)
+		defaultValue := L.Get(2)
+		bytesKey := []byte(key)
+		v, err := userdata.DataStore.Get(namespace, bytesKey)
+		if err != nil {
+			if err == storage.ErrNotFound {
+				L.Push(defaultValue)
+				return 1
+			}
+			log.Error(err)
+			L.Push(lua.LNil)
+			L.Push(lua.LString("database error: " + err.Error()))
+			return 2
+		}
+		data, err := userdata.DecodeValue(v)
+		if err != nil {
+			log.Errorf("error when reading data from database: %s", err)
+			L.Push(lua.LNil)
+			L.Push(lua.LString("error when reading data from database: " + err.Error()))
+			return 2
+		}
+		L.Push(toLuaValue(L, data))
+		return 1
+	}
+}
+
+func dbPut(namespace string) lua.LGFunction {
+	return func(L *lua.LState) int {
+		key := L.ToString(1)
+		value := L.Get(2)
+		bytesKey := []byte(key)
+		v, err := encodeValue(value)
+		if err != nil {
+			log.Errorf("error when encode value as bytes: %s", err)
+			L.Push(lua.LString("error when encode value as bytes: " + err.Error()))
 			return 1
 		}
-		log.Error(err)
-		L.Push(lua.LNil)
-		L.Push(lua.LString("database error: " + err.Error()))
-		return 2
+		if err := userdata.DataStore.Put(namespace, bytesKey, v.Format, v.Payload, ttlArgument(L, 3)); err != nil {
+			log.Errorf("error when put value to database: %s", err)
+			L.Push(lua.LString("error when put value to database: " + err.Error()))
+			return 1
+		}
+		return 0
 	}
-	var data *lua.LValue
-	buffer := bytes.Buffer{}
-	buffer.Write(bytesData)
-	decoder := gob.NewDecoder(&buffer)
-	if err := decoder.Decode(&data); err != nil {
-		log.Errorf("error when reading data from database: %s", err)
-		L.Push(lua.LNil)
-		L.Push(lua.LString("error when reading data from database: " + err.Error()))
-		return 2
+}
+
+func dbDelete(namespace string) lua.LGFunction {
+	return func(L *lua.LState) int {
+		key := L.ToString(1)
+		if err := userdata.DataStore.Delete(namespace, []byte(key)); err != nil {
+			log.Errorf("error when delete value from database: %s", err)
+			L.Push(lua.LString("error when delete value from database: " + err.Error()))
+			return 1
+		}
+		return 0
 	}
-	L.Push(*data)
-	return 1
 }
 
-func dbPut(L *lua.LState) int {
-	key := L.ToString(1)
-	value := L.Get(2)
-	bytesKey := []byte(key)
-	buffer := bytes.Buffer{}
-	encoder := gob.NewEncoder(&buffer)
-	if err := encoder.Encode(&value); err != nil {
-		log.Errorf("error when encode valueStore as bytes: %s", err)
-		L.Push(lua.LString("error when encode valueStore as bytes: " + err.Error()))
+// dbList returns an array of {key=..., value=...} with keys in ascending order
+func dbList(namespace string) lua.LGFunction {
+	return func(L *lua.LState) int {
+		prefix := L.OptString(1, "")
+		limit := L.OptInt(2, 0)
+		entries, err := userdata.DataStore.List(namespace, []byte(prefix), limit)
+		if err != nil {
+			log.Error(err)
+			L.Push(lua.LNil)
+			L.Push(lua.LString("database error: " + err.Error()))
+			return 2
+		}
+		list := L.NewTable()
+		for _, e := range entries {
+			value, err := userdata.DecodeValue(e.Value)
+			if err != nil {
+				log.Errorf("error when reading data from database: %s", err)
+				continue
+			}
+			entry := L.NewTable()
+			L.SetField(entry, "key", lua.LString(e.Key))
+			L.SetField(entry, "value", toLuaValue(L, value))
+			list.Append(entry)
+		}
+		L.Push(list)
 		return 1
 	}
-	if err := db.Put(append([]byte("gypsum-userDB-lua-"), bytesKey...), buffer.Bytes(), nil); err != nil {
-		log.Errorf("error when put value to database: %s", err)
-		L.Push(lua.LString("error when put value to database: " + err.Error()))
+}
+
+// dbIncr adds delta (default 1) to a number atomically and returns the new number, a missing key counts as 0
+func dbIncr(namespace string) lua.LGFunction {
+	return func(L *lua.LState) int {
+		key := L.ToString(1)
+		delta := L.OptNumber(2, 1)
+		var result lua.LNumber
+		err := userdata.DataStore.Update(namespace, []byte(key), ttlArgument(L, 3), func(old *userdata.Value) (*userdata.Value, error) {
+			var current lua.LNumber
+			if old != nil {
+				value, err := userdata.DecodeValue(old)
+				if err != nil {
+					return nil, err
+				}
+				switch number := value.(type) {
+				case int:
+					current = lua.LNumber(number)
+				case float64:
+					current = lua.LNumber(number)
+				default:
+					return nil, errors.New(fmt.Sprintf("cannot increase %T value of key %s", value, key))
+				}
+			}
+			result = current + delta
+			return encodeValue(result)
+		})
+		if err != nil {
+			log.Errorf("error when increase value in database: %s", err)
+			L.Push(lua.LNil)
+			L.Push(lua.LString("database error: " + err.Error()))
+			return 2
+		}
+		L.Push(result)
+		return 1
+	}
+}
+
+// dbCompareAndSet writes the new value only if the key still holds the old value, nil old value means the key must not exist.
+// Tables are compared by their content.
+func dbCompareAndSet(namespace string) lua.LGFunction {
+	return func(L *lua.LState) int {
+		key := L.ToString(1)
+		oldValue := L.Get(2)
+		expected, err := toGoValue(L.Get(2))
+		if err != nil {
+			log.Errorf("error when compare value: %s", err)
+			L.Push(lua.LFalse)
+			L.Push(lua.LString("error when compare value: " + err.Error()))
+			return 2
+		}
+		newValue, err := encodeValue(L.Get(3))
+		if err != nil {
+			log.Errorf("error when encode value as bytes: %s", err)
+			L.Push(lua.LFalse)
+			L.Push(lua.LString("error when encode value as bytes: " + err.Error()))
+			return 2
+		}
+		swapped := false
+		err = userdata.DataStore.Update(namespace, []byte(key), ttlArgument(L, 4), func(old *userdata.Value) (*userdata.Value, error) {
+			if old == nil {
+				if oldValue != lua.LNil {
+					return nil, nil
+				}
+			} else {
+				current, err := userdata.DecodeValue(old)
+				if err != nil || oldValue == lua.LNil || !userdata.Equal(current, expected) {
+					return nil, err
+				}
+			}
+			swapped = true
+			return newValue, nil
+		})
+		if err != nil {
+			log.Errorf("error when compare and set value in database: %s", err)
+			L.Push(lua.LFalse)
+			L.Push(lua.LString("database error: " + err.Error()))
+			return 2
+		}
+		L.Push(lua.LBool(swapped))
 		return 1
 	}
-	return 0
 }
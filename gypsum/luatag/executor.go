@@ -3,6 +3,7 @@ package luatag
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"net/http"
 	"time"
@@ -13,6 +14,8 @@ import (
 	zero "github.com/wdvxdr1123/ZeroBot"
 	"github.com/yuin/gopher-lua"
 	luaJson "layeh.com/gopher-json"
+
+	"github.com/yuudi/gypsum/gypsum/sandbox"
 )
 
 type tagLuaNode struct {
@@ -26,68 +29,100 @@ func (node tagLuaNode) Execute(ctx *pongo2.ExecutionContext, writer pongo2.Templ
 	}
 	s := b.String()
 
-	L := ctx.Public["_lua"].(*lua.LState)
-	if L == nil {
-		L = lua.NewState()
-		var metaEvent *zero.Event
-		metaEventInterface, ok := ctx.Public["_event"]
-		if ok {
-			metaEvent = metaEventInterface.(*zero.Event)
-		} else {
-			metaEvent = nil
+	session, _ := ctx.Public["_lua"].(*Session)
+	if session == nil {
+		// not rendered by a handler, the state lives for this block only
+		timeoutContext, cancel := context.WithTimeout(context.Background(), 300*time.Second)
+		defer cancel()
+		session = NewSession(timeoutContext, Limits{})
+		defer session.Release()
+	}
+	if session.state == nil {
+		session.state = acquireState(session.size)
+		if err := bindExecution(session.state.L, ctx, session.budget.Context); err != nil {
+			session.broken = true
+			log.Errorf("lua execution error: %s", err)
+			return nil
+		}
+	}
+	L := session.state.L
+	// blocks may be rendered into different writers, such as inside a filter block
+	L.SetGlobal("write", L.NewFunction(Writer(writer, false)))
+	L.SetGlobal("write_safe", L.NewFunction(Writer(writer, true)))
+	L.SetContext(session.budget)
+	if err := L.DoString(s); err != nil {
+		session.broken = true
+		if exceeded := session.exceededLimit(err); exceeded != nil {
+			session.exceeded = exceeded
+			return ctx.Error(fmt.Sprintf("lua execution stopped: %s", exceeded), nil)
 		}
+		return ctx.Error(fmt.Sprintf("lua execution error: %s", err), nil)
+	}
+	return nil
+}
 
-		L.PreloadModule("bot", botModLoaderFunc(metaEvent))
-		L.PreloadModule("database", dbLoader)
-		L.PreloadModule("json", luaJson.Loader)
-		L.PreloadModule("http", gluahttp.NewHttpModule(&http.Client{}).Loader)
-		var luaEvent lua.LValue
-		event, ok := ctx.Public["json_event"]
-		if !ok {
-			luaEvent = lua.LNil
-		} else {
-			var err error
-			luaEvent, err = luaJson.Decode(L, []byte(*event.(*string)))
-			if err != nil {
-				log.Errorf("lua execution error: cannot resume lua event from pongo2 context")
-				return nil
-			}
+// bindExecution sets what a pooled state sees of this render: the event, the state and the modules.
+// Requests and sleep stop when the render is cancelled.
+func bindExecution(L *lua.LState, ctx *pongo2.ExecutionContext, renderContext context.Context) error {
+	var metaEvent *zero.Event
+	metaEventInterface, ok := ctx.Public["_event"]
+	if ok {
+		metaEvent = metaEventInterface.(*zero.Event)
+	} else {
+		metaEvent = nil
+	}
+
+	L.PreloadModule("bot", botModLoaderFunc(metaEvent))
+	namespace, _ := ctx.Public["_namespace"].(string)
+	L.PreloadModule("database", dbLoader(namespace))
+	L.PreloadModule("json", luaJson.Loader)
+	L.PreloadModule("http", gluahttp.NewHttpModuleWithDo(func(req *http.Request) (*http.Response, error) {
+		return sandbox.Current().Do(req.WithContext(renderContext))
+	}).Loader)
+	var luaEvent lua.LValue
+	event, ok := ctx.Public["json_event"]
+	if !ok {
+		luaEvent = lua.LNil
+	} else {
+		var err error
+		luaEvent, err = luaJson.Decode(L, []byte(*event.(*string)))
+		if err != nil {
+			return errors.New("cannot resume lua event from pongo2 context")
 		}
-		var luaState lua.LValue
-		state, ok := ctx.Public["state"]
-		if !ok {
-			luaState = lua.LNil
-		} else {
-			luaState = L.NewTable()
-			for k, i := range state.(zero.State) {
-				switch v := i.(type) {
-				case string:
-					L.SetField(luaState, k, lua.LString(v))
-				case []string:
-					list := L.NewTable()
-					for _, s := range v {
-						list.Append(lua.LString(s))
-					}
-					L.SetField(luaState, k, list)
-				default:
-					log.Warnf("unknown type in state: %#v", v)
+	}
+	var luaState lua.LValue
+	state, ok := ctx.Public["state"]
+	if !ok {
+		luaState = lua.LNil
+	} else {
+		luaState = L.NewTable()
+		for k, i := range state.(zero.State) {
+			switch v := i.(type) {
+			case string:
+				L.SetField(luaState, k, lua.LString(v))
+			case float64:
+				L.SetField(luaState, k, lua.LNumber(v))
+			case []string:
+				list := L.NewTable()
+				for _, s := range v {
+					list.Append(lua.LString(s))
 				}
+				L.SetField(luaState, k, list)
+			case map[string]string:
+				table := L.NewTable()
+				for name, s := range v {
+					table.RawSetString(name, lua.LString(s))
+				}
+				L.SetField(luaState, k, table)
+			default:
+				log.Warnf("unknown type in state: %#v", v)
 			}
 		}
-		L.SetGlobal("write", L.NewFunction(Writer(writer, false)))
-		L.SetGlobal("write_safe", L.NewFunction(Writer(writer, true)))
-		L.SetGlobal("sleep", L.NewFunction(luaSleep))
-		L.SetGlobal("res", L.NewFunction(resFunc))
-		L.SetGlobal("event", luaEvent)
-		L.SetGlobal("state", luaState)
-		ctx.Public["_lua"] = L
-	}
-	timeoutContext, cancel := context.WithTimeout(context.Background(), 300*time.Second)
-	defer cancel()
-	L.SetContext(timeoutContext)
-	if err := L.DoString(s); err != nil {
-		return ctx.Error(fmt.Sprintf("lua execution error: %s", err), nil)
 	}
+	L.SetGlobal("sleep", L.NewFunction(luaSleep))
+	L.SetGlobal("res", L.NewFunction(resFunc))
+	L.SetGlobal("event", luaEvent)
+	L.SetGlobal("state", luaState)
 	return nil
 }
 
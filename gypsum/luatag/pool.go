@@ -0,0 +1,173 @@
+package luatag
+
+import (
+	"context"
+	"sync"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// maxIdleStates is how many lua states of one size are kept for reuse, states released beyond it are closed
+const maxIdleStates = 32
+
+// pooledState is a lua state with the standard libraries of the sandbox policy opened, and a snapshot of its tables to reset it after use
+type pooledState struct {
+	L        *lua.LState
+	size     stateSize
+	snapshot map[*lua.LTable]tableSnapshot
+	// builtinMetatables are metatables of values that are not tables, which debug.setmetatable can change
+	builtinMetatables map[lua.LValue]lua.LValue
+}
+
+type tableSnapshot struct {
+	fields    map[lua.LValue]lua.LValue
+	metatable lua.LValue
+}
+
+// stateSize is the size of the registry and the call stack, which cannot be changed once a state is created
+type stateSize struct {
+	registry  int
+	callStack int
+}
+
+var (
+	idleStatesMutex sync.Mutex
+	idleStates      = map[stateSize]chan *pooledState{}
+)
+
+func idleStatesOf(size stateSize) chan *pooledState {
+	idleStatesMutex.Lock()
+	defer idleStatesMutex.Unlock()
+	idle, ok := idleStates[size]
+	if !ok {
+		idle = make(chan *pooledState, maxIdleStates)
+		idleStates[size] = idle
+	}
+	return idle
+}
+
+func newPooledState(size stateSize) *pooledState {
+	p := &pooledState{
+		L:                 newSandboxedState(size),
+		size:              size,
+		snapshot:          map[*lua.LTable]tableSnapshot{},
+		builtinMetatables: map[lua.LValue]lua.LValue{},
+	}
+	for _, sample := range []lua.LValue{lua.LNil, lua.LFalse, lua.LNumber(0), lua.LString("")} {
+		p.builtinMetatables[sample] = p.L.GetMetatable(sample)
+	}
+	// globals, libraries in globals and tables in libraries (such as package.loaded), and the metatable of strings
+	p.takeSnapshot(p.L.G.Global, 2)
+	p.takeSnapshot(p.L.Get(lua.RegistryIndex).(*lua.LTable).RawGetString("_LOADED"), 1)
+	p.takeSnapshot(p.L.GetMetatable(lua.LString("")), 1)
+	return p
+}
+
+func (p *pooledState) takeSnapshot(value lua.LValue, depth int) {
+	table, ok := value.(*lua.LTable)
+	if !ok {
+		return
+	}
+	if _, ok := p.snapshot[table]; ok {
+		return
+	}
+	s := tableSnapshot{
+		fields:    map[lua.LValue]lua.LValue{},
+		metatable: p.L.GetMetatable(table),
+	}
+	p.snapshot[table] = s
+	table.ForEach(func(k, v lua.LValue) {
+		s.fields[k] = v
+	})
+	if depth == 0 {
+		return
+	}
+	for _, v := range s.fields {
+		p.takeSnapshot(v, depth-1)
+	}
+}
+
+// reset puts back everything a script may have changed in the snapshot tables: added globals, replaced library functions, loaded modules
+func (p *pooledState) reset() {
+	p.L.SetTop(0)
+	p.L.RemoveContext()
+	for table, s := range p.snapshot {
+		var keys []lua.LValue
+		table.ForEach(func(k, _ lua.LValue) {
+			keys = append(keys, k)
+		})
+		for _, k := range keys {
+			if _, ok := s.fields[k]; !ok {
+				table.RawSet(k, lua.LNil)
+			}
+		}
+		for k, v := range s.fields {
+			table.RawSet(k, v)
+		}
+		if p.L.GetMetatable(table) != s.metatable {
+			p.L.SetMetatable(table, s.metatable)
+		}
+	}
+	for sample, metatable := range p.builtinMetatables {
+		if p.L.GetMetatable(sample) != metatable {
+			p.L.SetMetatable(sample, metatable)
+		}
+	}
+}
+
+func acquireState(size stateSize) *pooledState {
+	select {
+	case p := <-idleStatesOf(size):
+		return p
+	default:
+		return newPooledState(size)
+	}
+}
+
+func releaseState(p *pooledState) {
+	p.reset()
+	select {
+	case idleStatesOf(p.size) <- p:
+	default:
+		p.L.Close()
+	}
+}
+
+// Session is the lua state shared by all lua blocks in one render, so that globals set in a block are seen by the next block.
+// The state is taken from the pool by the first lua block, Release gives it back.
+// All blocks run with the context of the render and share one instruction budget.
+type Session struct {
+	state    *pooledState
+	size     stateSize
+	budget   *instructionBudget
+	broken   bool
+	exceeded error
+}
+
+func NewSession(ctx context.Context, limits Limits) *Session {
+	return &Session{
+		size:   limits.stateSize(),
+		budget: newInstructionBudget(ctx, limits.Instructions),
+	}
+}
+
+// Exceeded returns the limit that stopped a lua block, or nil
+func (s *Session) Exceeded() error {
+	if s == nil {
+		return nil
+	}
+	return s.exceeded
+}
+
+// Release gives the lua state back to the pool, a state that failed in execution is closed instead, since it may be left inconsistent
+func (s *Session) Release() {
+	if s == nil || s.state == nil {
+		return
+	}
+	if s.broken {
+		s.state.L.Close()
+	} else {
+		releaseState(s.state)
+	}
+	s.state = nil
+}
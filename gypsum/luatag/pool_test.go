@@ -0,0 +1,217 @@
+package luatag
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/flosch/pongo2"
+	zero "github.com/wdvxdr1123/ZeroBot"
+	lua "github.com/yuin/gopher-lua"
+
+	"github.com/yuudi/gypsum/gypsum/sandbox"
+	"github.com/yuudi/gypsum/gypsum/storage"
+	"github.com/yuudi/gypsum/gypsum/userdata"
+)
+
+const benchmarkScript = `
+local json = require("json")
+local sum = 0
+for i = 1, 100 do
+	sum = sum + i
+end
+write(json.encode({sum = sum, text = state.text}))
+`
+
+func benchmarkContext() *pongo2.ExecutionContext {
+	event := `{"message_type":"group","raw_message":"hello"}`
+	return &pongo2.ExecutionContext{
+		Public: pongo2.Context{
+			"json_event": &event,
+			"state":      zero.State{"text": "hello"},
+		},
+	}
+}
+
+// BenchmarkRenderPooled runs a lua block the way a render does: a state is taken from the pool, bound to the render and given back
+func BenchmarkRenderPooled(b *testing.B) {
+	ctx := benchmarkContext()
+	size := Limits{}.stateSize()
+	out := &bytes.Buffer{}
+	releaseState(acquireState(size))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		out.Reset()
+		p := acquireState(size)
+		if err := bindExecution(p.L, ctx, context.Background()); err != nil {
+			b.Fatal(err)
+		}
+		p.L.SetGlobal("write", p.L.NewFunction(Writer(out, false)))
+		if err := p.L.DoString(benchmarkScript); err != nil {
+			b.Fatal(err)
+		}
+		releaseState(p)
+	}
+}
+
+// BenchmarkRenderNewState runs the same lua block in a new state for every render, as it was done before states were pooled
+func BenchmarkRenderNewState(b *testing.B) {
+	ctx := benchmarkContext()
+	out := &bytes.Buffer{}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		out.Reset()
+		L := lua.NewState()
+		if err := bindExecution(L, ctx, context.Background()); err != nil {
+			b.Fatal(err)
+		}
+		L.SetGlobal("write", L.NewFunction(Writer(out, false)))
+		if err := L.DoString(benchmarkScript); err != nil {
+			b.Fatal(err)
+		}
+		L.Close()
+	}
+}
+
+// testStateSize is only used by these tests, so the pool of this size holds the state released by the previous execution
+var testStateSize = stateSize{registry: lua.RegistrySize + 1, callStack: lua.CallStackSize}
+
+func executionContext(namespace, text string) *pongo2.ExecutionContext {
+	event := `{"message_type":"group","raw_message":"` + text + `"}`
+	return &pongo2.ExecutionContext{
+		Public: pongo2.Context{
+			"json_event": &event,
+			"state":      zero.State{"text": text},
+			"_namespace": namespace,
+		},
+	}
+}
+
+// runPooled executes a script the way a render does, with a state from the pool, and returns the state and what is written
+func runPooled(t *testing.T, size stateSize, ctx *pongo2.ExecutionContext, script string) (*pooledState, string) {
+	t.Helper()
+	out := &bytes.Buffer{}
+	p := acquireState(size)
+	if err := bindExecution(p.L, ctx, context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	p.L.SetGlobal("write", p.L.NewFunction(Writer(out, false)))
+	p.L.SetContext(context.Background())
+	if err := p.L.DoString(script); err != nil {
+		t.Fatal(err)
+	}
+	releaseState(p)
+	return p, out.String()
+}
+
+// runTwice changes a state in the first execution and returns what the second execution on the same state writes
+func runTwice(t *testing.T, size stateSize, first, second string) string {
+	t.Helper()
+	p1, _ := runPooled(t, size, executionContext("", "first"), first)
+	p2, out := runPooled(t, size, executionContext("", "second"), second)
+	if p1 != p2 {
+		t.Fatal("the state is not reused")
+	}
+	return out
+}
+
+func TestPooledStateForgetsGlobals(t *testing.T) {
+	out := runTwice(t, testStateSize, `
+leaked = 1
+print = nil
+string.upper = nil
+table.custom = 1
+_G.tostring = function() return "leaked" end
+`, `
+write(tostring(leaked) .. " " .. type(print) .. " " .. type(string.upper) .. " " .. tostring(table.custom))
+`)
+	if want := "nil function function nil"; out != want {
+		t.Errorf("got %q, want %q", out, want)
+	}
+}
+
+func TestPooledStateForgetsLoadedModules(t *testing.T) {
+	out := runTwice(t, testStateSize, `
+package.loaded.fake = {}
+package.preload.fake_loader = function() return {} end
+local json = require("json")
+json.encode = nil
+`, `
+write(tostring(package.loaded.fake) .. " " .. tostring(package.preload.fake_loader) .. " " .. type(require("json").encode))
+`)
+	if want := "nil nil function"; out != want {
+		t.Errorf("got %q, want %q", out, want)
+	}
+}
+
+func TestPooledStateForgetsMetatables(t *testing.T) {
+	out := runTwice(t, testStateSize, `
+setmetatable(_G, {__index = function() return "leaked" end})
+setmetatable(table, {__index = function() return "leaked" end})
+getmetatable("").__index = {leaked = function() return "leaked" end}
+getmetatable("").__add = function() return "leaked" end
+`, `
+write(tostring(undefined_name) .. " " .. tostring(table.undefined_name) .. " " .. tostring(getmetatable("").__index == string) .. " " .. tostring(getmetatable("").__add))
+`)
+	if want := "nil nil true nil"; out != want {
+		t.Errorf("got %q, want %q", out, want)
+	}
+}
+
+func TestPooledStateForgetsBuiltinMetatables(t *testing.T) {
+	previous := sandbox.Current()
+	sandbox.SetPolicy(&sandbox.Policy{
+		LuaLibraries: append([]string{"debug"}, previous.LuaLibraries...),
+	})
+	defer sandbox.SetPolicy(previous)
+	// states with debug opened must not be handed to other tests
+	size := stateSize{registry: testStateSize.registry, callStack: testStateSize.callStack + 1}
+	defer func() {
+		for {
+			select {
+			case p := <-idleStatesOf(size):
+				p.L.Close()
+			default:
+				return
+			}
+		}
+	}()
+	out := runTwice(t, size, `
+debug.setmetatable(0, {__index = function() return "leaked" end})
+debug.setmetatable(nil, {__index = function() return "leaked" end})
+debug.setmetatable(true, {__index = function() return "leaked" end})
+`, `
+write(tostring(getmetatable(0)) .. " " .. tostring(getmetatable(nil)) .. " " .. tostring(getmetatable(true)))
+`)
+	if want := "nil nil nil"; out != want {
+		t.Errorf("got %q, want %q", out, want)
+	}
+}
+
+func TestPooledStateForgetsExecution(t *testing.T) {
+	userdata.SetDB(storage.NewMemory())
+	defer userdata.SetDB(nil)
+	p1, _ := runPooled(t, testStateSize, executionContext("first", "first"), `
+local database = require("database")
+database.put("key", "first")
+event_seen = event
+`)
+	if p1.L.Context() != nil {
+		t.Error("the context of the execution is kept after release")
+	}
+	p2, out := runPooled(t, testStateSize, executionContext("second", "second"), `
+local database = require("database")
+write(tostring(database.get("key")) .. " " .. state.text .. " " .. event.raw_message .. " " .. tostring(event_seen))
+`)
+	if p1 != p2 {
+		t.Fatal("the state is not reused")
+	}
+	if want := "nil second second nil"; out != want {
+		t.Errorf("got %q, want %q", out, want)
+	}
+	if v, err := userdata.DataStore.Get("first", []byte("key")); err != nil || string(v.Payload) != `"first"` {
+		t.Errorf("data of the first execution: %v %v", v, err)
+	}
+}
@@ -0,0 +1,98 @@
+package luatag
+
+import (
+	lua "github.com/yuin/gopher-lua"
+
+	"github.com/yuudi/gypsum/gypsum/sandbox"
+)
+
+var luaLibraryLoaders = map[string]struct {
+	name string
+	open lua.LGFunction
+}{
+	"base":      {lua.BaseLibName, lua.OpenBase},
+	"table":     {lua.TabLibName, lua.OpenTable},
+	"string":    {lua.StringLibName, lua.OpenString},
+	"math":      {lua.MathLibName, lua.OpenMath},
+	"coroutine": {lua.CoroutineLibName, lua.OpenCoroutine},
+	"channel":   {lua.ChannelLibName, lua.OpenChannel},
+	"os":        {lua.OsLibName, lua.OpenOs},
+	"io":        {lua.IoLibName, lua.OpenIo},
+	"debug":     {lua.DebugLibName, lua.OpenDebug},
+}
+
+// safeOsFunctions are kept in os when the os library is not enabled
+var safeOsFunctions = []string{"clock", "date", "difftime", "time"}
+
+func openLibrary(L *lua.LState, name string, open lua.LGFunction) {
+	L.Push(L.NewFunction(open))
+	L.Push(lua.LString(name))
+	L.Call(1, 0)
+}
+
+// newSandboxedState opens the libraries enabled by the sandbox policy
+func newSandboxedState(size stateSize) *lua.LState {
+	L := lua.NewState(lua.Options{
+		SkipOpenLibs:  true,
+		RegistrySize:  size.registry,
+		CallStackSize: size.callStack,
+	})
+	// package is always opened, modules of gypsum are loaded by require
+	openLibrary(L, lua.LoadLibName, lua.OpenPackage)
+	enabled := map[string]bool{}
+	for _, name := range sandbox.LuaLibraries {
+		for _, wanted := range sandbox.Current().LuaLibraries {
+			if name == wanted {
+				enabled[name] = true
+				lib := luaLibraryLoaders[name]
+				openLibrary(L, lib.name, lib.open)
+			}
+		}
+	}
+	loaded := L.Get(lua.RegistryIndex).(*lua.LTable).RawGetString("_LOADED").(*lua.LTable)
+	if !enabled["io"] {
+		L.SetGlobal("dofile", lua.LNil)
+		L.SetGlobal("loadfile", lua.LNil)
+		if pkg, ok := L.GetGlobal("package").(*lua.LTable); ok {
+			pkg.RawSetString("path", lua.LString(""))
+			pkg.RawSetString("cpath", lua.LString(""))
+		}
+	}
+	if !enabled["os"] {
+		openLibrary(L, lua.OsLibName, lua.OpenOs)
+		full := L.GetGlobal("os").(*lua.LTable)
+		os := L.NewTable()
+		for _, name := range safeOsFunctions {
+			os.RawSetString(name, full.RawGetString(name))
+		}
+		L.SetGlobal("os", os)
+		loaded.RawSetString("os", os)
+	}
+	if co, ok := L.GetGlobal(lua.CoroutineLibName).(*lua.LTable); ok {
+		shareContext(L, co, "create", func(v lua.LValue) lua.LValue { return v })
+		shareContext(L, co, "wrap", func(v lua.LValue) lua.LValue {
+			if fn, ok := v.(*lua.LFunction); ok && len(fn.Upvalues) > 0 {
+				return fn.Upvalues[0].Value()
+			}
+			return lua.LNil
+		})
+	}
+	return L
+}
+
+// shareContext makes coroutines run with the context of the state that creates them,
+// otherwise they get a context of their own and their instructions are not counted in the budget
+func shareContext(L *lua.LState, co *lua.LTable, name string, thread func(lua.LValue) lua.LValue) {
+	original, ok := co.RawGetString(name).(*lua.LFunction)
+	if !ok {
+		return
+	}
+	co.RawSetString(name, L.NewFunction(func(L *lua.LState) int {
+		L.Insert(original, 1)
+		L.Call(L.GetTop()-1, 1)
+		if th, ok := thread(L.Get(-1)).(*lua.LState); ok && L.Context() != nil {
+			th.SetContext(L.Context())
+		}
+		return 1
+	}))
+}
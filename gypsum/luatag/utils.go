@@ -31,6 +31,12 @@ func Writer(w interface{ WriteString(string) (int, error) }, safe bool) func(*lu
 func luaSleep(L *lua.LState) int {
 	arg := L.ToNumber(1)
 	duration := time.Duration(float64(arg) * float64(time.Second))
-	time.Sleep(duration)
+	timer := time.NewTimer(duration)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-L.Context().Done():
+		L.RaiseError(L.Context().Err().Error())
+	}
 	return 0
 }
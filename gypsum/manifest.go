@@ -0,0 +1,812 @@
+package gypsum
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v2"
+
+	"github.com/yuudi/gypsum/gypsum/helper"
+)
+
+// A manifest is the whole bot written as a directory tree of yaml files, so that it can be reviewed and kept in git.
+// Every directory is a group described by its group.yaml, the root directory is the root group.
+// Items are saved as <item_type>-<item_id>.yaml, subgroups as group-<group_id>/ directories.
+// Resources are saved as references only, their files stay in the resource directory.
+// A file name without a numeric id (e.g. rule-greeting.yaml) is a new item and gets a new id when imported.
+
+const manifestGroupFile = "group.yaml"
+
+// manifestNode is a group or an item read from a manifest
+type manifestNode struct {
+	itemType ItemType
+	id       uint64
+	hasID    bool
+	file     string
+	record   UserRecord
+	parent   *manifestNode
+	children []*manifestNode
+}
+
+type ManifestReport struct {
+	DryRun    bool     `json:"dry_run"`
+	Created   []string `json:"created"`
+	Updated   []string `json:"updated"`
+	Deleted   []string `json:"deleted"`
+	Unchanged int      `json:"unchanged"`
+}
+
+func (r *ManifestReport) Lines() []string {
+	lines := make([]string, 0, len(r.Created)+len(r.Updated)+len(r.Deleted)+1)
+	for _, s := range r.Created {
+		lines = append(lines, "create "+s)
+	}
+	for _, s := range r.Updated {
+		lines = append(lines, "update "+s)
+	}
+	for _, s := range r.Deleted {
+		lines = append(lines, "delete "+s)
+	}
+	verb := "applied"
+	if r.DryRun {
+		verb = "to apply"
+	}
+	lines = append(lines, fmt.Sprintf("%d created, %d updated, %d deleted, %d unchanged, %s", len(r.Created), len(r.Updated), len(r.Deleted), r.Unchanged, verb))
+	return lines
+}
+
+func manifestFileName(itemType ItemType, id uint64) string {
+	return fmt.Sprintf("%s-%d.yaml", itemType, id)
+}
+
+// parseManifestName parses a file name (without extension) or a directory name of a manifest
+func parseManifestName(name string) (itemType ItemType, id uint64, hasID bool, ok bool) {
+	i := strings.IndexByte(name, '-')
+	if i < 0 {
+		return "", 0, false, false
+	}
+	itemType = ItemType(name[:i])
+	switch itemType {
+	case RuleItem, TriggerItem, SchedulerItem, ResourceItem, GroupItem:
+	default:
+		return "", 0, false, false
+	}
+	id, err := strconv.ParseUint(name[i+1:], 10, 64)
+	if err != nil || id == 0 {
+		return itemType, 0, false, true
+	}
+	return itemType, id, true, true
+}
+
+func isManifestExt(ext string) bool {
+	return ext == ".yaml" || ext == ".yml" || ext == ".json"
+}
+
+// manifestWriter is where a manifest is exported to, names are slash separated
+type manifestWriter interface {
+	WriteFile(name string, data []byte) error
+}
+
+type dirManifestWriter string
+
+func (d dirManifestWriter) WriteFile(name string, data []byte) error {
+	p := filepath.Join(string(d), filepath.FromSlash(name))
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(p, data, 0644)
+}
+
+type zipManifestWriter struct {
+	*zip.Writer
+}
+
+func (z zipManifestWriter) WriteFile(name string, data []byte) error {
+	f, err := z.Create(name)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	return err
+}
+
+// writeManifest exports every item in registry, items are placed by their parent group
+func writeManifest(w manifestWriter) error {
+	children := make(map[uint64][]Item)
+	addChild := func(itemType ItemType, id uint64, item UserRecord) {
+		parentID := item.GetParentID()
+		if _, ok := registry.groups[parentID]; !ok {
+			log.Warnf("parent group %d of %s %d not found, exporting into root group", parentID, itemType, id)
+			parentID = 0
+		}
+		children[parentID] = append(children[parentID], Item{ItemType: itemType, ItemID: id})
+	}
+	for id, g := range registry.groups {
+		if id != 0 {
+			addChild(GroupItem, id, g)
+		}
+	}
+	for id, r := range registry.rules {
+		addChild(RuleItem, id, r)
+	}
+	for id, t := range registry.triggers {
+		addChild(TriggerItem, id, t)
+	}
+	for id, j := range registry.jobs {
+		addChild(SchedulerItem, id, j)
+	}
+	for id, r := range registry.resources {
+		addChild(ResourceItem, id, r)
+	}
+	return writeManifestGroup(w, "", 0, children, make(map[uint64]bool))
+}
+
+func writeManifestGroup(w manifestWriter, dir string, gid uint64, children map[uint64][]Item, visited map[uint64]bool) error {
+	if visited[gid] {
+		return errors.New(fmt.Sprintf("group %d is contained in itself", gid))
+	}
+	visited[gid] = true
+	data, err := yaml.Marshal(registry.groups[gid])
+	if err != nil {
+		return err
+	}
+	if err = w.WriteFile(path.Join(dir, manifestGroupFile), data); err != nil {
+		return err
+	}
+	for _, child := range children[gid] {
+		if child.ItemType == GroupItem {
+			subDir := path.Join(dir, fmt.Sprintf("%s-%d", GroupItem, child.ItemID))
+			if err = writeManifestGroup(w, subDir, child.ItemID, children, visited); err != nil {
+				return err
+			}
+			continue
+		}
+		item, _ := findItem(child.ItemType, child.ItemID)
+		data, err := yaml.Marshal(item)
+		if err != nil {
+			return err
+		}
+		if err = w.WriteFile(path.Join(dir, manifestFileName(child.ItemType, child.ItemID)), data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// cleanManifestDir removes files of a previous export, so that deleted items do not remain
+func cleanManifestDir(dir string) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return os.MkdirAll(dir, 0755)
+		}
+		return err
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() {
+			if itemType, _, _, ok := parseManifestName(name); ok && itemType == GroupItem {
+				if err = os.RemoveAll(filepath.Join(dir, name)); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		ext := path.Ext(name)
+		if !isManifestExt(ext) {
+			continue
+		}
+		if _, _, _, ok := parseManifestName(strings.TrimSuffix(name, ext)); ok || name == manifestGroupFile {
+			if err = os.Remove(filepath.Join(dir, name)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func decodeManifestRecord(itemType ItemType, data []byte) (UserRecord, error) {
+	var record UserRecord
+	switch itemType {
+	case RuleItem:
+		record = &Rule{
+			GroupsID:    []int64{},
+			UsersID:     []int64{},
+			Patterns:    []string{},
+			Probability: 1,
+		}
+	case TriggerItem:
+		record = &Trigger{
+			GroupsID:    []int64{},
+			UsersID:     []int64{},
+			TriggerType: []string{},
+			Probability: 1,
+		}
+	case SchedulerItem:
+		record = &ScheduledJob{
+			GroupsID: []int64{},
+			UsersID:  []int64{},
+		}
+	case ResourceItem:
+		record = &Resource{}
+	case GroupItem:
+		record = &Group{
+			Active: true,
+			Items:  []Item{},
+		}
+	default:
+		return nil, errors.New("unexpected type of user_record")
+	}
+	if err := yaml.UnmarshalStrict(data, record); err != nil {
+		return nil, err
+	}
+	return record, nil
+}
+
+// readManifest reads a manifest tree, the root of fsys is the root group
+func readManifest(fsys fs.FS) (*manifestNode, error) {
+	root := &manifestNode{
+		itemType: GroupItem,
+		id:       0,
+		hasID:    true,
+		file:     manifestGroupFile,
+	}
+	data, err := fs.ReadFile(fsys, manifestGroupFile)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, errors.New("not a gypsum manifest: " + manifestGroupFile + " not found")
+		}
+		return nil, err
+	}
+	if root.record, err = decodeManifestRecord(GroupItem, data); err != nil {
+		return nil, errors.New(fmt.Sprintf("%s: %s", root.file, err))
+	}
+	if err = readManifestDir(fsys, ".", root); err != nil {
+		return nil, err
+	}
+	return root, nil
+}
+
+func readManifestDir(fsys fs.FS, dir string, group *manifestNode) error {
+	entries, err := fs.ReadDir(fsys, dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if strings.HasPrefix(name, ".") || name == manifestGroupFile {
+			continue
+		}
+		file := path.Join(dir, name)
+		if entry.IsDir() {
+			itemType, id, hasID, ok := parseManifestName(name)
+			if !ok || itemType != GroupItem {
+				continue
+			}
+			node := &manifestNode{
+				itemType: GroupItem,
+				id:       id,
+				hasID:    hasID,
+				file:     path.Join(file, manifestGroupFile),
+				parent:   group,
+			}
+			data, err := fs.ReadFile(fsys, node.file)
+			if err != nil {
+				return err
+			}
+			if node.record, err = decodeManifestRecord(GroupItem, data); err != nil {
+				return errors.New(fmt.Sprintf("%s: %s", node.file, err))
+			}
+			group.children = append(group.children, node)
+			if err = readManifestDir(fsys, file, node); err != nil {
+				return err
+			}
+			continue
+		}
+		ext := path.Ext(name)
+		if !isManifestExt(ext) {
+			continue
+		}
+		itemType, id, hasID, ok := parseManifestName(strings.TrimSuffix(name, ext))
+		if !ok || itemType == GroupItem {
+			continue
+		}
+		data, err := fs.ReadFile(fsys, file)
+		if err != nil {
+			return err
+		}
+		record, err := decodeManifestRecord(itemType, data)
+		if err != nil {
+			return errors.New(fmt.Sprintf("%s: %s", file, err))
+		}
+		group.children = append(group.children, &manifestNode{
+			itemType: itemType,
+			id:       id,
+			hasID:    hasID,
+			file:     file,
+			record:   record,
+			parent:   group,
+		})
+	}
+	return nil
+}
+
+func (n *manifestNode) walk(fn func(node *manifestNode)) {
+	fn(n)
+	for _, child := range n.children {
+		child.walk(fn)
+	}
+}
+
+func checkManifestRecord(record UserRecord) error {
+	switch r := record.(type) {
+	case *Rule:
+		_, err := r.check()
+		return err
+	case *Trigger:
+		_, err := r.check()
+		return err
+	case *ScheduledJob:
+		if _, err := specParser.Parse(r.CronSpec); err != nil {
+			return errors.New(fmt.Sprintf("spec syntax error: %s", err))
+		}
+		if err := r.Limits.check(); err != nil {
+			return err
+		}
+		return checkTemplate(r.Action)
+	case *Group:
+		if err := r.Defaults.check(); err != nil {
+			return err
+		}
+		return checkActivation(r.StartAt, r.EndAt)
+	case *Resource:
+		if _, err := hex.DecodeString(r.Sha256Sum); err != nil || len(r.Sha256Sum) != 64 {
+			return errors.New("sha256_sum must be 64 hex digits")
+		}
+		if _, err := os.Stat(path.Join(resDir, r.Sha256Sum+r.Ext)); err != nil {
+			return errors.New(fmt.Sprintf("resource file not found: %s", err))
+		}
+	}
+	return nil
+}
+
+// itemTypeByID finds which kind of item an id belongs to
+func itemTypeByID(id uint64) (ItemType, bool) {
+	for _, itemType := range []ItemType{GroupItem, RuleItem, TriggerItem, SchedulerItem, ResourceItem} {
+		if _, ok := findItem(itemType, id); ok {
+			return itemType, true
+		}
+	}
+	return "", false
+}
+
+// checkManifest validates every record and makes sure ids in the manifest do not conflict.
+// The registry must be locked.
+func checkManifest(root *manifestNode) error {
+	files := make(map[uint64]string)
+	var err error
+	root.walk(func(node *manifestNode) {
+		if err != nil {
+			return
+		}
+		if e := checkManifestRecord(node.record); e != nil {
+			err = errors.New(fmt.Sprintf("%s: %s", node.file, e))
+			return
+		}
+		if !node.hasID {
+			return
+		}
+		if other, ok := files[node.id]; ok {
+			err = errors.New(fmt.Sprintf("%s and %s have the same id %d", other, node.file, node.id))
+			return
+		}
+		files[node.id] = node.file
+		if itemType, ok := itemTypeByID(node.id); ok && itemType != node.itemType {
+			err = errors.New(fmt.Sprintf("%s: id %d is used by a %s", node.file, node.id, itemType))
+		}
+	})
+	return err
+}
+
+func setRecordParent(record UserRecord, parentID uint64) {
+	switch r := record.(type) {
+	case *Rule:
+		r.ParentGroup = parentID
+	case *Trigger:
+		r.ParentGroup = parentID
+	case *ScheduledJob:
+		r.ParentGroup = parentID
+	case *Resource:
+		r.ParentGroup = parentID
+	case *Group:
+		r.ParentGroup = parentID
+	}
+}
+
+// replaceItem puts a record into registry in place of the old one, and registers it to the bot if asked
+func replaceItem(itemType ItemType, id uint64, record UserRecord, register bool) {
+	unregisterItem(itemType, id)
+	var err error
+	switch r := record.(type) {
+	case *Rule:
+		registry.rules[id] = r
+		if register {
+			err = r.Register(id)
+		}
+	case *Trigger:
+		registry.triggers[id] = r
+		if register {
+			err = r.Register(id)
+		}
+	case *ScheduledJob:
+		registry.jobs[id] = r
+		if register {
+			err = r.Register(id)
+		}
+	case *Resource:
+		registry.resources[id] = r
+	}
+	if err != nil {
+		log.Errorf("无法注册%s %d：%s", itemType, id, err)
+	}
+}
+
+func removeItem(itemType ItemType, id uint64) {
+	unregisterItem(itemType, id)
+	switch itemType {
+	case RuleItem:
+		delete(registry.rules, id)
+	case TriggerItem:
+		delete(registry.triggers, id)
+	case SchedulerItem:
+		delete(registry.jobs, id)
+	case ResourceItem:
+		delete(registry.resources, id)
+	}
+}
+
+func sameGroup(a, b *Group) bool {
+	if a.DisplayName != b.DisplayName || a.PluginName != b.PluginName || a.PluginVersion != b.PluginVersion || a.ParentGroup != b.ParentGroup || len(a.Items) != len(b.Items) {
+		return false
+	}
+	if a.Active != b.Active || !sameTime(a.StartAt, b.StartAt) || !sameTime(a.EndAt, b.EndAt) || !a.Defaults.equal(&b.Defaults) {
+		return false
+	}
+	for i := range a.Items {
+		if a.Items[i] != b.Items[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// applyManifest reconciles database with a checked manifest: missing items are created, changed items are updated,
+// and items not in the manifest are deleted. Everything is written in one transaction.
+// With register, changed items are registered to the bot. The registry must be locked for writing.
+func applyManifest(root *manifestNode, dryRun, register bool) (*ManifestReport, error) {
+	report := &ManifestReport{
+		DryRun:  dryRun,
+		Created: []string{},
+		Updated: []string{},
+		Deleted: []string{},
+	}
+	// ids of trashed items still belong to them, so that they can be restored
+	trashed, err := trashedItemIDs()
+	if err != nil {
+		return report, err
+	}
+	tx := newTransaction()
+	// allocate ids
+	wanted := make(map[uint64]bool)
+	var nodes []*manifestNode
+	root.walk(func(node *manifestNode) {
+		nodes = append(nodes, node)
+		if _, exists := findItem(node.itemType, node.id); node.hasID && !exists && trashed[node.id] {
+			log.Warnf("%s: id %d is used by an item in trash, a new id is allocated", node.file, node.id)
+			node.hasID = false
+		}
+		if node.hasID {
+			wanted[node.id] = true
+			if _, exists := findItem(node.itemType, node.id); !exists {
+				tx.ReserveItemID(node.id)
+			}
+		}
+	})
+	for _, node := range nodes {
+		if !node.hasID {
+			node.id = tx.NewItemID()
+			wanted[node.id] = true
+		}
+	}
+	describe := func(node *manifestNode) string {
+		return fmt.Sprintf("%s %d %s (%s)", node.itemType, node.id, node.record.GetDisplayName(), node.file)
+	}
+	// create and update
+	for _, node := range nodes {
+		var parentID uint64
+		if node.parent != nil {
+			parentID = node.parent.id
+		}
+		setRecordParent(node.record, parentID)
+		if node.itemType == GroupItem {
+			g := node.record.(*Group)
+			old, exists := registry.groups[node.id]
+			g.Items = manifestGroupItems(node, old)
+			if !exists {
+				report.Created = append(report.Created, describe(node))
+			} else if sameGroup(old, g) {
+				report.Unchanged++
+				continue
+			} else {
+				report.Updated = append(report.Updated, describe(node))
+				if err := tx.SaveRevision(GroupItem, node.id, old); err != nil {
+					log.Errorf("error when saving revision of group %d: %s", node.id, err)
+				}
+			}
+			tx.PutGroup(node.id, g)
+			continue
+		}
+		newBytes, err := node.record.ToBytes()
+		if err != nil {
+			return report, errors.New(fmt.Sprintf("%s: %s", node.file, err))
+		}
+		old, exists := findItem(node.itemType, node.id)
+		if exists {
+			oldBytes, err := old.ToBytes()
+			if err == nil && bytes.Equal(oldBytes, newBytes) {
+				report.Unchanged++
+				continue
+			}
+			report.Updated = append(report.Updated, describe(node))
+			if revisionKept(node.itemType) {
+				if err = tx.SaveRevision(node.itemType, node.id, old); err != nil {
+					log.Errorf("error when saving revision of %s %d: %s", node.itemType, node.id, err)
+				}
+			}
+		} else {
+			report.Created = append(report.Created, describe(node))
+		}
+		if err = node.record.SaveToBatch(tx.batch, node.id); err != nil {
+			return report, errors.New(fmt.Sprintf("%s: %s", node.file, err))
+		}
+		if res, ok := node.record.(*Resource); ok {
+			if oldRes, ok := old.(*Resource); ok && oldRes.Sha256Sum != res.Sha256Sum {
+				if idx, ok := resourceIDByHash(oldRes.Sha256Sum); ok && idx == node.id {
+					tx.batch.Delete(resourceHashKey(oldRes.Sha256Sum))
+				}
+			}
+			tx.batch.Put(resourceHashKey(res.Sha256Sum), helper.U64ToBytes(node.id))
+		}
+		node := node
+		tx.OnCommit(func() {
+			replaceItem(node.itemType, node.id, node.record, register)
+		})
+	}
+	// delete, deleted items are moved into trash
+	deleteItem := func(itemType ItemType, id uint64, item UserRecord) {
+		if wanted[id] || err != nil {
+			return
+		}
+		report.Deleted = append(report.Deleted, fmt.Sprintf("%s %d %s", itemType, id, item.GetDisplayName()))
+		if err = tx.MoveToTrash(itemType, id, item, nil); err != nil {
+			return
+		}
+		tx.OnCommit(func() {
+			removeItem(itemType, id)
+		})
+	}
+	for gid, g := range registry.groups {
+		if gid != 0 {
+			deleteItem(GroupItem, gid, g)
+		}
+	}
+	for id, r := range registry.rules {
+		deleteItem(RuleItem, id, r)
+	}
+	for id, t := range registry.triggers {
+		deleteItem(TriggerItem, id, t)
+	}
+	for id, j := range registry.jobs {
+		deleteItem(SchedulerItem, id, j)
+	}
+	for id, r := range registry.resources {
+		deleteItem(ResourceItem, id, r)
+	}
+	if err != nil {
+		return report, err
+	}
+	if dryRun {
+		return report, nil
+	}
+	if err = tx.Commit(); err != nil {
+		return report, err
+	}
+	return report, nil
+}
+
+// manifestGroupItems lists the children of a group node, keeping the order of items already in the group
+func manifestGroupItems(node *manifestNode, old *Group) []Item {
+	children := make(map[uint64]*manifestNode, len(node.children))
+	for _, child := range node.children {
+		children[child.id] = child
+	}
+	items := make([]Item, 0, len(node.children))
+	if old != nil {
+		for _, item := range old.Items {
+			if child, ok := children[item.ItemID]; ok && child.itemType == item.ItemType {
+				items = append(items, Item{
+					ItemType:    child.itemType,
+					DisplayName: child.record.GetDisplayName(),
+					ItemID:      child.id,
+				})
+				delete(children, item.ItemID)
+			}
+		}
+	}
+	for _, child := range node.children {
+		if _, ok := children[child.id]; ok {
+			items = append(items, Item{
+				ItemType:    child.itemType,
+				DisplayName: child.record.GetDisplayName(),
+				ItemID:      child.id,
+			})
+		}
+	}
+	return items
+}
+
+// ExportManifest writes all items in gypsum_data into dir while gypsum is not running
+func ExportManifest(dir string) error {
+	if err := openOffline(); err != nil {
+		return err
+	}
+	defer db.Close()
+	registry.RLock()
+	defer registry.RUnlock()
+	if err := cleanManifestDir(dir); err != nil {
+		return err
+	}
+	return writeManifest(dirManifestWriter(dir))
+}
+
+// ImportManifest reconciles gypsum_data with the manifest in dir while gypsum is not running
+func ImportManifest(dir string, dryRun bool, logger func(...interface{})) error {
+	if err := openOffline(); err != nil {
+		return err
+	}
+	defer db.Close()
+	root, err := readManifest(os.DirFS(dir))
+	if err != nil {
+		return err
+	}
+	registry.Lock()
+	defer registry.Unlock()
+	if err = checkManifest(root); err != nil {
+		return err
+	}
+	report, err := applyManifest(root, dryRun, false)
+	for _, line := range report.Lines() {
+		logger(line)
+	}
+	if err != nil || dryRun {
+		return err
+	}
+	return renameNewManifestFiles(dir, root)
+}
+
+// renameNewManifestFiles puts the allocated ids into names of new files, so that importing again updates them
+func renameNewManifestFiles(dir string, root *manifestNode) error {
+	var nodes []*manifestNode
+	root.walk(func(node *manifestNode) {
+		nodes = append(nodes, node)
+	})
+	// children are renamed before their directory
+	for i := len(nodes) - 1; i >= 0; i-- {
+		node := nodes[i]
+		if node.hasID {
+			continue
+		}
+		oldPath := node.file
+		newPath := path.Join(path.Dir(oldPath), manifestFileName(node.itemType, node.id))
+		if node.itemType == GroupItem {
+			oldPath = path.Dir(node.file)
+			newPath = path.Join(path.Dir(oldPath), fmt.Sprintf("%s-%d", GroupItem, node.id))
+		} else {
+			newPath = strings.TrimSuffix(newPath, ".yaml") + path.Ext(oldPath)
+		}
+		if err := os.Rename(filepath.Join(dir, filepath.FromSlash(oldPath)), filepath.Join(dir, filepath.FromSlash(newPath))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func exportManifest(c *gin.Context) {
+	registry.RLock()
+	defer registry.RUnlock()
+	buf := new(bytes.Buffer)
+	zipWriter := zip.NewWriter(buf)
+	if err := writeManifest(zipManifestWriter{zipWriter}); err != nil {
+		log.Error(err)
+		c.String(500, fmt.Sprintf("500 Internal Server Error\nServer got itself into trouble: %s", err))
+		return
+	}
+	if err := zipWriter.Close(); err != nil {
+		log.Error(err)
+		c.String(500, fmt.Sprintf("500 Internal Server Error\nServer got itself into trouble: %s", err))
+		return
+	}
+	c.Header("Content-Description", "File Transfer")
+	c.Header("Content-Disposition", "attachment; filename=gypsum-manifest.zip")
+	c.Data(200, "application/zip", buf.Bytes())
+}
+
+func importManifest(c *gin.Context) {
+	if c.ContentType() != "application/zip" {
+		c.JSON(415, gin.H{
+			"code":    5000,
+			"message": fmt.Sprintf("request type do not meet application/zip: %s", c.ContentType()),
+		})
+		return
+	}
+	dryRun := c.Query("dry_run") == "true"
+	body, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		c.JSON(500, gin.H{
+			"code":    6000,
+			"message": fmt.Sprintf("error when reading request body: %s", err),
+		})
+		return
+	}
+	zipReader, err := zip.NewReader(bytes.NewReader(body), int64(len(body)))
+	if err != nil {
+		c.JSON(400, gin.H{
+			"code":    5000,
+			"message": fmt.Sprintf("cannot read body as zipfile: %s", err),
+		})
+		return
+	}
+	root, err := readManifest(zipReader)
+	if err != nil {
+		c.JSON(422, gin.H{
+			"code":    4001,
+			"message": fmt.Sprintf("manifest error: %s", err),
+		})
+		return
+	}
+	registry.Lock()
+	defer registry.Unlock()
+	if err = checkManifest(root); err != nil {
+		c.JSON(422, gin.H{
+			"code":    4001,
+			"message": fmt.Sprintf("manifest error: %s", err),
+		})
+		return
+	}
+	report, err := applyManifest(root, dryRun, true)
+	if err != nil {
+		log.Error(err)
+		c.JSON(500, gin.H{
+			"code":    3000,
+			"message": fmt.Sprintf("Server got itself into trouble: %s", err),
+		})
+		return
+	}
+	c.JSON(200, gin.H{
+		"code":    0,
+		"message": "ok",
+		"report":  report,
+	})
+}
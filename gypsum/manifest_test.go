@@ -0,0 +1,80 @@
+package gypsum
+
+import (
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func TestApplyManifestTrash(t *testing.T) {
+	useTestMemory(t)
+	openTestRegistry(t)
+	groupID := mustCreate(t, createGroup, "group_id", `{"display_name":"kept group","active":true}`)
+	keptID := mustCreate(t, createRule, "rule_id", `{"display_name":"kept","active":true,"patterns":["a"],"response":"a"}`, "gid", itoa(groupID))
+	removedID := mustCreate(t, createRule, "rule_id", `{"display_name":"removed","active":true,"patterns":["b"],"response":"b"}`)
+	trashedID := mustCreate(t, createRule, "rule_id", `{"display_name":"trashed","active":true,"patterns":["c"],"response":"c"}`)
+	if code, body := callHandler(deleteRule, "DELETE", "/", "", "rid", itoa(trashedID)); code >= 300 {
+		t.Fatalf("delete rule: %d %s", code, body)
+	}
+
+	// the removed rule is not in the manifest, and a new rule asks for the id of the trashed rule
+	rule := func(name string) *fstest.MapFile {
+		return &fstest.MapFile{Data: []byte("display_name: " + name + "\nactive: true\npatterns: [" + name + "]\nresponse: " + name + "\n")}
+	}
+	manifest := fstest.MapFS{
+		"group.yaml":                             {Data: []byte("display_name: root group\nactive: true\n")},
+		"group-" + itoa(groupID) + "/group.yaml": {Data: []byte("display_name: kept group\nactive: true\n")},
+		"group-" + itoa(groupID) + "/rule-" + itoa(keptID) + ".yaml": rule("kept"),
+		"rule-" + itoa(trashedID) + ".yaml":                          rule("reused"),
+	}
+	root, err := readManifest(manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cursor := registry.cursor
+	registry.Lock()
+	report, err := applyManifest(root, false, false)
+	registry.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(report.Deleted) != 1 || !strings.HasPrefix(report.Deleted[0], "rule "+itoa(removedID)+" ") {
+		t.Errorf("deleted: %q", report.Deleted)
+	}
+	if _, ok := registry.rules[removedID]; ok {
+		t.Error("removed rule is still in registry")
+	}
+	if _, ok := registry.rules[keptID]; !ok {
+		t.Error("kept rule is deleted")
+	}
+	trashed, err := trashedItemIDs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !trashed[removedID] {
+		t.Error("removed rule is not moved into trash")
+	}
+	if !trashed[trashedID] {
+		t.Error("trashed rule is no longer in trash")
+	}
+
+	if _, ok := registry.rules[trashedID]; ok {
+		t.Errorf("new rule took id %d of the trashed rule", trashedID)
+	}
+	if len(report.Created) != 1 {
+		t.Fatalf("created: %q", report.Created)
+	}
+	var reusedID uint64
+	for id, r := range registry.rules {
+		if r.DisplayName == "reused" {
+			reusedID = id
+		}
+	}
+	if reusedID <= cursor {
+		t.Errorf("new rule got id %d, want a new id after %d", reusedID, cursor)
+	}
+	if registry.cursor < reusedID {
+		t.Errorf("cursor %d is behind id %d", registry.cursor, reusedID)
+	}
+}
@@ -0,0 +1,275 @@
+package gypsum
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	zero "github.com/wdvxdr1123/ZeroBot"
+
+	"github.com/yuudi/gypsum/gypsum/normalize"
+)
+
+// defaultFuzzyThreshold is used when the threshold of a fuzzy rule is 0
+const defaultFuzzyThreshold = 0.8
+
+// messageRule builds the zero rule that matches the message with the patterns.
+// If normalization is enabled, the rule sees a normalized copy of the event, and the patterns are normalized in the same way except regex.
+func messageRule(matcherType RuleType, patterns []string, threshold float64, n normalize.Options) (zero.Rule, error) {
+	if !n.Enabled() {
+		return plainMessageRule(matcherType, patterns, threshold)
+	}
+	if matcherType != Regex {
+		normalized := make([]string, len(patterns))
+		for i, pattern := range patterns {
+			normalized[i] = n.Text(pattern)
+		}
+		patterns = normalized
+	}
+	rule, err := plainMessageRule(matcherType, patterns, threshold)
+	if err != nil {
+		return nil, err
+	}
+	return func(event *zero.Event, state zero.State) bool {
+		normalized := *event
+		normalized.Message = n.Message(event.Message)
+		normalized.RawMessage = normalized.Message.CQString()
+		if !rule(&normalized, state) {
+			return false
+		}
+		state["normalized"] = normalized.RawMessage
+		return true
+	}, nil
+}
+
+func plainMessageRule(matcherType RuleType, patterns []string, threshold float64) (zero.Rule, error) {
+	switch matcherType {
+	case FullMatch:
+		return zero.FullMatchRule(patterns...), nil
+	case Keyword:
+		return zero.KeywordRule(patterns...), nil
+	case Prefix:
+		return zero.PrefixRule(patterns...), nil
+	case Suffix:
+		return zero.SuffixRule(patterns...), nil
+	case Command:
+		return zero.CommandRule(patterns...), nil
+	case Regex:
+		return regexRule(patterns)
+	case Fuzzy:
+		return fuzzyRule(patterns, threshold), nil
+	case Wildcard:
+		return wildcardRule(patterns), nil
+	case AnyMessage:
+		return anyMessageRule, nil
+	default:
+		return nil, errors.New(fmt.Sprintf("Unknown type %#v", matcherType))
+	}
+}
+
+// checkPatterns checks the patterns of a rule before it is saved, code is the error code of the api
+func checkPatterns(matcherType RuleType, patterns []string, threshold float64) (code int, err error) {
+	if matcherType < FullMatch || matcherType > AnyMessage {
+		return 2004, errors.New(fmt.Sprintf("Unknown type %#v", matcherType))
+	}
+	switch matcherType {
+	case Regex:
+		if len(patterns) == 0 {
+			return 2001, errors.New("regex matcher needs at least one pattern")
+		}
+		for _, pattern := range patterns {
+			if err := checkRegex(pattern); err != nil {
+				return 2002, errors.New(fmt.Sprintf("cannot compile regex pattern %q: %s", pattern, err))
+			}
+		}
+	case Fuzzy:
+		if len(patterns) == 0 {
+			return 2001, errors.New("fuzzy matcher needs at least one pattern")
+		}
+		if threshold < 0 || threshold > 1 {
+			return 2003, errors.New(fmt.Sprintf("threshold must be between 0 and 1, got %v", threshold))
+		}
+	case Wildcard:
+		if len(patterns) == 0 {
+			return 2001, errors.New("wildcard matcher needs at least one pattern")
+		}
+	}
+	return 0, nil
+}
+
+// reservedStateKeys are set by matchers of gypsum and ZeroBot, named groups of regex patterns do not replace them
+var reservedStateKeys = map[string]bool{
+	"matched":          true,
+	"normalized":       true,
+	"keyword":          true,
+	"prefix":           true,
+	"suffix":           true,
+	"command":          true,
+	"args":             true,
+	"manager":          true,
+	"regex_matched":    true,
+	"regex_groups":     true,
+	"fuzzy_matched":    true,
+	"score":            true,
+	"wildcard_matched": true,
+}
+
+// regexRule matches any of the patterns, the first pattern that matches sets regex_matched (the submatches) and regex_groups (the named groups).
+// Each named group that matched something is also set in state by its name, unless the name is one of reservedStateKeys.
+func regexRule(patterns []string) (zero.Rule, error) {
+	regexes := make([]*regexp.Regexp, len(patterns))
+	for i, pattern := range patterns {
+		regex, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, err
+		}
+		regexes[i] = regex
+	}
+	return func(event *zero.Event, state zero.State) bool {
+		msg := event.RawMessage
+		for _, regex := range regexes {
+			matched := regex.FindStringSubmatch(msg)
+			if matched == nil {
+				continue
+			}
+			groups := make(map[string]string)
+			for j, name := range regex.SubexpNames() {
+				if name == "" {
+					continue
+				}
+				groups[name] = matched[j]
+				if matched[j] != "" && !reservedStateKeys[name] {
+					state[name] = matched[j]
+				}
+			}
+			state["regex_matched"] = matched
+			state["regex_groups"] = groups
+			return true
+		}
+		return false
+	}, nil
+}
+
+// fuzzyRule matches the text of the message with the most similar pattern, if the similarity is at least threshold.
+// It sets fuzzy_matched (the pattern) and score (the similarity).
+func fuzzyRule(patterns []string, threshold float64) zero.Rule {
+	if threshold == 0 {
+		threshold = defaultFuzzyThreshold
+	}
+	runePatterns := make([][]rune, len(patterns))
+	for i, pattern := range patterns {
+		runePatterns[i] = []rune(strings.TrimSpace(pattern))
+	}
+	return func(event *zero.Event, state zero.State) bool {
+		msg := []rune(strings.TrimSpace(event.Message.ExtractPlainText()))
+		best, bestScore := -1, threshold
+		for i, pattern := range runePatterns {
+			if score := similarity(msg, pattern, bestScore); score >= bestScore {
+				best, bestScore = i, score
+			}
+		}
+		if best < 0 {
+			return false
+		}
+		state["fuzzy_matched"] = patterns[best]
+		state["score"] = bestScore
+		return true
+	}
+}
+
+// similarity is 1 minus the edit distance divided by the length of the longer text.
+// It returns 0 early if the similarity cannot reach atLeast.
+func similarity(a, b []rune, atLeast float64) float64 {
+	longer := len(a)
+	if len(b) > longer {
+		longer = len(b)
+	}
+	if longer == 0 {
+		return 1
+	}
+	lengthDiff := len(a) - len(b)
+	if lengthDiff < 0 {
+		lengthDiff = -lengthDiff
+	}
+	// the distance is at least the difference of lengths
+	if 1-float64(lengthDiff)/float64(longer) < atLeast {
+		return 0
+	}
+	return 1 - float64(editDistance(a, b))/float64(longer)
+}
+
+// editDistance is the levenshtein distance of runes
+func editDistance(a, b []rune) int {
+	previous := make([]int, len(b)+1)
+	current := make([]int, len(b)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		current[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			current[j] = minInt(previous[j]+1, current[j-1]+1, previous[j-1]+cost)
+		}
+		previous, current = current, previous
+	}
+	return previous[len(b)]
+}
+
+func minInt(first int, others ...int) int {
+	for _, n := range others {
+		if n < first {
+			first = n
+		}
+	}
+	return first
+}
+
+// wildcardToRegex converts a pattern where `*` is any text and `?` is any character to a regex matching the whole message
+func wildcardToRegex(pattern string) *regexp.Regexp {
+	var b strings.Builder
+	b.WriteString(`(?s)^`)
+	for _, c := range pattern {
+		switch c {
+		case '*':
+			b.WriteString(`(.*?)`)
+		case '?':
+			b.WriteString(`(.)`)
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	b.WriteString(`$`)
+	return regexp.MustCompile(b.String())
+}
+
+// wildcardRule matches the whole message with any of the patterns.
+// It sets wildcard_matched, the message followed by the text matched by each `*` and `?`, and score (always 1).
+func wildcardRule(patterns []string) zero.Rule {
+	regexes := make([]*regexp.Regexp, len(patterns))
+	for i, pattern := range patterns {
+		regexes[i] = wildcardToRegex(pattern)
+	}
+	return func(event *zero.Event, state zero.State) bool {
+		msg := event.Message.CQString()
+		for _, regex := range regexes {
+			if matched := regex.FindStringSubmatch(msg); matched != nil {
+				state["wildcard_matched"] = matched
+				state["score"] = 1.0
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// anyMessageRule matches every message, it sets matched (the message) and score (always 1)
+func anyMessageRule(event *zero.Event, state zero.State) bool {
+	state["matched"] = event.Message.CQString()
+	state["score"] = 1.0
+	return true
+}
@@ -0,0 +1,251 @@
+package gypsum
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/yuudi/gypsum/gypsum/storage"
+)
+
+// Records are saved as an envelope: recordMagic, a big-endian uint16 schema version, then the gob payload.
+// A gob stream never begins with a zero byte, so records written before versioning are recognized as version 0.
+var recordMagic = []byte{0x00, 'g', 'y', 'p'}
+
+const recordHeaderLength = 6
+
+// schemaVersions is the current schema version of every kind of record
+var schemaVersions = map[ItemType]uint16{
+	RuleItem:      2,
+	TriggerItem:   2,
+	SchedulerItem: 1,
+	ResourceItem:  1,
+	GroupItem:     2,
+}
+
+// recordPrefixes is the database key prefix of every kind of record, in the order of migrating
+var recordPrefixes = []struct {
+	itemType ItemType
+	prefix   string
+}{
+	{GroupItem, "gypsum-groups-"},
+	{RuleItem, "gypsum-rules-"},
+	{TriggerItem, "gypsum-triggers-"},
+	{SchedulerItem, "gypsum-jobs-"},
+	{ResourceItem, "gypsum-resources-"},
+}
+
+// migration upgrades the payload of one kind of record from fromVersion to fromVersion+1.
+// When a field changes its meaning, decode the payload into a copy of the old struct and convert it here.
+type migration struct {
+	itemType    ItemType
+	fromVersion uint16
+	description string
+	migrate     func(payload []byte) ([]byte, error)
+}
+
+var migrations = []migration{
+	{RuleItem, 0, "wrap legacy record in versioned envelope", keepPayload},
+	{TriggerItem, 0, "wrap legacy record in versioned envelope", keepPayload},
+	{SchedulerItem, 0, "wrap legacy record in versioned envelope", keepPayload},
+	{ResourceItem, 0, "wrap legacy record in versioned envelope", keepPayload},
+	{GroupItem, 0, "wrap legacy record in versioned envelope", keepPayload},
+	{GroupItem, 1, "add active state, existing groups are active", activateGroups},
+	{RuleItem, 1, "probability 0 meant always, set it to 1", respondAlwaysRule},
+	{TriggerItem, 1, "probability 0 meant always, set it to 1", respondAlwaysTrigger},
+}
+
+func keepPayload(payload []byte) ([]byte, error) {
+	return payload, nil
+}
+
+func findMigration(itemType ItemType, fromVersion uint16) (migration, bool) {
+	for _, m := range migrations {
+		if m.itemType == itemType && m.fromVersion == fromVersion {
+			return m, true
+		}
+	}
+	return migration{}, false
+}
+
+func sealRecord(itemType ItemType, payload []byte) []byte {
+	b := make([]byte, recordHeaderLength, recordHeaderLength+len(payload))
+	copy(b, recordMagic)
+	binary.BigEndian.PutUint16(b[len(recordMagic):], schemaVersions[itemType])
+	return append(b, payload...)
+}
+
+// splitRecord returns the schema version and the payload of a saved record
+func splitRecord(b []byte) (uint16, []byte) {
+	if len(b) < recordHeaderLength || !bytes.HasPrefix(b, recordMagic) {
+		return 0, b
+	}
+	return binary.BigEndian.Uint16(b[len(recordMagic):]), b[recordHeaderLength:]
+}
+
+// upgradePayload runs all migrations from version to the current schema version
+func upgradePayload(itemType ItemType, version uint16, payload []byte) ([]byte, error) {
+	current := schemaVersions[itemType]
+	if version > current {
+		return nil, errors.New(fmt.Sprintf("%s record version %d is newer than supported version %d", itemType, version, current))
+	}
+	for ; version < current; version++ {
+		m, ok := findMigration(itemType, version)
+		if !ok {
+			return nil, errors.New(fmt.Sprintf("no migration for %s record from version %d", itemType, version))
+		}
+		var err error
+		payload, err = m.migrate(payload)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("migrating %s record from version %d: %s", itemType, version, err))
+		}
+	}
+	return payload, nil
+}
+
+// openRecord returns the payload of a saved record, upgraded to the current schema version
+func openRecord(itemType ItemType, b []byte) ([]byte, error) {
+	version, payload := splitRecord(b)
+	return upgradePayload(itemType, version, payload)
+}
+
+type MigrationStep struct {
+	ItemType    ItemType `json:"item_type"`
+	FromVersion uint16   `json:"from_version"`
+	Description string   `json:"description"`
+	Records     int      `json:"records"`
+}
+
+// PluginUserDataCopy is how many global keys are copied into the namespace of a plugin
+type PluginUserDataCopy struct {
+	Plugin string `json:"plugin"`
+	Keys   int    `json:"keys"`
+}
+
+type MigrationReport struct {
+	DryRun         bool                 `json:"dry_run"`
+	Scanned        int                  `json:"scanned"`
+	Upgraded       int                  `json:"upgraded"`
+	Steps          []MigrationStep      `json:"steps"`
+	MovedUserData  int                  `json:"moved_userdata"`
+	CopiedUserData []PluginUserDataCopy `json:"copied_userdata"`
+	Failures       []string             `json:"failures"`
+}
+
+func (r *MigrationReport) addStep(itemType ItemType, version uint16) {
+	for i := range r.Steps {
+		if r.Steps[i].ItemType == itemType && r.Steps[i].FromVersion == version {
+			r.Steps[i].Records++
+			return
+		}
+	}
+	m, _ := findMigration(itemType, version)
+	r.Steps = append(r.Steps, MigrationStep{
+		ItemType:    itemType,
+		FromVersion: version,
+		Description: m.description,
+		Records:     1,
+	})
+}
+
+func (r *MigrationReport) Lines() []string {
+	lines := make([]string, 0, len(r.Steps)+len(r.Failures)+1)
+	for _, step := range r.Steps {
+		lines = append(lines, fmt.Sprintf("%s v%d -> v%d: %s (%d records)", step.ItemType, step.FromVersion, step.FromVersion+1, step.Description, step.Records))
+	}
+	if r.MovedUserData != 0 {
+		lines = append(lines, fmt.Sprintf("lua userdata -> shared userdata: convert to JSON (%d keys)", r.MovedUserData))
+	}
+	for _, c := range r.CopiedUserData {
+		lines = append(lines, fmt.Sprintf("global userdata -> plugin %s: copy (%d keys)", c.Plugin, c.Keys))
+	}
+	for _, failure := range r.Failures {
+		lines = append(lines, "failed: "+failure)
+	}
+	verb := "upgraded"
+	if r.DryRun {
+		verb = "to upgrade"
+	}
+	lines = append(lines, fmt.Sprintf("%d records scanned, %d %s", r.Scanned, r.Upgraded, verb))
+	return lines
+}
+
+// migrateRecords upgrades every outdated record to the current schema version.
+// With dryRun, nothing is written and the report shows what would be done.
+func migrateRecords(dryRun bool) (*MigrationReport, error) {
+	report := &MigrationReport{
+		DryRun:         dryRun,
+		Steps:          []MigrationStep{},
+		CopiedUserData: []PluginUserDataCopy{},
+		Failures:       []string{},
+	}
+	batch := new(storage.Batch)
+	for _, kind := range recordPrefixes {
+		current := schemaVersions[kind.itemType]
+		iter := db.NewIterator([]byte(kind.prefix))
+		for iter.Next() {
+			report.Scanned++
+			version, payload := splitRecord(iter.Value())
+			if version == current {
+				continue
+			}
+			if version > current {
+				report.Failures = append(report.Failures, fmt.Sprintf("%s %x: version %d is newer than supported version %d", kind.itemType, iter.Key()[len(kind.prefix):], version, current))
+				continue
+			}
+			for v := version; v < current; v++ {
+				report.addStep(kind.itemType, v)
+			}
+			upgraded, err := upgradePayload(kind.itemType, version, payload)
+			if err != nil {
+				report.Failures = append(report.Failures, fmt.Sprintf("%s %x: %s", kind.itemType, iter.Key()[len(kind.prefix):], err))
+				continue
+			}
+			report.Upgraded++
+			if !dryRun {
+				key := append([]byte{}, iter.Key()...)
+				batch.Put(key, sealRecord(kind.itemType, upgraded))
+			}
+		}
+		iter.Release()
+		if err := iter.Error(); err != nil {
+			return report, err
+		}
+	}
+	moved := make(map[string][]byte)
+	if err := migrateLegacyLuaUserData(report, batch, dryRun, moved); err != nil {
+		return report, err
+	}
+	if err := migratePluginUserData(report, batch, dryRun, moved); err != nil {
+		return report, err
+	}
+	if dryRun || batch.Len() == 0 {
+		return report, nil
+	}
+	return report, db.Write(batch)
+}
+
+// MigrateDatabase upgrades records in gypsum_data while gypsum is not running
+func MigrateDatabase(dryRun bool, logger func(...interface{})) error {
+	if err := openDb(); err != nil {
+		return err
+	}
+	defer db.Close()
+	report, err := migrateRecords(dryRun)
+	for _, line := range report.Lines() {
+		logger(line)
+	}
+	return err
+}
+
+func logMigrationReport(report *MigrationReport) {
+	if report.Upgraded == 0 && len(report.CopiedUserData) == 0 && len(report.Failures) == 0 {
+		return
+	}
+	for _, line := range report.Lines() {
+		log.Info("数据升级：" + line)
+	}
+}
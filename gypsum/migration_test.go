@@ -0,0 +1,222 @@
+package gypsum
+
+import (
+	"bytes"
+	"encoding/gob"
+	"strings"
+	"testing"
+
+	"github.com/yuudi/gypsum/gypsum/storage"
+	"github.com/yuudi/gypsum/gypsum/userdata"
+)
+
+// putLegacyRecord saves a record the way gypsum did before records were versioned: a bare gob payload
+func putLegacyRecord(t *testing.T, s storage.Storage, key []byte, v interface{}) {
+	t.Helper()
+	buffer := bytes.Buffer{}
+	if err := gob.NewEncoder(&buffer).Encode(v); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Put(key, buffer.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func recordVersion(t *testing.T, s storage.Storage, key []byte) uint16 {
+	t.Helper()
+	b, err := s.Get(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	version, _ := splitRecord(b)
+	return version
+}
+
+func equalLines(got, want []string) bool {
+	if len(got) != len(want) {
+		return false
+	}
+	for i := range got {
+		if got[i] != want[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestMigrateLegacyRecords(t *testing.T) {
+	mem := useTestMemory(t)
+	rule := Rule{
+		DisplayName: "legacy rule",
+		Active:      true,
+		GroupsID:    []int64{},
+		UsersID:     []int64{},
+		Patterns:    []string{"hello"},
+		Response:    "world",
+		ParentGroup: 1,
+	}
+	group := Group{
+		DisplayName: "legacy group",
+		Items:       []Item{{ItemType: RuleItem, DisplayName: "legacy rule", ItemID: 2}},
+	}
+	putLegacyRecord(t, mem, groupKey(1), &group)
+	putLegacyRecord(t, mem, ruleKey(2), &rule)
+
+	var lines []string
+	logger := func(args ...interface{}) {
+		lines = append(lines, args[0].(string))
+	}
+
+	if err := MigrateDatabase(true, logger); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"group v0 -> v1: wrap legacy record in versioned envelope (1 records)",
+		"group v1 -> v2: add active state, existing groups are active (1 records)",
+		"rule v0 -> v1: wrap legacy record in versioned envelope (1 records)",
+		"rule v1 -> v2: probability 0 meant always, set it to 1 (1 records)",
+		"2 records scanned, 2 to upgrade",
+	}
+	if !equalLines(lines, want) {
+		t.Errorf("dry run report:\ngot  %q\nwant %q", lines, want)
+	}
+	if v := recordVersion(t, mem, groupKey(1)); v != 0 {
+		t.Errorf("dry run wrote group record with version %d", v)
+	}
+	if v := recordVersion(t, mem, ruleKey(2)); v != 0 {
+		t.Errorf("dry run wrote rule record with version %d", v)
+	}
+
+	lines = nil
+	if err := MigrateDatabase(false, logger); err != nil {
+		t.Fatal(err)
+	}
+	want[len(want)-1] = "2 records scanned, 2 upgraded"
+	if !equalLines(lines, want) {
+		t.Errorf("migration report:\ngot  %q\nwant %q", lines, want)
+	}
+	if v := recordVersion(t, mem, groupKey(1)); v != schemaVersions[GroupItem] {
+		t.Errorf("group record version: got %d, want %d", v, schemaVersions[GroupItem])
+	}
+	if v := recordVersion(t, mem, ruleKey(2)); v != schemaVersions[RuleItem] {
+		t.Errorf("rule record version: got %d, want %d", v, schemaVersions[RuleItem])
+	}
+
+	b, _ := mem.Get(groupKey(1))
+	g, err := GroupFromBytes(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g.DisplayName != group.DisplayName || !g.Active || len(g.Items) != 1 || g.Items[0] != group.Items[0] {
+		t.Errorf("migrated group: got %+v", g)
+	}
+	b, _ = mem.Get(ruleKey(2))
+	r, err := RuleFromBytes(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.DisplayName != rule.DisplayName || !r.Active || r.Response != rule.Response || len(r.Patterns) != 1 || r.Patterns[0] != "hello" || r.Probability != 1 {
+		t.Errorf("migrated rule: got %+v", r)
+	}
+
+	// everything is up to date now
+	lines = nil
+	if err := MigrateDatabase(true, logger); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"2 records scanned, 0 to upgrade"}; !equalLines(lines, want) {
+		t.Errorf("report after migration:\ngot  %q\nwant %q", lines, want)
+	}
+}
+
+func TestMigrateRejectsNewerRecords(t *testing.T) {
+	mem := useTestMemory(t)
+	newer := sealRecord(RuleItem, []byte("payload"))
+	newer[len(recordMagic)+1] = byte(schemaVersions[RuleItem] + 1)
+	if err := mem.Put(ruleKey(3), newer); err != nil {
+		t.Fatal(err)
+	}
+	var lines []string
+	if err := MigrateDatabase(false, func(args ...interface{}) {
+		lines = append(lines, args[0].(string))
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if len(lines) != 2 || lines[1] != "1 records scanned, 0 upgraded" {
+		t.Errorf("report: %q", lines)
+	}
+	if b, _ := mem.Get(ruleKey(3)); !bytes.Equal(b, newer) {
+		t.Error("a record newer than supported is changed")
+	}
+}
+
+func TestMigratePluginUserData(t *testing.T) {
+	mem := useTestMemory(t)
+	putLegacyRecord(t, mem, groupKey(1), &Group{DisplayName: "plugin", PluginName: "greeter", Items: []Item{}})
+	global := userdata.DataStore.Key(userdata.Global, []byte("count"))
+	shared := userdata.DataStore.Key(userdata.Global, []byte("shared"))
+	kept := userdata.DataStore.Key("greeter", []byte("shared"))
+	for key, value := range map[string]string{string(global): "1", string(shared): "global", string(kept): "plugin"} {
+		if err := mem.Put([]byte(key), []byte(value)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var lines []string
+	logger := func(args ...interface{}) {
+		lines = append(lines, args[0].(string))
+	}
+
+	if err := MigrateDatabase(true, logger); err != nil {
+		t.Fatal(err)
+	}
+	if !containsLine(lines, "global userdata -> plugin greeter: copy (1 keys)") {
+		t.Errorf("dry run report: %q", lines)
+	}
+	if has, _ := mem.Has(userdata.DataStore.Key("greeter", []byte("count"))); has {
+		t.Error("dry run copied userdata")
+	}
+
+	lines = nil
+	if err := MigrateDatabase(false, logger); err != nil {
+		t.Fatal(err)
+	}
+	if !containsLine(lines, "global userdata -> plugin greeter: copy (1 keys)") {
+		t.Errorf("migration report: %q", lines)
+	}
+	for key, want := range map[string]string{
+		string(userdata.DataStore.Key("greeter", []byte("count"))): "1",
+		string(kept):   "plugin",
+		string(global): "1",
+		string(shared): "global",
+	} {
+		got, err := mem.Get([]byte(key))
+		if err != nil {
+			t.Errorf("%q: %s", key, err)
+			continue
+		}
+		if string(got) != want {
+			t.Errorf("%q: got %q, want %q", key, got, want)
+		}
+	}
+
+	// copying happens once, plugins added later start with empty data
+	putLegacyRecord(t, mem, groupKey(2), &Group{DisplayName: "later", PluginName: "later", Items: []Item{}})
+	lines = nil
+	if err := MigrateDatabase(false, logger); err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range lines {
+		if strings.HasPrefix(line, "global userdata -> plugin") {
+			t.Errorf("userdata is copied again: %q", line)
+		}
+	}
+}
+
+func containsLine(lines []string, line string) bool {
+	for _, l := range lines {
+		if l == line {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,132 @@
+// Package normalize converts messages to a canonical form before they are matched
+package normalize
+
+import (
+	_ "embed"
+	"strings"
+	"unicode"
+
+	zeroMessage "github.com/wdvxdr1123/ZeroBot/message"
+)
+
+// Options are the conversions applied to a message, in the order of the fields
+type Options struct {
+	// StripCQCode removes everything in the message but text, such as images and at
+	StripCQCode bool `json:"strip_cq_code" yaml:"strip_cq_code"`
+	// HalfWidth converts full-width letters, digits, symbols and spaces to half-width
+	HalfWidth bool `json:"half_width" yaml:"half_width"`
+	// Simplified converts traditional chinese characters to simplified
+	Simplified bool `json:"simplified" yaml:"simplified"`
+	// FoldCase converts letters to lower case
+	FoldCase bool `json:"fold_case" yaml:"fold_case"`
+	// CollapseSpace replaces each run of spaces with one space, and removes spaces at the start and the end
+	CollapseSpace bool `json:"collapse_space" yaml:"collapse_space"`
+}
+
+func (o Options) Enabled() bool {
+	return o.StripCQCode || o.HalfWidth || o.Simplified || o.FoldCase || o.CollapseSpace
+}
+
+// Text converts a text, StripCQCode does not apply since a text has no CQ code
+func (o Options) Text(s string) string {
+	if o.HalfWidth {
+		s = ToHalfWidth(s)
+	}
+	if o.Simplified {
+		s = ToSimplified(s)
+	}
+	if o.FoldCase {
+		s = strings.ToLower(s)
+	}
+	if o.CollapseSpace {
+		s = strings.Join(strings.Fields(s), " ")
+	}
+	return s
+}
+
+// Message returns a converted copy of the message, the message itself is not changed
+func (o Options) Message(m zeroMessage.Message) zeroMessage.Message {
+	var result zeroMessage.Message
+	for _, segment := range m {
+		if segment.Type != "text" {
+			if !o.StripCQCode {
+				result = append(result, segment)
+			}
+			continue
+		}
+		// adjacent texts are joined, so that spaces between them are collapsed
+		if last := len(result) - 1; last >= 0 && result[last].Type == "text" {
+			result[last].Data["text"] += segment.Data["text"]
+			continue
+		}
+		result = append(result, zeroMessage.Text(segment.Data["text"]))
+	}
+	for i, segment := range result {
+		if segment.Type != "text" {
+			continue
+		}
+		text := segment.Data["text"]
+		if o.CollapseSpace {
+			// spaces next to other segments are kept as one space
+			leading := text != strings.TrimLeftFunc(text, unicode.IsSpace) && i > 0
+			trailing := text != strings.TrimRightFunc(text, unicode.IsSpace) && i < len(result)-1
+			text = o.Text(text)
+			if leading && text != "" {
+				text = " " + text
+			}
+			if trailing && text != "" {
+				text += " "
+			}
+		} else {
+			text = o.Text(text)
+		}
+		result[i] = zeroMessage.Text(text)
+	}
+	return result
+}
+
+// ToHalfWidth converts full-width forms (U+FF01 to U+FF5E) and the ideographic space
+func ToHalfWidth(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r == '　':
+			return ' '
+		case r >= '！' && r <= '～':
+			return r - 0xfee0
+		default:
+			return r
+		}
+	}, s)
+}
+
+// tsCharacters is the table of traditional to simplified characters from OpenCC (https://github.com/BYVoid/OpenCC),
+// licensed under the Apache License 2.0, see OPENCC_LICENSE in this directory. Each line is a traditional character, a tab, and simplified characters separated by spaces.
+//
+//go:embed TSCharacters.txt
+var tsCharacters string
+
+var simplifiedTable = func() map[rune]rune {
+	table := make(map[rune]rune, 4200)
+	for _, line := range strings.Split(tsCharacters, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		traditional, simplified := []rune(fields[0]), []rune(fields[1])
+		if len(traditional) != 1 || len(simplified) != 1 {
+			continue
+		}
+		table[traditional[0]] = simplified[0]
+	}
+	return table
+}()
+
+// ToSimplified converts each traditional chinese character to the most common simplified character
+func ToSimplified(s string) string {
+	return strings.Map(func(r rune) rune {
+		if simplified, ok := simplifiedTable[r]; ok {
+			return simplified
+		}
+		return r
+	}, s)
+}
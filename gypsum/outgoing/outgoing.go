@@ -0,0 +1,106 @@
+// Package outgoing limits the rate of messages sent by the bot, all sending in gypsum goes through it
+package outgoing
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/tidwall/gjson"
+	zero "github.com/wdvxdr1123/ZeroBot"
+)
+
+// limiter is a token bucket, tokens may go below 0 when messages are waiting for them
+type limiter struct {
+	sync.Mutex
+	rate    float64 // tokens per second, 0 means no limit
+	burst   float64
+	maxWait time.Duration
+	tokens  float64
+	last    time.Time
+}
+
+var global = &limiter{}
+
+// SetLimit allows perMinute messages in a minute and burst messages at once,
+// a message that has to wait longer than maxWait is dropped. perMinute 0 means no limit.
+func SetLimit(perMinute int, burst int, maxWait time.Duration) {
+	global.Lock()
+	defer global.Unlock()
+	global.rate = float64(perMinute) / 60
+	global.burst = float64(burst)
+	if global.burst < 1 {
+		global.burst = 1
+	}
+	global.maxWait = maxWait
+	global.tokens = global.burst
+	global.last = time.Now()
+}
+
+// reserve takes a token and returns how long to wait for it, ok is false if the wait is too long
+func (l *limiter) reserve() (wait time.Duration, ok bool) {
+	l.Lock()
+	defer l.Unlock()
+	if l.rate <= 0 {
+		return 0, true
+	}
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.last = now
+	if l.tokens >= 1 {
+		l.tokens--
+		return 0, true
+	}
+	wait = time.Duration((1 - l.tokens) / l.rate * float64(time.Second))
+	if wait > l.maxWait {
+		return 0, false
+	}
+	l.tokens--
+	return wait, true
+}
+
+// Wait blocks until a message can be sent, it returns false if the message should be dropped
+func Wait() bool {
+	wait, ok := global.reserve()
+	if !ok {
+		log.Warn("发送消息过于频繁，消息被丢弃")
+		return false
+	}
+	if wait > 0 {
+		time.Sleep(wait)
+	}
+	return true
+}
+
+func Send(event zero.Event, msg interface{}) int64 {
+	if !Wait() {
+		return 0
+	}
+	return zero.Send(event, msg)
+}
+
+func SendPrivateMessage(userID int64, msg interface{}) int64 {
+	if !Wait() {
+		return 0
+	}
+	return zero.SendPrivateMessage(userID, msg)
+}
+
+func SendGroupMessage(groupID int64, msg interface{}) int64 {
+	if !Wait() {
+		return 0
+	}
+	return zero.SendGroupMessage(groupID, msg)
+}
+
+// CallAction calls a bot api, sending apis (send_msg, send_group_msg and so on) are limited
+func CallAction(action string, params zero.Params) gjson.Result {
+	if strings.HasPrefix(action, "send_") && !Wait() {
+		return gjson.Result{}
+	}
+	return zero.CallAction(action, params)
+}
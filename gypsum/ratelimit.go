@@ -0,0 +1,47 @@
+package gypsum
+
+import (
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/yuudi/gypsum/gypsum/outgoing"
+)
+
+// RateLimitConfig limits all messages sent by the bot, Burst and MaxWait left 0 use the default
+type RateLimitConfig struct {
+	// MessagesPerMinute is the average rate, 0 or a negative number means no limit.
+	// A config file written before the limit was added has no such section, so nothing is limited after upgrading.
+	MessagesPerMinute int
+	// Burst is how many messages can be sent at once
+	Burst int
+	// MaxWait is the seconds a message can wait to be sent, messages that have to wait longer are dropped
+	MaxWait int
+}
+
+var defaultRateLimit = RateLimitConfig{
+	Burst:   10,
+	MaxWait: 10,
+}
+
+func initRateLimit() {
+	var c RateLimitConfig
+	if Config != nil {
+		c = Config.RateLimit
+	}
+	if c.MessagesPerMinute < 0 {
+		c.MessagesPerMinute = 0
+	}
+	if c.Burst <= 0 {
+		c.Burst = defaultRateLimit.Burst
+	}
+	if c.MaxWait <= 0 {
+		c.MaxWait = defaultRateLimit.MaxWait
+	}
+	outgoing.SetLimit(c.MessagesPerMinute, c.Burst, time.Duration(c.MaxWait)*time.Second)
+	if c.MessagesPerMinute == 0 {
+		log.Debug("发送限制：不限制")
+		return
+	}
+	log.Debugf("发送限制：每分钟 %d 条，突发 %d 条，最长等待 %d 秒", c.MessagesPerMinute, c.Burst, c.MaxWait)
+}
@@ -0,0 +1,39 @@
+package gypsum
+
+import (
+	"sync"
+
+	"github.com/robfig/cron/v3"
+	zero "github.com/wdvxdr1123/ZeroBot"
+)
+
+// itemRegistry holds every item loaded from database, and the matchers and cron entries registered for them.
+// It is shared by web handlers, cron jobs and bot events, so any access must hold the lock.
+type itemRegistry struct {
+	sync.RWMutex
+	cursor      uint64 // the last allocated item id
+	rules       map[uint64]*Rule
+	triggers    map[uint64]*Trigger
+	jobs        map[uint64]*ScheduledJob
+	resources   map[uint64]*Resource
+	groups      map[uint64]*Group
+	zeroMatcher map[uint64]*zero.Matcher
+	zeroTrigger map[uint64]*zero.Matcher
+	entries     map[uint64]cron.EntryID
+	groupStates map[uint64]groupState // nil until the group watcher starts
+}
+
+var registry = newItemRegistry()
+
+func newItemRegistry() *itemRegistry {
+	return &itemRegistry{
+		rules:       make(map[uint64]*Rule),
+		triggers:    make(map[uint64]*Trigger),
+		jobs:        make(map[uint64]*ScheduledJob),
+		resources:   make(map[uint64]*Resource),
+		groups:      make(map[uint64]*Group),
+		zeroMatcher: make(map[uint64]*zero.Matcher),
+		zeroTrigger: make(map[uint64]*zero.Matcher),
+		entries:     make(map[uint64]cron.EntryID),
+	}
+}
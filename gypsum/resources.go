@@ -15,20 +15,18 @@ import (
 
 	"github.com/gin-gonic/gin"
 	log "github.com/sirupsen/logrus"
-	"github.com/syndtr/goleveldb/leveldb"
-	"github.com/syndtr/goleveldb/leveldb/util"
 
 	"github.com/yuudi/gypsum/gypsum/helper"
+	"github.com/yuudi/gypsum/gypsum/storage"
 )
 
 type Resource struct {
-	FileName    string `json:"file_name"`
-	Ext         string `json:"ext"`
-	Sha256Sum   string `json:"sha256_sum"`
-	ParentGroup uint64 `json:"-"`
+	FileName    string `json:"file_name" yaml:"file_name"`
+	Ext         string `json:"ext" yaml:"ext"`
+	Sha256Sum   string `json:"sha256_sum" yaml:"sha256_sum"`
+	ParentGroup uint64 `json:"-" yaml:"-"`
 }
 
-var resources map[uint64]*Resource
 var resDir string // absolute path of resource directory
 
 func (r *Resource) ToBytes() ([]byte, error) {
@@ -37,15 +35,19 @@ func (r *Resource) ToBytes() ([]byte, error) {
 	if err := encoder.Encode(r); err != nil {
 		return nil, err
 	}
-	return buffer.Bytes(), nil
+	return sealRecord(ResourceItem, buffer.Bytes()), nil
 }
 
 func ResourceFromBytes(b []byte) (*Resource, error) {
 	r := &Resource{}
+	payload, err := openRecord(ResourceItem, b)
+	if err != nil {
+		return r, err
+	}
 	buffer := bytes.Buffer{}
-	buffer.Write(b)
+	buffer.Write(payload)
 	decoder := gob.NewDecoder(&buffer)
-	err := decoder.Decode(r)
+	err = decoder.Decode(r)
 	return r, err
 }
 
@@ -68,8 +70,7 @@ func loadResources() {
 			panic("resource directory exists and is not directory")
 		}
 	}
-	resources = make(map[uint64]*Resource)
-	iter := db.NewIterator(util.BytesPrefix([]byte("gypsum-resources-")), nil)
+	iter := db.NewIterator([]byte("gypsum-resources-"))
 	defer func() {
 		iter.Release()
 		if err = iter.Error(); err != nil {
@@ -84,16 +85,34 @@ func loadResources() {
 			log.Errorf("无法加载资源%d：%s", key, e)
 			continue
 		}
-		resources[key] = r
+		registry.resources[key] = r
 	}
 }
 
+func resourceKey(idx uint64) []byte {
+	return append([]byte("gypsum-resources-"), helper.U64ToBytes(idx)...)
+}
+
+func resourceHashKey(sum string) []byte {
+	b, _ := hex.DecodeString(sum)
+	return append([]byte("gypsum-resources_hash-"), b...)
+}
+
 func (r *Resource) SaveToDB(idx uint64) error {
 	v, err := r.ToBytes()
 	if err != nil {
 		return err
 	}
-	return db.Put(append([]byte("gypsum-resources-"), helper.U64ToBytes(idx)...), v, nil)
+	return db.Put(resourceKey(idx), v)
+}
+
+func (r *Resource) SaveToBatch(batch *storage.Batch, idx uint64) error {
+	v, err := r.ToBytes()
+	if err != nil {
+		return err
+	}
+	batch.Put(resourceKey(idx), v)
+	return nil
 }
 
 func resourcePathFunc(shareType string) func(string) string {
@@ -157,14 +176,16 @@ func (r *Resource) GetDisplayName() string {
 	return r.FileName + r.Ext
 }
 
-func (r *Resource) NewParent(selfID, parentID uint64) error {
-	r.ParentGroup = parentID
-	v, err := r.ToBytes()
-	if err != nil {
+func (r *Resource) NewParent(tx *transaction, selfID, parentID uint64) error {
+	moved := *r
+	moved.ParentGroup = parentID
+	if err := moved.SaveToBatch(tx.batch, selfID); err != nil {
 		return err
 	}
-	err = db.Put(append([]byte("gypsum-resources-"), helper.U64ToBytes(selfID)...), v, nil)
-	return err
+	tx.OnCommit(func() {
+		r.ParentGroup = parentID
+	})
+	return nil
 }
 
 func resourceIDByHash(sum string) (uint64, bool) {
@@ -175,9 +196,9 @@ func resourceIDByHash(sum string) (uint64, bool) {
 	if err != nil {
 		return 0, false
 	}
-	v, err := db.Get(append([]byte("gypsum-resources_hash-"), b...), nil)
+	v, err := db.Get(append([]byte("gypsum-resources_hash-"), b...))
 	if err != nil {
-		if err != leveldb.ErrNotFound {
+		if err != storage.ErrNotFound {
 			log.Errorf("error reading database: %s", err)
 		}
 		return 0, false
@@ -186,7 +207,9 @@ func resourceIDByHash(sum string) (uint64, bool) {
 }
 
 func getResources(c *gin.Context) {
-	c.JSON(200, resources)
+	registry.RLock()
+	defer registry.RUnlock()
+	c.JSON(200, registry.resources)
 }
 
 func getResourceByID(c *gin.Context) {
@@ -205,7 +228,9 @@ func getResourceByID(c *gin.Context) {
 			return
 		}
 	}
-	r, ok := resources[resourceID]
+	registry.RLock()
+	defer registry.RUnlock()
+	r, ok := registry.resources[resourceID]
 	if !ok {
 		c.JSON(404, gin.H{
 			"code":    1000,
@@ -223,7 +248,9 @@ func downloadResource(c *gin.Context) {
 		c.String(404, "404: resource not found")
 		return
 	}
-	r, ok := resources[resourceID]
+	registry.RLock()
+	defer registry.RUnlock()
+	r, ok := registry.resources[resourceID]
 	if !ok {
 		c.String(404, "404: resource not found")
 		return
@@ -263,14 +290,6 @@ func uploadResource(c *gin.Context) {
 			return
 		}
 	}
-	parentGroup, ok := groups[parentID]
-	if !ok {
-		c.JSON(404, gin.H{
-			"code":    1000,
-			"message": "group not found",
-		})
-		return
-	}
 	bodyReader := c.Request.Body
 	body, err := io.ReadAll(bodyReader)
 	if err != nil {
@@ -282,8 +301,19 @@ func uploadResource(c *gin.Context) {
 	}
 	hashBytes := sha256.Sum256(body)
 	hashHex := hex.EncodeToString(hashBytes[:])
+	registry.Lock()
+	defer registry.Unlock()
+	tx := newTransaction()
+	parentGroup, ok := tx.Group(parentID)
+	if !ok {
+		c.JSON(404, gin.H{
+			"code":    1000,
+			"message": "group not found",
+		})
+		return
+	}
 	// check if resource already exist
-	idx, err := db.Get(append([]byte("gypsum-resources_hash-"), hashBytes[:]...), nil)
+	idx, err := db.Get(append([]byte("gypsum-resources_hash-"), hashBytes[:]...))
 	if err == nil {
 		// already exist
 		c.JSON(200, gin.H{
@@ -293,7 +323,7 @@ func uploadResource(c *gin.Context) {
 		})
 		return
 	} else {
-		if err != leveldb.ErrNotFound {
+		if err != storage.ErrNotFound {
 			// error other than "ErrNotFound"
 			c.JSON(500, gin.H{
 				"code":    3000,
@@ -311,57 +341,36 @@ func uploadResource(c *gin.Context) {
 		return
 	}
 	// save info data
-	itemCursor++
-	cursor := itemCursor
+	cursor := tx.NewItemID()
 	parentGroup.Items = append(parentGroup.Items, Item{
 		ItemType:    ResourceItem,
 		DisplayName: fileName + ext,
 		ItemID:      cursor,
 	})
-	if err := parentGroup.SaveToDB(parentID); err != nil {
-		log.Error(err)
-		c.JSON(500, gin.H{
-			"code":    3000,
-			"message": fmt.Sprintf("Server got itself into trouble: %s", err),
-		})
-		return
-	}
-	if err := db.Put([]byte("gypsum-$meta-cursor"), helper.U64ToBytes(cursor), nil); err != nil {
-		c.JSON(500, gin.H{
-			"code":    3000,
-			"message": fmt.Sprintf("Server got itself into trouble: %s", err),
-		})
-		return
-	}
 	resource := Resource{
 		FileName:    fileName,
 		Ext:         ext,
 		Sha256Sum:   hashHex,
 		ParentGroup: parentID,
 	}
-	v, err := resource.ToBytes()
-	if err != nil {
+	if err := resource.SaveToBatch(tx.batch, cursor); err != nil {
 		c.JSON(400, gin.H{
 			"code":    2000,
 			"message": fmt.Sprintf("converting error: %s", err),
 		})
 		return
 	}
-	if err = db.Put(append([]byte("gypsum-resources-"), helper.U64ToBytes(cursor)...), v, nil); err != nil {
-		c.JSON(500, gin.H{
-			"code":    3000,
-			"message": fmt.Sprintf("Server got itself into trouble: %s", err),
-		})
-		return
-	}
-	if err = db.Put(append([]byte("gypsum-resources_hash-"), hashBytes[:]...), helper.U64ToBytes(cursor), nil); err != nil {
+	tx.batch.Put(append([]byte("gypsum-resources_hash-"), hashBytes[:]...), helper.U64ToBytes(cursor))
+	tx.OnCommit(func() {
+		registry.resources[cursor] = &resource
+	})
+	if err := tx.Commit(); err != nil {
 		c.JSON(500, gin.H{
 			"code":    3000,
 			"message": fmt.Sprintf("Server got itself into trouble: %s", err),
 		})
 		return
 	}
-	resources[cursor] = &resource
 	c.JSON(201, gin.H{
 		"code":        0,
 		"message":     "ok",
@@ -379,7 +388,9 @@ func deleteResource(c *gin.Context) {
 		})
 		return
 	}
-	oldResource, ok := resources[resourceID]
+	registry.Lock()
+	defer registry.Unlock()
+	oldResource, ok := registry.resources[resourceID]
 	if !ok {
 		c.JSON(404, gin.H{
 			"code":    1000,
@@ -387,13 +398,23 @@ func deleteResource(c *gin.Context) {
 		})
 		return
 	}
+	tx := newTransaction()
 	// remove self from parent
-	if err := DeleteFromParent(oldResource.ParentGroup, resourceID); err != nil {
+	if err := DeleteFromParent(tx, oldResource.ParentGroup, resourceID); err != nil {
 		log.Errorf("error when delete group %d from parent group %d: %s", resourceID, oldResource.ParentGroup, err)
 	}
-	// remove self from database
-	delete(resources, resourceID)
-	if err := db.Delete(append([]byte("gypsum-resources-"), helper.U64ToBytes(resourceID)...), nil); err != nil {
+	// move self into trash, the file is kept until the trash is purged
+	if err := tx.MoveToTrash(ResourceItem, resourceID, oldResource, nil); err != nil {
+		c.JSON(500, gin.H{
+			"code":    3001,
+			"message": fmt.Sprintf("Server got itself into trouble: %s", err),
+		})
+		return
+	}
+	tx.OnCommit(func() {
+		delete(registry.resources, resourceID)
+	})
+	if err := tx.Commit(); err != nil {
 		c.JSON(500, gin.H{
 			"code":    3001,
 			"message": fmt.Sprintf("Server got itself into trouble: %s", err),
@@ -421,7 +442,9 @@ func renameResource(c *gin.Context) {
 		})
 		return
 	}
-	r, ok := resources[resourceID]
+	registry.Lock()
+	defer registry.Unlock()
+	r, ok := registry.resources[resourceID]
 	if !ok {
 		c.JSON(404, gin.H{
 			"code":    1000,
@@ -437,11 +460,23 @@ func renameResource(c *gin.Context) {
 		})
 		return
 	}
-	r.FileName = np.FileName
-	if err = ChangeNameForParent(r.ParentGroup, resourceID, np.FileName+r.Ext); err != nil {
+	tx := newTransaction()
+	renamed := *r
+	renamed.FileName = np.FileName
+	if err = renamed.SaveToBatch(tx.batch, resourceID); err != nil {
+		c.JSON(400, gin.H{
+			"code":    2000,
+			"message": fmt.Sprintf("converting error: %s", err),
+		})
+		return
+	}
+	if err = ChangeNameForParent(tx, r.ParentGroup, resourceID, np.FileName+r.Ext); err != nil {
 		log.Errorf("error when change resource %d from parent group %d: %s", resourceID, r.ParentGroup, err)
 	}
-	if err = r.SaveToDB(resourceID); err != nil {
+	tx.OnCommit(func() {
+		r.FileName = np.FileName
+	})
+	if err = tx.Commit(); err != nil {
 		c.JSON(500, gin.H{
 			"code":    3000,
 			"message": fmt.Sprintf("Server got itself into trouble: %s", err),
@@ -0,0 +1,345 @@
+package gypsum
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/yuudi/gypsum/gypsum/helper"
+	"github.com/yuudi/gypsum/gypsum/storage"
+)
+
+// Revision is the content of an item before it was changed.
+// Revisions are saved under gypsum-revisions- + item id + big-endian unix nano time, so they are iterated from the oldest.
+type Revision struct {
+	ItemType  ItemType
+	ItemBytes []byte
+}
+
+type revisionInfo struct {
+	Revision    uint64    `json:"revision,string"`
+	Time        time.Time `json:"time"`
+	DisplayName string    `json:"display_name"`
+}
+
+const defaultMaxRevisions = 20
+
+func (r *Revision) ToBytes() ([]byte, error) {
+	buffer := bytes.Buffer{}
+	encoder := gob.NewEncoder(&buffer)
+	if err := encoder.Encode(r); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+func RevisionFromBytes(b []byte) (*Revision, error) {
+	r := &Revision{}
+	buffer := bytes.Buffer{}
+	buffer.Write(b)
+	decoder := gob.NewDecoder(&buffer)
+	err := decoder.Decode(r)
+	return r, err
+}
+
+// maxRevisions is how many revisions are kept for each item, negative means no revision is kept
+func maxRevisions() int {
+	if Config == nil || Config.MaxRevisions == 0 {
+		return defaultMaxRevisions
+	}
+	return Config.MaxRevisions
+}
+
+// revisionKept tells if changes of this kind of item are recorded
+func revisionKept(itemType ItemType) bool {
+	switch itemType {
+	case RuleItem, TriggerItem, SchedulerItem, GroupItem:
+		return true
+	default:
+		return false
+	}
+}
+
+func revisionPrefix(id uint64) []byte {
+	return append([]byte("gypsum-revisions-"), helper.U64ToBytes(id)...)
+}
+
+func revisionKey(id, rev uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, rev)
+	return append(revisionPrefix(id), b...)
+}
+
+// revisionIDs lists revisions of an item from the oldest
+func revisionIDs(id uint64) ([]uint64, error) {
+	prefix := revisionPrefix(id)
+	iter := db.NewIterator(prefix)
+	defer iter.Release()
+	var revs []uint64
+	for iter.Next() {
+		revs = append(revs, binary.BigEndian.Uint64(iter.Key()[len(prefix):]))
+	}
+	return revs, iter.Error()
+}
+
+func loadRevision(itemType ItemType, id, rev uint64) (UserRecord, error) {
+	v, err := db.Get(revisionKey(id, rev))
+	if err != nil {
+		return nil, err
+	}
+	r, err := RevisionFromBytes(v)
+	if err != nil {
+		return nil, err
+	}
+	if r.ItemType != itemType {
+		return nil, errors.New(fmt.Sprintf("revision %d is a %s, not %s", rev, r.ItemType, itemType))
+	}
+	return itemFromBytes(itemType, r.ItemBytes)
+}
+
+// SaveRevision keeps the content of an item before the transaction changes it, the oldest revisions beyond the limit are dropped
+func (tx *transaction) SaveRevision(itemType ItemType, id uint64, old UserRecord) error {
+	limit := maxRevisions()
+	if limit < 0 {
+		return nil
+	}
+	itemBytes, err := old.ToBytes()
+	if err != nil {
+		return err
+	}
+	v, err := (&Revision{
+		ItemType:  itemType,
+		ItemBytes: itemBytes,
+	}).ToBytes()
+	if err != nil {
+		return err
+	}
+	revs, err := revisionIDs(id)
+	if err != nil {
+		return err
+	}
+	rev := uint64(time.Now().UnixNano())
+	if len(revs) > 0 && rev <= revs[len(revs)-1] {
+		rev = revs[len(revs)-1] + 1
+	}
+	for len(revs) > 0 && len(revs) >= limit {
+		tx.batch.Delete(revisionKey(id, revs[0]))
+		revs = revs[1:]
+	}
+	tx.batch.Put(revisionKey(id, rev), v)
+	return nil
+}
+
+// DeleteRevisions drops all revisions of an item
+func (tx *transaction) DeleteRevisions(id uint64) error {
+	revs, err := revisionIDs(id)
+	if err != nil {
+		return err
+	}
+	for _, rev := range revs {
+		tx.batch.Delete(revisionKey(id, rev))
+	}
+	return nil
+}
+
+// itemFromParams finds the item of route /items/:type/:iid, writes 404 if not found
+func itemFromParams(c *gin.Context) (ItemType, uint64, UserRecord, bool) {
+	itemType := ItemType(c.Param("type"))
+	itemID, err := strconv.ParseUint(c.Param("iid"), 10, 64)
+	if err != nil {
+		c.JSON(404, gin.H{
+			"code":    1000,
+			"message": "no such item",
+		})
+		return itemType, 0, nil, false
+	}
+	item, ok := findItem(itemType, itemID)
+	if !ok {
+		c.JSON(404, gin.H{
+			"code":    1000,
+			"message": "no such item",
+		})
+		return itemType, itemID, nil, false
+	}
+	if !revisionKept(itemType) {
+		c.JSON(422, gin.H{
+			"code":    3020,
+			"message": fmt.Sprintf("revisions are not kept for %s", itemType),
+		})
+		return itemType, itemID, nil, false
+	}
+	return itemType, itemID, item, true
+}
+
+// revisionFromQuery loads the revision named by the query value, "current" or empty means the item itself
+func revisionFromQuery(itemType ItemType, itemID uint64, current UserRecord, value string) (UserRecord, error) {
+	if value == "" || value == "current" {
+		return current, nil
+	}
+	rev, err := strconv.ParseUint(value, 10, 64)
+	if err != nil {
+		return nil, storage.ErrNotFound
+	}
+	return loadRevision(itemType, itemID, rev)
+}
+
+func revisionLines(itemType ItemType, record UserRecord) []string {
+	// decode again from bytes like revisions, so that empty and missing lists look the same
+	if itemBytes, err := record.ToBytes(); err == nil {
+		if decoded, err := itemFromBytes(itemType, itemBytes); err == nil {
+			record = decoded
+		}
+	}
+	b, err := json.MarshalIndent(record, "", "  ")
+	if err != nil {
+		return []string{err.Error()}
+	}
+	return strings.Split(string(b), "\n")
+}
+
+func getRevisions(c *gin.Context) {
+	registry.RLock()
+	defer registry.RUnlock()
+	itemType, itemID, _, ok := itemFromParams(c)
+	if !ok {
+		return
+	}
+	revs, err := revisionIDs(itemID)
+	if err != nil {
+		c.JSON(500, gin.H{
+			"code":    3000,
+			"message": fmt.Sprintf("Server got itself into trouble: %s", err),
+		})
+		return
+	}
+	infos := make([]revisionInfo, 0, len(revs))
+	for i := len(revs) - 1; i >= 0; i-- {
+		record, err := loadRevision(itemType, itemID, revs[i])
+		if err != nil {
+			log.Errorf("无法加载修订%d：%s", revs[i], err)
+			continue
+		}
+		infos = append(infos, revisionInfo{
+			Revision:    revs[i],
+			Time:        time.Unix(0, int64(revs[i])),
+			DisplayName: record.GetDisplayName(),
+		})
+	}
+	c.JSON(200, infos)
+}
+
+func diffRevisions(c *gin.Context) {
+	registry.RLock()
+	defer registry.RUnlock()
+	itemType, itemID, current, ok := itemFromParams(c)
+	if !ok {
+		return
+	}
+	from, err := revisionFromQuery(itemType, itemID, current, c.Query("from"))
+	if err != nil {
+		c.JSON(404, gin.H{
+			"code":    1000,
+			"message": "no such revision",
+		})
+		return
+	}
+	to, err := revisionFromQuery(itemType, itemID, current, c.Query("to"))
+	if err != nil {
+		c.JSON(404, gin.H{
+			"code":    1000,
+			"message": "no such revision",
+		})
+		return
+	}
+	c.JSON(200, gin.H{
+		"code":    0,
+		"message": "ok",
+		"diff":    helper.LineDiff(revisionLines(itemType, from), revisionLines(itemType, to)),
+	})
+}
+
+func restoreRevision(c *gin.Context) {
+	rev, err := strconv.ParseUint(c.Param("rev"), 10, 64)
+	if err != nil {
+		c.JSON(404, gin.H{
+			"code":    1000,
+			"message": "no such revision",
+		})
+		return
+	}
+	registry.Lock()
+	defer registry.Unlock()
+	itemType, itemID, current, ok := itemFromParams(c)
+	if !ok {
+		return
+	}
+	old, err := loadRevision(itemType, itemID, rev)
+	if err != nil {
+		if err == storage.ErrNotFound {
+			c.JSON(404, gin.H{
+				"code":    1000,
+				"message": "no such revision",
+			})
+			return
+		}
+		c.JSON(500, gin.H{
+			"code":    3000,
+			"message": fmt.Sprintf("Server got itself into trouble: %s", err),
+		})
+		return
+	}
+	tx := newTransaction()
+	// the current content is kept, so that restoring can be undone
+	if err = tx.SaveRevision(itemType, itemID, current); err != nil {
+		log.Errorf("error when saving revision of %s %d: %s", itemType, itemID, err)
+	}
+	parentID := current.GetParentID()
+	if g, ok := old.(*Group); ok {
+		// members of a group are not restored, items are registered again by Commit if the activation or the defaults change
+		staged, _ := tx.Group(itemID)
+		staged.DisplayName = g.DisplayName
+		staged.PluginName = g.PluginName
+		staged.PluginVersion = g.PluginVersion
+		staged.Active = g.Active
+		staged.StartAt = g.StartAt
+		staged.EndAt = g.EndAt
+		staged.Defaults = g.Defaults
+	} else {
+		setRecordParent(old, parentID)
+		if err = old.SaveToBatch(tx.batch, itemID); err != nil {
+			c.JSON(400, gin.H{
+				"code":    2000,
+				"message": fmt.Sprintf("converting error: %s", err),
+			})
+			return
+		}
+		tx.OnCommit(func() {
+			replaceItem(itemType, itemID, old, true)
+		})
+	}
+	if itemID != 0 && old.GetDisplayName() != current.GetDisplayName() {
+		if err = ChangeNameForParent(tx, parentID, itemID, old.GetDisplayName()); err != nil {
+			log.Errorf("error when change %s %d from parent group %d: %s", itemType, itemID, parentID, err)
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		c.JSON(500, gin.H{
+			"code":    3002,
+			"message": fmt.Sprintf("Server got itself into trouble: %s", err),
+		})
+		return
+	}
+	c.JSON(200, gin.H{
+		"code":    0,
+		"message": "ok",
+	})
+}
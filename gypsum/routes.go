@@ -44,6 +44,8 @@ func initWeb() {
 	api.GET("/groups/:gid/archive", exportGroup)
 	api.DELETE("/groups/:gid", deleteGroup)
 	api.PATCH("/groups/:gid", renameGroup)
+	api.PUT("/groups/:gid/activation", activateGroup)
+	api.PUT("/groups/:gid/defaults", setGroupDefaults)
 	api.GET("/rules", getRules)
 	api.GET("/rules/:rid", getRuleByID)
 	api.POST("/rules", createRule)
@@ -75,6 +77,21 @@ func initWeb() {
 	api.POST("/groups/:gid/resources/:name", uploadResource)
 	api.DELETE("/resources/:rid", deleteResource)
 	api.PATCH("/resources/:rid", renameResource)
+	api.GET("/trash", getTrash)
+	api.POST("/trash/:iid/restore", restoreTrash)
+	api.DELETE("/trash/:iid", purgeTrashItem)
+	api.DELETE("/trash", emptyTrash)
+	api.GET("/items/:type/:iid/revisions", getRevisions)
+	api.GET("/items/:type/:iid/diff", diffRevisions)
+	api.POST("/items/:type/:iid/revisions/:rev/restore", restoreRevision)
+	api.GET("/items/:type/:iid/effective", getEffectiveState)
+	api.GET("/userdata/namespaces", getUserDataNamespaces)
+	api.GET("/userdata", listUserData)
+	api.GET("/userdata/value", getUserDataValue)
+	api.PUT("/userdata/value", putUserDataValue)
+	api.DELETE("/userdata/value", deleteUserDataValue)
+	api.GET("/userdata/export", exportUserData)
+	api.POST("/userdata/import", importUserData)
 
 	// debug
 	api.POST("/debug", userTest)
@@ -82,6 +99,14 @@ func initWeb() {
 	// admin
 	api.GET("/gypsum/update", getUpdateStatus)
 	api.PUT("/gypsum/update", requestUpdateGypsum)
+	api.GET("/gypsum/manifest", exportManifest)
+	api.PUT("/gypsum/manifest", importManifest)
+	api.GET("/gypsum/integrity", getIntegrity)
+	api.POST("/gypsum/integrity/repair", repairIntegrityHandler)
+	api.GET("/gypsum/db/stats", getDatabaseStats)
+	api.POST("/gypsum/db/compact", compactDatabaseHandler)
+	api.GET("/gypsum/db/verify", verifyDatabaseHandler)
+	api.GET("/gypsum/db/dump", dumpDatabaseHandler)
 	// admin (non-auth)
 	r.GET("/api/v1/gypsum/information", getGypsumInformation)
 	r.PUT("/api/v1/gypsum/login", loginHandler)
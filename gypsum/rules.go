@@ -12,11 +12,12 @@ import (
 	"github.com/flosch/pongo2"
 	"github.com/gin-gonic/gin"
 	log "github.com/sirupsen/logrus"
-	"github.com/syndtr/goleveldb/leveldb/util"
 	zero "github.com/wdvxdr1123/ZeroBot"
-	lua "github.com/yuin/gopher-lua"
 
 	"github.com/yuudi/gypsum/gypsum/helper"
+	"github.com/yuudi/gypsum/gypsum/normalize"
+	"github.com/yuudi/gypsum/gypsum/outgoing"
+	"github.com/yuudi/gypsum/gypsum/storage"
 )
 
 type RuleType int
@@ -29,6 +30,9 @@ const (
 	Suffix
 	Command
 	Regex
+	Fuzzy
+	Wildcard
+	AnyMessage
 )
 
 const (
@@ -55,32 +59,37 @@ var messageTypeTable = map[string]MessageType{
 }
 
 type Rule struct {
-	DisplayName string      `json:"display_name"`
-	Active      bool        `json:"active"`
-	MessageType MessageType `json:"message_type"`
-	GroupsID    []int64     `json:"groups_id"`
-	UsersID     []int64     `json:"users_id"`
-	MatcherType RuleType    `json:"matcher_type"`
-	Patterns    []string    `json:"patterns"`
-	OnlyAtMe    bool        `json:"only_at_me"`
-	Response    string      `json:"response"`
-	Priority    int         `json:"priority"`
-	Block       bool        `json:"block"`
-	ParentGroup uint64      `json:"-"`
+	DisplayName      string            `json:"display_name" yaml:"display_name"`
+	Active           bool              `json:"active" yaml:"active"`
+	MessageType      MessageType       `json:"message_type" yaml:"message_type"`
+	GroupsID         []int64           `json:"groups_id" yaml:"groups_id"`
+	UsersID          []int64           `json:"users_id" yaml:"users_id"`
+	ExcludedGroupsID []int64           `json:"excluded_groups_id" yaml:"excluded_groups_id"`
+	ExcludedUsersID  []int64           `json:"excluded_users_id" yaml:"excluded_users_id"`
+	Roles            []string          `json:"roles" yaml:"roles"`
+	Window           ActiveWindow      `json:"window" yaml:"window"`
+	Probability      float64           `json:"probability" yaml:"probability"`
+	MatcherType      RuleType          `json:"matcher_type" yaml:"matcher_type"`
+	Patterns         []string          `json:"patterns" yaml:"patterns"`
+	Threshold        float64           `json:"threshold" yaml:"threshold"`
+	Normalize        normalize.Options `json:"normalize" yaml:"normalize"`
+	OnlyAtMe         bool              `json:"only_at_me" yaml:"only_at_me"`
+	Response         string            `json:"response" yaml:"response"`
+	Priority         int               `json:"priority" yaml:"priority"`
+	Overrides        FilterOverrides   `json:"overrides" yaml:"overrides,omitempty"`
+	Block            bool              `json:"block" yaml:"block"`
+	Limits           ExecutionLimits   `json:"limits" yaml:"limits"`
+	Cooldown         Cooldown          `json:"cooldown" yaml:"cooldown"`
+	ParentGroup      uint64            `json:"-" yaml:"-"`
 }
 
-var (
-	rules       map[uint64]*Rule
-	zeroMatcher map[uint64]*zero.Matcher
-)
-
 func (r *Rule) ToBytes() ([]byte, error) {
 	buffer := bytes.Buffer{}
 	encoder := gob.NewEncoder(&buffer)
 	if err := encoder.Encode(r); err != nil {
 		return nil, err
 	}
-	return buffer.Bytes(), nil
+	return sealRecord(RuleItem, buffer.Bytes()), nil
 }
 
 func RuleFromBytes(b []byte) (*Rule, error) {
@@ -89,10 +98,14 @@ func RuleFromBytes(b []byte) (*Rule, error) {
 		UsersID:  []int64{},
 		Patterns: []string{},
 	}
+	payload, err := openRecord(RuleItem, b)
+	if err != nil {
+		return r, err
+	}
 	buffer := bytes.Buffer{}
-	buffer.Write(b)
+	buffer.Write(payload)
 	decoder := gob.NewDecoder(&buffer)
-	err := decoder.Decode(r)
+	err = decoder.Decode(r)
 	return r, err
 }
 
@@ -140,62 +153,120 @@ func usersRule(usersID []int64) zero.Rule {
 }
 
 func (r *Rule) Register(id uint64) error {
-	if !r.Active {
-		return nil
+	matcher, err := r.newMatcher(id)
+	if err != nil {
+		return err
+	}
+	if matcher != nil {
+		registry.zeroMatcher[id] = zero.StoreMatcher(matcher)
+	}
+	return nil
+}
+
+// check validates a rule from a request or a manifest, code is the error code of api
+func (r *Rule) check() (int, error) {
+	if code, err := checkPatterns(r.MatcherType, r.Patterns, r.Threshold); err != nil {
+		return code, err
+	}
+	if err := checkTemplate(r.Response); err != nil {
+		return 2041, errors.New(fmt.Sprintf("template error: %s", err))
+	}
+	if err := r.Limits.check(); err != nil {
+		return 2043, errors.New(fmt.Sprintf("limits error: %s", err))
+	}
+	if err := r.Cooldown.check(); err != nil {
+		return 2044, errors.New(fmt.Sprintf("cooldown error: %s", err))
+	}
+	if err := checkRoles(r.Roles); err != nil {
+		return 2045, errors.New(fmt.Sprintf("roles error: %s", err))
+	}
+	if err := r.Window.check(); err != nil {
+		return 2046, errors.New(fmt.Sprintf("window error: %s", err))
+	}
+	if err := checkProbability(r.Probability); err != nil {
+		return 2047, errors.New(fmt.Sprintf("probability error: %s", err))
+	}
+	if err := r.ownFilters().check(); err != nil {
+		return 2049, errors.New(fmt.Sprintf("filters error: %s", err))
+	}
+	return 0, nil
+}
+
+// newMatcher builds the matcher of the rule without registering it, nil if the rule is not effective
+func (r *Rule) newMatcher(id uint64) (*zero.Matcher, error) {
+	if !r.Active || !groupEffective(r.ParentGroup) {
+		return nil, nil
 	}
 	tmpl, err := pongo2.FromString(r.Response)
 	if err != nil {
 		log.Errorf("模板预处理出错：%s", err)
-		return err
+		return nil, err
+	}
+	filters := r.filters()
+	rules := []zero.Rule{typeRule(filters.MessageType)}
+	if len(filters.GroupsID) != 0 {
+		rules = append(rules, groupsRule(filters.GroupsID))
 	}
-	rules := []zero.Rule{typeRule(r.MessageType)}
-	if len(r.GroupsID) != 0 {
-		rules = append(rules, groupsRule(r.GroupsID))
+	if len(filters.UsersID) != 0 {
+		rules = append(rules, usersRule(filters.UsersID))
 	}
-	if len(r.UsersID) != 0 {
-		rules = append(rules, usersRule(r.UsersID))
+	if len(r.ExcludedGroupsID) != 0 {
+		rules = append(rules, excludedGroupsRule(r.ExcludedGroupsID))
+	}
+	if len(r.ExcludedUsersID) != 0 {
+		rules = append(rules, excludedUsersRule(r.ExcludedUsersID))
+	}
+	if len(r.Roles) != 0 {
+		rules = append(rules, rolesRule(r.Roles))
+	}
+	if r.Window.enabled() {
+		windowRule, err := r.Window.rule()
+		if err != nil {
+			log.Errorf("无法创建时间窗口：%s", err)
+			return nil, err
+		}
+		rules = append(rules, windowRule)
 	}
 	if r.OnlyAtMe {
 		rules = append(rules, zero.OnlyToMe)
 	}
-	var msgRule zero.Rule
-	switch r.MatcherType {
-	case FullMatch:
-		msgRule = zero.FullMatchRule(r.Patterns...)
-	case Keyword:
-		msgRule = zero.KeywordRule(r.Patterns...)
-	case Prefix:
-		msgRule = zero.PrefixRule(r.Patterns...)
-	case Suffix:
-		msgRule = zero.SuffixRule(r.Patterns...)
-	case Command:
-		msgRule = zero.CommandRule(r.Patterns...)
-	case Regex:
-		if len(r.Patterns) == 0 {
-			msgRule = func(_ *zero.Event, _ zero.State) bool {
-				return false
-			}
-		} else {
-			msgRule = zero.RegexRule(r.Patterns[0])
+	msgRule, err := messageRule(r.MatcherType, r.Patterns, r.Threshold, r.Normalize)
+	if err != nil {
+		log.Errorf("无法创建匹配规则：%s", err)
+		return nil, err
+	}
+	rules = append(rules, msgRule)
+	if r.Probability < 1 {
+		rules = append(rules, probabilityRule(r.Probability))
+	}
+	item := fmt.Sprintf("%s %d", RuleItem, id)
+	newHandler := func(tmpl pongo2.Template) zero.Handler {
+		return templateRuleHandler(tmpl, item, r.Limits, itemNamespace(RuleItem, id), outgoing.Send, log.Error)
+	}
+	handler := newHandler(*tmpl)
+	if r.Cooldown.enabled() {
+		rules = append(rules, r.Cooldown.rule(item))
+		if handler, err = r.Cooldown.handler(handler, newHandler); err != nil {
+			log.Errorf("模板预处理出错：%s", err)
+			return nil, err
 		}
-	default:
-		log.Errorf("Unknown type %#v", r.MatcherType)
-		return errors.New(fmt.Sprintf("Unknown type %#v", r.MatcherType))
 	}
-	zeroMatcher[id] = zero.OnMessage(append(rules, msgRule)...).SetPriority(r.Priority).SetBlock(r.Block).Handle(templateRuleHandler(*tmpl, zero.Send, log.Error))
-	return nil
+	return &zero.Matcher{
+		State:    zero.State{},
+		Type:     zero.Type("message"),
+		Rules:    rules,
+		Priority: filters.Priority,
+		Block:    r.Block,
+		Handler:  handler,
+	}, nil
 }
 
-func templateRuleHandler(tmpl pongo2.Template, send func(event zero.Event, msg interface{}) int64, errLogger func(...interface{})) zero.Handler {
+func templateRuleHandler(tmpl pongo2.Template, item string, limits ExecutionLimits, namespace func() string, send func(event zero.Event, msg interface{}) int64, errLogger func(...interface{})) zero.Handler {
 	return func(matcher *zero.Matcher, event zero.Event, state zero.State) zero.Response {
-		var luaState *lua.LState
-		defer func() {
-			if luaState != nil {
-				luaState.Close()
-			}
-		}()
-		reply, err := tmpl.Execute(buildExecutionContext(matcher, event, state, luaState))
-		if err != nil {
+		exe := newExecution(item, limits)
+		defer exe.Close()
+		reply, err := tmpl.Execute(buildExecutionContext(matcher, event, state, exe, namespace()))
+		if err = exe.Check(err); err != nil {
 			errLogger("渲染模板出错：" + err.Error())
 			return zero.FinishResponse
 		}
@@ -207,10 +278,8 @@ func templateRuleHandler(tmpl pongo2.Template, send func(event zero.Event, msg i
 	}
 }
 
-func loadRules() {
-	rules = make(map[uint64]*Rule)
-	zeroMatcher = make(map[uint64]*zero.Matcher)
-	iter := db.NewIterator(util.BytesPrefix([]byte("gypsum-rules-")), nil)
+func loadRules(register bool) {
+	iter := db.NewIterator([]byte("gypsum-rules-"))
 	defer func() {
 		iter.Release()
 		if err := iter.Error(); err != nil {
@@ -225,7 +294,10 @@ func loadRules() {
 			log.Errorf("无法加载规则%d：%s", key, e)
 			continue
 		}
-		rules[key] = r
+		registry.rules[key] = r
+		if !register {
+			continue
+		}
 		if e := r.Register(key); e != nil {
 			log.Errorf("无法注册规则%d：%s", key, e)
 			continue
@@ -233,12 +305,25 @@ func loadRules() {
 	}
 }
 
+func ruleKey(idx uint64) []byte {
+	return append([]byte("gypsum-rules-"), helper.U64ToBytes(idx)...)
+}
+
 func (r *Rule) SaveToDB(idx uint64) error {
 	v, err := r.ToBytes()
 	if err != nil {
 		return err
 	}
-	return db.Put(append([]byte("gypsum-rules-"), helper.U64ToBytes(idx)...), v, nil)
+	return db.Put(ruleKey(idx), v)
+}
+
+func (r *Rule) SaveToBatch(batch *storage.Batch, idx uint64) error {
+	v, err := r.ToBytes()
+	if err != nil {
+		return err
+	}
+	batch.Put(ruleKey(idx), v)
+	return nil
 }
 
 func checkRegex(pattern string) error {
@@ -259,21 +344,27 @@ func (r *Rule) GetDisplayName() string {
 	return r.DisplayName
 }
 
-func (r *Rule) NewParent(selfID, parentID uint64) error {
-	v, err := r.ToBytes()
-	if err != nil {
+func (r *Rule) NewParent(tx *transaction, selfID, parentID uint64) error {
+	moved := *r
+	moved.ParentGroup = parentID
+	if err := moved.SaveToBatch(tx.batch, selfID); err != nil {
 		return err
 	}
-	r.ParentGroup = parentID
-	err = db.Put(append([]byte("gypsum-rules-"), helper.U64ToBytes(selfID)...), v, nil)
-	return err
+	tx.OnCommit(func() {
+		r.ParentGroup = parentID
+	})
+	return nil
 }
 
 func getRules(c *gin.Context) {
-	c.JSON(200, rules)
+	registry.RLock()
+	defer registry.RUnlock()
+	c.JSON(200, registry.rules)
 }
 
 func getRuleByID(c *gin.Context) {
+	registry.RLock()
+	defer registry.RUnlock()
 	ruleIDStr := c.Param("rid")
 	ruleID, err := strconv.ParseUint(ruleIDStr, 10, 64)
 	if err != nil {
@@ -282,7 +373,7 @@ func getRuleByID(c *gin.Context) {
 			"message": "no such rule",
 		})
 	} else {
-		r, ok := rules[ruleID]
+		r, ok := registry.rules[ruleID]
 		if ok {
 			c.JSON(200, r)
 		} else {
@@ -295,7 +386,7 @@ func getRuleByID(c *gin.Context) {
 }
 
 func createRule(c *gin.Context) {
-	var rule Rule
+	rule := Rule{Probability: 1}
 	if err := c.BindJSON(&rule); err != nil {
 		c.JSON(400, gin.H{
 			"code":    2000,
@@ -318,7 +409,10 @@ func createRule(c *gin.Context) {
 			return
 		}
 	}
-	parentGroup, ok := groups[parentID]
+	registry.Lock()
+	defer registry.Unlock()
+	tx := newTransaction()
+	parentGroup, ok := tx.Group(parentID)
 	if !ok {
 		c.JSON(404, gin.H{
 			"code":    1000,
@@ -328,75 +422,50 @@ func createRule(c *gin.Context) {
 	}
 	rule.ParentGroup = parentID
 	// syntax check
-	if rule.MatcherType == Regex {
-		if len(rule.Patterns) != 1 {
-			c.JSON(422, gin.H{
-				"code":    2001,
-				"message": fmt.Sprintf("regex mather can only accept one pattern"),
-			})
-			return
-		}
-		if err := checkRegex(rule.Patterns[0]); err != nil {
-			c.JSON(422, gin.H{
-				"code":    2002,
-				"message": fmt.Sprintf("cannot compile regex pattern: %s", err),
-			})
-			return
-		}
-	}
-	if err := checkTemplate(rule.Response); err != nil {
+	if code, err := rule.check(); err != nil {
 		c.JSON(422, gin.H{
-			"code":    2041,
-			"message": fmt.Sprintf("template error: %s", err),
+			"code":    code,
+			"message": err.Error(),
+		})
+		return
+	}
+	// build the matcher before saving, so that a broken rule is never stored
+	cursor := tx.NewItemID()
+	matcher, err := rule.newMatcher(cursor)
+	if err != nil {
+		c.JSON(400, gin.H{
+			"code":    2001,
+			"message": fmt.Sprintf("rule error: %s", err),
 		})
 		return
 	}
 	// save
-	itemCursor++
-	cursor := itemCursor
 	parentGroup.Items = append(parentGroup.Items, Item{
 		ItemType:    RuleItem,
 		DisplayName: rule.DisplayName,
 		ItemID:      cursor,
 	})
-	if err := parentGroup.SaveToDB(parentID); err != nil {
-		log.Error(err)
-		c.JSON(500, gin.H{
-			"code":    3000,
-			"message": fmt.Sprintf("Server got itself into trouble: %s", err),
-		})
-		return
-	}
-	if err := db.Put([]byte("gypsum-$meta-cursor"), helper.U64ToBytes(cursor), nil); err != nil {
-		c.JSON(500, gin.H{
-			"code":    3000,
-			"message": fmt.Sprintf("Server got itself into trouble: %s", err),
-		})
-		return
-	}
-	v, err := rule.ToBytes()
-	if err != nil {
+	if err := rule.SaveToBatch(tx.batch, cursor); err != nil {
 		c.JSON(400, gin.H{
 			"code":    2000,
 			"message": fmt.Sprintf("converting error: %s", err),
 		})
 		return
 	}
-	if err := rule.Register(cursor); err != nil {
-		c.JSON(400, gin.H{
-			"code":    2001,
-			"message": fmt.Sprintf("rule error: %s", err),
-		})
-		return
-	}
-	if err := db.Put(append([]byte("gypsum-rules-"), helper.U64ToBytes(cursor)...), v, nil); err != nil {
+	tx.OnCommit(func() {
+		registry.rules[cursor] = &rule
+		if matcher != nil {
+			registry.zeroMatcher[cursor] = zero.StoreMatcher(matcher)
+		}
+	})
+	if err := tx.Commit(); err != nil {
+		log.Error(err)
 		c.JSON(500, gin.H{
 			"code":    3000,
 			"message": fmt.Sprintf("Server got itself into trouble: %s", err),
 		})
 		return
 	}
-	rules[cursor] = &rule
 	c.JSON(201, gin.H{
 		"code":    0,
 		"message": "ok",
@@ -415,7 +484,9 @@ func deleteRule(c *gin.Context) {
 		})
 		return
 	}
-	oldRule, ok := rules[ruleID]
+	registry.Lock()
+	defer registry.Unlock()
+	oldRule, ok := registry.rules[ruleID]
 	if !ok {
 		c.JSON(404, gin.H{
 			"code":    1000,
@@ -423,21 +494,32 @@ func deleteRule(c *gin.Context) {
 		})
 		return
 	}
+	tx := newTransaction()
 	// remove self from parent
-	if err := DeleteFromParent(oldRule.ParentGroup, ruleID); err != nil {
+	if err := DeleteFromParent(tx, oldRule.ParentGroup, ruleID); err != nil {
 		log.Errorf("error when delete group %d from parent group %d: %s", ruleID, oldRule.ParentGroup, err)
 	}
-	// remove self from database
-	delete(rules, ruleID)
-	if err := db.Delete(append([]byte("gypsum-rules-"), helper.U64ToBytes(ruleID)...), nil); err != nil {
+	// move self into trash
+	if err := tx.MoveToTrash(RuleItem, ruleID, oldRule, nil); err != nil {
 		c.JSON(500, gin.H{
 			"code":    3001,
 			"message": fmt.Sprintf("Server got itself into trouble: %s", err),
 		})
 		return
 	}
-	if oldRule.Active {
-		zeroMatcher[ruleID].Delete()
+	tx.OnCommit(func() {
+		delete(registry.rules, ruleID)
+	})
+	if err := tx.Commit(); err != nil {
+		c.JSON(500, gin.H{
+			"code":    3001,
+			"message": fmt.Sprintf("Server got itself into trouble: %s", err),
+		})
+		return
+	}
+	if matcher, ok := registry.zeroMatcher[ruleID]; ok {
+		matcher.Delete()
+		delete(registry.zeroMatcher, ruleID)
 	}
 	c.JSON(200, gin.H{
 		"code":    0,
@@ -456,7 +538,9 @@ func modifyRule(c *gin.Context) {
 		})
 		return
 	}
-	oldRule, ok := rules[ruleID]
+	registry.Lock()
+	defer registry.Unlock()
+	oldRule, ok := registry.rules[ruleID]
 	if !ok {
 		c.JSON(404, gin.H{
 			"code":    100,
@@ -464,7 +548,7 @@ func modifyRule(c *gin.Context) {
 		})
 		return
 	}
-	var newRule Rule
+	newRule := Rule{Probability: 1}
 	if err := c.BindJSON(&newRule); err != nil {
 		c.JSON(400, gin.H{
 			"code":    2000,
@@ -473,61 +557,53 @@ func modifyRule(c *gin.Context) {
 		return
 	}
 	// check new rule syntax
-	if newRule.MatcherType == Regex {
-		if len(newRule.Patterns) != 1 {
-			c.JSON(422, gin.H{
-				"code":    2001,
-				"message": fmt.Sprintf("regex mather can only accept one pattern"),
-			})
-			return
-		}
-		if err := checkRegex(newRule.Patterns[0]); err != nil {
-			c.JSON(422, gin.H{
-				"code":    2002,
-				"message": fmt.Sprintf("cannot compile regex pattern: %s", err),
-			})
-			return
-		}
-	}
-	if err := checkTemplate(newRule.Response); err != nil {
+	if code, err := newRule.check(); err != nil {
 		c.JSON(422, gin.H{
-			"code":    2041,
-			"message": fmt.Sprintf("template error: %s", err),
+			"code":    code,
+			"message": err.Error(),
 		})
 		return
 	}
 	newRule.ParentGroup = oldRule.ParentGroup
-	if oldRule.Active {
-		oldMatcher, ok := zeroMatcher[ruleID]
-		if !ok {
-			c.JSON(500, gin.H{
-				"code":    7012,
-				"message": "error when delete old rule: matcher not found",
-			})
-			return
-		}
-		oldMatcher.Delete()
-	}
-	if err := newRule.Register(ruleID); err != nil {
+	// build the matcher before saving, so that a failed edit keeps the old rule working
+	matcher, err := newRule.newMatcher(ruleID)
+	if err != nil {
 		c.JSON(400, gin.H{
 			"code":    2001,
 			"message": fmt.Sprintf("rule error: %s", err),
 		})
 		return
 	}
-	if err := newRule.SaveToDB(ruleID); err != nil {
-		c.JSON(500, gin.H{
-			"code":    3002,
-			"message": fmt.Sprintf("Server got itself into trouble: %s", err),
+	tx := newTransaction()
+	if err := tx.SaveRevision(RuleItem, ruleID, oldRule); err != nil {
+		log.Errorf("error when saving revision of rule %d: %s", ruleID, err)
+	}
+	if err := newRule.SaveToBatch(tx.batch, ruleID); err != nil {
+		c.JSON(400, gin.H{
+			"code":    2000,
+			"message": fmt.Sprintf("converting error: %s", err),
 		})
 		return
 	}
-	rules[ruleID] = &newRule
 	if newRule.DisplayName != oldRule.DisplayName {
-		if err = ChangeNameForParent(newRule.ParentGroup, ruleID, newRule.DisplayName); err != nil {
+		if err = ChangeNameForParent(tx, newRule.ParentGroup, ruleID, newRule.DisplayName); err != nil {
 			log.Errorf("error when change rule %d from parent group %d: %s", ruleID, newRule.ParentGroup, err)
 		}
 	}
+	tx.OnCommit(func() {
+		registry.rules[ruleID] = &newRule
+		unregisterItem(RuleItem, ruleID)
+		if matcher != nil {
+			registry.zeroMatcher[ruleID] = zero.StoreMatcher(matcher)
+		}
+	})
+	if err := tx.Commit(); err != nil {
+		c.JSON(500, gin.H{
+			"code":    3002,
+			"message": fmt.Sprintf("Server got itself into trouble: %s", err),
+		})
+		return
+	}
 	c.JSON(200, gin.H{
 		"code":    0,
 		"message": "ok",
@@ -0,0 +1,61 @@
+package gypsum
+
+import (
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/yuudi/gypsum/gypsum/sandbox"
+)
+
+// sensitiveFiles can never be read by templates and lua, whatever the sandbox config is
+var sensitiveFiles = []string{"gypsum_config.toml", "gypsum_data", "gypsum.pem", "gypsum.key"}
+
+// fillDefaultLists sets lists left out of the config file (nil) to the defaults, so that they are saved as the defaults.
+// An empty list written in the config file forbids everything.
+func (c *SandboxConfig) fillDefaultLists() {
+	if c.FileRoots == nil {
+		c.FileRoots = sandbox.DefaultFileRoots
+	}
+	if c.UrlHosts == nil {
+		c.UrlHosts = sandbox.DefaultURLHosts
+	}
+	if c.LuaLibraries == nil {
+		c.LuaLibraries = sandbox.DefaultLuaLibraries
+	}
+}
+
+// sandboxPolicy converts the config, a number left 0 uses the default and a negative number means no limit
+func sandboxPolicy() *sandbox.Policy {
+	var c SandboxConfig
+	if Config != nil {
+		c = Config.Sandbox
+	}
+	c.fillDefaultLists()
+	p := &sandbox.Policy{
+		FileRoots:           c.FileRoots,
+		DeniedFiles:         sensitiveFiles,
+		URLHosts:            c.UrlHosts,
+		AllowPrivateNetwork: c.AllowPrivateNetwork,
+		HTTPTimeout:         time.Duration(c.HttpTimeout) * time.Second,
+		MaxResponseSize:     c.MaxResponseSize,
+		LuaLibraries:        c.LuaLibraries,
+	}
+	if c.HttpTimeout == 0 {
+		p.HTTPTimeout = sandbox.DefaultHTTPTimeout
+	} else if c.HttpTimeout < 0 {
+		p.HTTPTimeout = 0
+	}
+	if c.MaxResponseSize == 0 {
+		p.MaxResponseSize = sandbox.DefaultMaxResponseSize
+	} else if c.MaxResponseSize < 0 {
+		p.MaxResponseSize = 0
+	}
+	return p
+}
+
+func initSandbox() {
+	p := sandboxPolicy()
+	sandbox.SetPolicy(p)
+	log.Debugf("沙盒：文件目录 %v，网络 %v，lua 库 %v", p.FileRoots, p.URLHosts, p.LuaLibraries)
+}
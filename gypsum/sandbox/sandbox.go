@@ -0,0 +1,280 @@
+package sandbox
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Policy limits what templates and lua can reach on the host
+type Policy struct {
+	// FileRoots are directories where files can be read, an empty list forbids reading files
+	FileRoots []string
+	// DeniedFiles can never be read even if they are in FileRoots, such as the config file
+	DeniedFiles []string
+	// URLHosts are hosts that can be requested, "*.example.com" matches subdomains, "*" matches any host.
+	// An empty list forbids network requests.
+	URLHosts []string
+	// AllowPrivateNetwork allows requests to loopback, private and link-local addresses, which are checked after the host is resolved
+	AllowPrivateNetwork bool
+	// HTTPTimeout limits a whole request including reading the body
+	HTTPTimeout time.Duration
+	// MaxResponseSize limits the body of a response in bytes
+	MaxResponseSize int64
+	// LuaLibraries are the lua standard libraries opened, each is one of LuaLibraries
+	LuaLibraries []string
+
+	transportOnce sync.Once
+	transport     *http.Transport
+}
+
+// LuaLibraries are the lua standard libraries that can be enabled.
+// Without "io", dofile, loadfile and lua modules on disk are not available.
+// Without "os", os only has clock, date, difftime and time.
+var LuaLibraries = []string{"base", "table", "string", "math", "coroutine", "channel", "os", "io", "debug"}
+
+var (
+	DefaultFileRoots       = []string{"resources"}
+	DefaultURLHosts        = []string{"*"}
+	DefaultHTTPTimeout     = 10 * time.Second
+	DefaultMaxResponseSize = int64(10 << 20)
+	DefaultLuaLibraries    = []string{"base", "table", "string", "math", "coroutine", "channel"}
+)
+
+var current = &Policy{
+	FileRoots:       DefaultFileRoots,
+	URLHosts:        DefaultURLHosts,
+	HTTPTimeout:     DefaultHTTPTimeout,
+	MaxResponseSize: DefaultMaxResponseSize,
+	LuaLibraries:    DefaultLuaLibraries,
+}
+
+// SetPolicy replaces the policy, it must be called before any template is executed
+func SetPolicy(p *Policy) {
+	current = p
+}
+
+func Current() *Policy {
+	return current
+}
+
+// CheckLuaLibraries returns an error for names not in LuaLibraries
+func CheckLuaLibraries(names []string) error {
+	for _, name := range names {
+		known := false
+		for _, lib := range LuaLibraries {
+			if name == lib {
+				known = true
+				break
+			}
+		}
+		if !known {
+			return errors.New(fmt.Sprintf("unknown lua library: %s", name))
+		}
+	}
+	return nil
+}
+
+// realPath is the absolute path with symbolic links resolved, a path that does not exist is kept as it is
+func realPath(name string) (string, error) {
+	abs, err := filepath.Abs(name)
+	if err != nil {
+		return "", err
+	}
+	if resolved, err := filepath.EvalSymlinks(abs); err == nil {
+		return resolved, nil
+	}
+	return abs, nil
+}
+
+func within(name, root string) bool {
+	rel, err := filepath.Rel(root, name)
+	if err != nil {
+		return false
+	}
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// CheckFile returns an error if the file or directory cannot be read by the policy
+func (p *Policy) CheckFile(name string) error {
+	real, err := realPath(name)
+	if err != nil {
+		return err
+	}
+	for _, denied := range p.DeniedFiles {
+		deniedReal, err := realPath(denied)
+		if err == nil && within(real, deniedReal) {
+			return errors.New(fmt.Sprintf("sandbox: reading %s is not allowed", name))
+		}
+	}
+	for _, root := range p.FileRoots {
+		rootReal, err := realPath(root)
+		if err == nil && within(real, rootReal) {
+			return nil
+		}
+	}
+	return errors.New(fmt.Sprintf("sandbox: %s is outside allowed directories", name))
+}
+
+// ReadFile reads a file allowed by the policy
+func (p *Policy) ReadFile(name string) ([]byte, error) {
+	if err := p.CheckFile(name); err != nil {
+		return nil, err
+	}
+	return os.ReadFile(name)
+}
+
+// ReadDir reads a directory allowed by the policy
+func (p *Policy) ReadDir(name string) ([]os.DirEntry, error) {
+	if err := p.CheckFile(name); err != nil {
+		return nil, err
+	}
+	return os.ReadDir(name)
+}
+
+func hostMatches(host, pattern string) bool {
+	pattern = strings.ToLower(pattern)
+	if pattern == "*" || pattern == host {
+		return true
+	}
+	return strings.HasPrefix(pattern, "*.") && strings.HasSuffix(host, pattern[1:])
+}
+
+// CheckURL returns an error if the url cannot be requested by the policy
+func (p *Policy) CheckURL(u *url.URL) error {
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return errors.New(fmt.Sprintf("sandbox: scheme %q is not allowed", u.Scheme))
+	}
+	host := strings.ToLower(u.Hostname())
+	for _, pattern := range p.URLHosts {
+		if hostMatches(host, pattern) {
+			return nil
+		}
+	}
+	return errors.New(fmt.Sprintf("sandbox: host %s is not allowed", u.Host))
+}
+
+// privateNetworks are ranges of private addresses, loopback and link-local addresses are checked by net.IP
+var privateNetworks = func() []*net.IPNet {
+	var networks []*net.IPNet
+	for _, cidr := range []string{"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "fc00::/7"} {
+		_, network, _ := net.ParseCIDR(cidr)
+		networks = append(networks, network)
+	}
+	return networks
+}()
+
+func isPrivateIP(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsUnspecified() {
+		return true
+	}
+	for _, network := range privateNetworks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkDialAddress runs before each connection, after the host is resolved, so that a public name pointing to a private address is caught too
+func (p *Policy) checkDialAddress(_, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || isPrivateIP(ip) {
+		return errors.New(fmt.Sprintf("sandbox: address %s is not allowed", host))
+	}
+	return nil
+}
+
+func (p *Policy) httpTransport() *http.Transport {
+	p.transportOnce.Do(func() {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		if !p.AllowPrivateNetwork {
+			dialer := &net.Dialer{
+				Timeout:   30 * time.Second,
+				KeepAlive: 30 * time.Second,
+				Control:   p.checkDialAddress,
+			}
+			transport.DialContext = dialer.DialContext
+			// through a proxy, the address really requested cannot be checked
+			transport.Proxy = nil
+		}
+		p.transport = transport
+	})
+	return p.transport
+}
+
+// limitedBody fails reading once the body is larger than the limit, instead of silently cutting it
+type limitedBody struct {
+	io.ReadCloser
+	remaining int64
+}
+
+func (b *limitedBody) Read(buf []byte) (int, error) {
+	if b.remaining < 0 {
+		return 0, errors.New("sandbox: response body is too large")
+	}
+	if int64(len(buf)) > b.remaining+1 {
+		buf = buf[:b.remaining+1]
+	}
+	n, err := b.ReadCloser.Read(buf)
+	b.remaining -= int64(n)
+	if b.remaining < 0 {
+		return 0, errors.New("sandbox: response body is too large")
+	}
+	return n, err
+}
+
+// Do sends a request allowed by the policy, redirects are checked too.
+// The timeout covers reading the body, and reading more than MaxResponseSize fails.
+func (p *Policy) Do(req *http.Request) (*http.Response, error) {
+	if err := p.CheckURL(req.URL); err != nil {
+		return nil, err
+	}
+	client := &http.Client{
+		Transport: p.httpTransport(),
+		Timeout:   p.HTTPTimeout,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= 10 {
+				return errors.New("stopped after 10 redirects")
+			}
+			return p.CheckURL(req.URL)
+		},
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if p.MaxResponseSize > 0 {
+		res.Body = &limitedBody{ReadCloser: res.Body, remaining: p.MaxResponseSize}
+	}
+	return res, nil
+}
+
+// Get fetches a url allowed by the policy and reads the body, it stops when ctx is cancelled
+func (p *Policy) Get(ctx context.Context, rawURL string) (*http.Response, []byte, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", rawURL, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	res, err := p.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	return res, body, err
+}
@@ -11,29 +11,27 @@ import (
 	"github.com/gin-gonic/gin"
 	"github.com/robfig/cron/v3"
 	log "github.com/sirupsen/logrus"
-	"github.com/syndtr/goleveldb/leveldb/util"
-	zero "github.com/wdvxdr1123/ZeroBot"
-	lua "github.com/yuin/gopher-lua"
 
 	"github.com/yuudi/gypsum/gypsum/helper"
+	"github.com/yuudi/gypsum/gypsum/outgoing"
+	"github.com/yuudi/gypsum/gypsum/storage"
 )
 
 type ScheduledJob struct {
-	DisplayName string  `json:"display_name"`
-	Active      bool    `json:"active"`
-	GroupsID    []int64 `json:"groups_id"`
-	UsersID     []int64 `json:"users_id"`
-	Once        bool    `json:"once"`
-	CronSpec    string  `json:"cron_spec"`
-	Action      string  `json:"action"`
-	ParentGroup uint64  `json:"-"`
+	DisplayName      string          `json:"display_name" yaml:"display_name"`
+	Active           bool            `json:"active" yaml:"active"`
+	GroupsID         []int64         `json:"groups_id" yaml:"groups_id"`
+	UsersID          []int64         `json:"users_id" yaml:"users_id"`
+	ExcludedGroupsID []int64         `json:"excluded_groups_id" yaml:"excluded_groups_id"`
+	ExcludedUsersID  []int64         `json:"excluded_users_id" yaml:"excluded_users_id"`
+	Once             bool            `json:"once" yaml:"once"`
+	CronSpec         string          `json:"cron_spec" yaml:"cron_spec"`
+	Action           string          `json:"action" yaml:"action"`
+	Limits           ExecutionLimits `json:"limits" yaml:"limits"`
+	ParentGroup      uint64          `json:"-" yaml:"-"`
 }
 
-var (
-	scheduler *cron.Cron
-	jobs      map[uint64]*ScheduledJob
-	entries   map[uint64]cron.EntryID
-)
+var scheduler *cron.Cron
 
 var specParser = cron.NewParser(cron.Minute | cron.Hour | cron.Dom | cron.Month | cron.Dow | cron.Descriptor)
 
@@ -43,7 +41,7 @@ func (j *ScheduledJob) ToBytes() ([]byte, error) {
 	if err := encoder.Encode(j); err != nil {
 		return nil, err
 	}
-	return buffer.Bytes(), nil
+	return sealRecord(SchedulerItem, buffer.Bytes()), nil
 }
 
 func JobFromBytes(b []byte) (*ScheduledJob, error) {
@@ -51,10 +49,14 @@ func JobFromBytes(b []byte) (*ScheduledJob, error) {
 		GroupsID: []int64{},
 		UsersID:  []int64{},
 	}
+	payload, err := openRecord(SchedulerItem, b)
+	if err != nil {
+		return j, err
+	}
 	buffer := bytes.Buffer{}
-	buffer.Write(b)
+	buffer.Write(payload)
 	decoder := gob.NewDecoder(&buffer)
-	err := decoder.Decode(j)
+	err = decoder.Decode(j)
 	return j, err
 }
 
@@ -65,61 +67,97 @@ func (j *ScheduledJob) Executor() (func(), *uint64, error) {
 	}
 	jobID := ^uint64(0)
 	return func() {
-		var luaState *lua.LState
-		defer func() {
-			if luaState != nil {
-				luaState.Close()
-			}
-		}()
-		msg, err := tmpl.Execute(pongo2.Context{
-			"_lua": luaState,
-		})
-		if err != nil {
+		exe := newExecution(fmt.Sprintf("%s %d", SchedulerItem, jobID), j.Limits)
+		defer exe.Close()
+		registry.RLock()
+		namespace := pluginNamespace(j.ParentGroup)
+		registry.RUnlock()
+		msg, err := tmpl.Execute(exe.Context(namespace))
+		if err = exe.Check(err); err != nil {
 			log.Errorf("渲染模板出错：%s", err)
 			return
 		}
 		msg = strings.TrimSpace(msg)
 		if msg != "" {
-			for _, friend := range j.UsersID {
-				zero.SendPrivateMessage(friend, msg)
+			for _, friend := range excludeTargets(j.UsersID, j.ExcludedUsersID) {
+				outgoing.SendPrivateMessage(friend, msg)
 			}
-			for _, group := range j.GroupsID {
-				zero.SendGroupMessage(group, msg)
+			for _, group := range excludeTargets(j.GroupsID, j.ExcludedGroupsID) {
+				outgoing.SendGroupMessage(group, msg)
 			}
 			log.Infof("scheduled job executed: %s", msg)
 		}
 		if j.Once {
-			delete(jobs, jobID)
-			scheduler.Remove(entries[jobID])
-			if err := db.Delete(append([]byte("gypsum-jobs-"), helper.U64ToBytes(jobID)...), nil); err != nil {
+			registry.Lock()
+			defer registry.Unlock()
+			// the job may have been modified or deleted while running, then it is not this job to delete
+			if registry.jobs[jobID] != j {
+				return
+			}
+			tx := newTransaction()
+			if err := DeleteFromParent(tx, j.ParentGroup, jobID); err != nil {
+				log.Errorf("error when delete job %d from parent group %d: %s", jobID, j.ParentGroup, err)
+			}
+			// a finished job goes to trash like a deleted one, so that it can be run again by restoring
+			if err := tx.MoveToTrash(SchedulerItem, jobID, j, nil); err != nil {
+				log.Errorf("error when moving job %d into trash: %s", jobID, err)
+				return
+			}
+			tx.OnCommit(func() {
+				delete(registry.jobs, jobID)
+				unregisterItem(SchedulerItem, jobID)
+			})
+			if err := tx.Commit(); err != nil {
 				log.Errorf("delete job from database error: %s", err)
 			}
 		}
 	}, &jobID, nil
 }
 
+// cronEntry is a job ready to be added to the scheduler
+type cronEntry struct {
+	schedule cron.Schedule
+	run      func()
+}
+
+func (e *cronEntry) add() cron.EntryID {
+	return scheduler.Schedule(e.schedule, cron.FuncJob(e.run))
+}
+
 func (j *ScheduledJob) Register(id uint64) error {
-	if !j.Active {
-		return nil
+	entry, err := j.newEntry(id)
+	if err != nil {
+		return err
+	}
+	if entry != nil {
+		registry.entries[id] = entry.add()
+	}
+	return nil
+}
+
+// newEntry prepares the cron entry of the job without adding it to the scheduler, nil if the job is not effective
+func (j *ScheduledJob) newEntry(id uint64) (*cronEntry, error) {
+	if !j.Active || !groupEffective(j.ParentGroup) {
+		return nil, nil
 	}
 	exe, jobID, err := j.Executor()
 	if err != nil {
-		return err
+		return nil, err
 	}
 	*jobID = id
-	entry, err := scheduler.AddFunc(j.CronSpec, exe)
+	schedule, err := specParser.Parse(j.CronSpec)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	entries[id] = entry
-	return nil
+	return &cronEntry{
+		schedule: schedule,
+		run:      exe,
+	}, nil
 }
 
-func loadJobs() {
+func loadJobs(register bool) {
 	scheduler = cron.New()
-	jobs = make(map[uint64]*ScheduledJob)
-	entries = make(map[uint64]cron.EntryID)
-	iter := db.NewIterator(util.BytesPrefix([]byte("gypsum-jobs-")), nil)
+	iter := db.NewIterator([]byte("gypsum-jobs-"))
 	defer func() {
 		iter.Release()
 		if err := iter.Error(); err != nil {
@@ -134,13 +172,22 @@ func loadJobs() {
 			log.Errorf("无法加载任务%d：%s", key, e)
 			continue
 		}
-		jobs[key] = j
+		registry.jobs[key] = j
+		if !register {
+			continue
+		}
 		if e := j.Register(key); e != nil {
 			log.Errorf("无法注册任务%d：%s", key, e)
 			continue
 		}
 	}
-	go scheduler.Start()
+	if register {
+		go scheduler.Start()
+	}
+}
+
+func jobKey(idx uint64) []byte {
+	return append([]byte("gypsum-jobs-"), helper.U64ToBytes(idx)...)
 }
 
 func (j *ScheduledJob) SaveToDB(idx uint64) error {
@@ -148,7 +195,16 @@ func (j *ScheduledJob) SaveToDB(idx uint64) error {
 	if err != nil {
 		return err
 	}
-	return db.Put(append([]byte("gypsum-jobs-"), helper.U64ToBytes(idx)...), v, nil)
+	return db.Put(jobKey(idx), v)
+}
+
+func (j *ScheduledJob) SaveToBatch(batch *storage.Batch, idx uint64) error {
+	v, err := j.ToBytes()
+	if err != nil {
+		return err
+	}
+	batch.Put(jobKey(idx), v)
+	return nil
 }
 
 func (j *ScheduledJob) GetParentID() uint64 {
@@ -159,21 +215,27 @@ func (j *ScheduledJob) GetDisplayName() string {
 	return j.DisplayName
 }
 
-func (j *ScheduledJob) NewParent(selfID, parentID uint64) error {
-	j.ParentGroup = parentID
-	v, err := j.ToBytes()
-	if err != nil {
+func (j *ScheduledJob) NewParent(tx *transaction, selfID, parentID uint64) error {
+	moved := *j
+	moved.ParentGroup = parentID
+	if err := moved.SaveToBatch(tx.batch, selfID); err != nil {
 		return err
 	}
-	err = db.Put(append([]byte("gypsum-jobs-"), helper.U64ToBytes(selfID)...), v, nil)
-	return err
+	tx.OnCommit(func() {
+		j.ParentGroup = parentID
+	})
+	return nil
 }
 
 func getJobs(c *gin.Context) {
-	c.JSON(200, jobs)
+	registry.RLock()
+	defer registry.RUnlock()
+	c.JSON(200, registry.jobs)
 }
 
 func getJobByID(c *gin.Context) {
+	registry.RLock()
+	defer registry.RUnlock()
 	jobIDStr := c.Param("jid")
 	jobID, err := strconv.ParseUint(jobIDStr, 10, 64)
 	if err != nil {
@@ -183,7 +245,7 @@ func getJobByID(c *gin.Context) {
 		})
 		return
 	}
-	r, ok := jobs[jobID]
+	r, ok := registry.jobs[jobID]
 	if ok {
 		c.JSON(200, r)
 		return
@@ -218,7 +280,10 @@ func createJob(c *gin.Context) {
 			return
 		}
 	}
-	parentGroup, ok := groups[parentID]
+	registry.Lock()
+	defer registry.Unlock()
+	tx := newTransaction()
+	parentGroup, ok := tx.Group(parentID)
 	if !ok {
 		c.JSON(404, gin.H{
 			"code":    1000,
@@ -243,54 +308,50 @@ func createJob(c *gin.Context) {
 		})
 		return
 	}
-	// save
-	itemCursor++
-	cursor := itemCursor
-	parentGroup.Items = append(parentGroup.Items, Item{
-		ItemType:    SchedulerItem,
-		DisplayName: job.DisplayName,
-		ItemID:      cursor,
-	})
-	if err := parentGroup.SaveToDB(parentID); err != nil {
-		log.Error(err)
-		c.JSON(500, gin.H{
-			"code":    3000,
-			"message": fmt.Sprintf("Server got itself into trouble: %s", err),
-		})
-		return
-	}
-	if err := db.Put([]byte("gypsum-$meta-cursor"), helper.U64ToBytes(cursor), nil); err != nil {
-		log.Error(err)
-		c.JSON(500, gin.H{
-			"code":    3000,
-			"message": fmt.Sprintf("Server got itself into trouble: %s", err),
+	if err := job.Limits.check(); err != nil {
+		c.JSON(422, gin.H{
+			"code":    2043,
+			"message": fmt.Sprintf("limits error: %s", err),
 		})
 		return
 	}
-	v, err := job.ToBytes()
+	// prepare the cron entry before saving, so that a broken job is never stored
+	cursor := tx.NewItemID()
+	entry, err := job.newEntry(cursor)
 	if err != nil {
 		c.JSON(400, gin.H{
-			"code":    2000,
-			"message": fmt.Sprintf("converting error: %s", err),
+			"code":    2001,
+			"message": fmt.Sprintf("job error: %s", err),
 		})
 		return
 	}
-	// register
-	if err := job.Register(cursor); err != nil {
+	// save
+	parentGroup.Items = append(parentGroup.Items, Item{
+		ItemType:    SchedulerItem,
+		DisplayName: job.DisplayName,
+		ItemID:      cursor,
+	})
+	if err := job.SaveToBatch(tx.batch, cursor); err != nil {
 		c.JSON(400, gin.H{
-			"code":    2001,
-			"message": fmt.Sprintf("job error: %s", err),
+			"code":    2000,
+			"message": fmt.Sprintf("converting error: %s", err),
 		})
 		return
 	}
-	if err := db.Put(append([]byte("gypsum-jobs-"), helper.U64ToBytes(cursor)...), v, nil); err != nil {
+	tx.OnCommit(func() {
+		registry.jobs[cursor] = &job
+		if entry != nil {
+			registry.entries[cursor] = entry.add()
+		}
+	})
+	if err := tx.Commit(); err != nil {
+		log.Error(err)
 		c.JSON(500, gin.H{
 			"code":    3000,
 			"message": fmt.Sprintf("Server got itself into trouble: %s", err),
 		})
 		return
 	}
-	jobs[cursor] = &job
 	c.JSON(201, gin.H{
 		"code":    0,
 		"message": "ok",
@@ -309,7 +370,9 @@ func deleteJob(c *gin.Context) {
 		})
 		return
 	}
-	job, ok := jobs[jobID]
+	registry.Lock()
+	defer registry.Unlock()
+	job, ok := registry.jobs[jobID]
 	if !ok {
 		c.JSON(404, gin.H{
 			"code":    1000,
@@ -317,21 +380,32 @@ func deleteJob(c *gin.Context) {
 		})
 		return
 	}
+	tx := newTransaction()
 	// remove self from parent
-	if err := DeleteFromParent(job.ParentGroup, jobID); err != nil {
+	if err := DeleteFromParent(tx, job.ParentGroup, jobID); err != nil {
 		log.Errorf("error when delete group %d from parent group %d: %s", jobID, job.ParentGroup, err)
 	}
-	// remove self from database
-	delete(jobs, jobID)
-	if err := db.Delete(append([]byte("gypsum-jobs-"), helper.U64ToBytes(jobID)...), nil); err != nil {
+	// move self into trash
+	if err := tx.MoveToTrash(SchedulerItem, jobID, job, nil); err != nil {
+		c.JSON(500, gin.H{
+			"code":    3001,
+			"message": fmt.Sprintf("Server got itself into trouble: %s", err),
+		})
+		return
+	}
+	tx.OnCommit(func() {
+		delete(registry.jobs, jobID)
+	})
+	if err := tx.Commit(); err != nil {
 		c.JSON(500, gin.H{
 			"code":    3001,
 			"message": fmt.Sprintf("Server got itself into trouble: %s", err),
 		})
 		return
 	}
-	if job.Active {
-		scheduler.Remove(entries[jobID])
+	if entry, ok := registry.entries[jobID]; ok {
+		scheduler.Remove(entry)
+		delete(registry.entries, jobID)
 	}
 	c.JSON(200, gin.H{
 		"code":    0,
@@ -350,7 +424,9 @@ func modifyJob(c *gin.Context) {
 		})
 		return
 	}
-	oldJob, ok := jobs[jobID]
+	registry.Lock()
+	defer registry.Unlock()
+	oldJob, ok := registry.jobs[jobID]
 	if !ok {
 		c.JSON(404, gin.H{
 			"code":    100,
@@ -382,30 +458,53 @@ func modifyJob(c *gin.Context) {
 		})
 		return
 	}
-	newJob.ParentGroup = oldJob.ParentGroup
-	if oldJob.Active {
-		scheduler.Remove(entries[jobID])
+	if err := newJob.Limits.check(); err != nil {
+		c.JSON(422, gin.H{
+			"code":    2043,
+			"message": fmt.Sprintf("limits error: %s", err),
+		})
+		return
 	}
-	if err := newJob.Register(jobID); err != nil {
+	newJob.ParentGroup = oldJob.ParentGroup
+	// prepare the cron entry before saving, so that a failed edit keeps the old job running
+	entry, err := newJob.newEntry(jobID)
+	if err != nil {
 		c.JSON(400, gin.H{
 			"code":    2001,
 			"message": fmt.Sprintf("job error: %s", err),
 		})
 		return
 	}
-	if err := newJob.SaveToDB(jobID); err != nil {
-		c.JSON(500, gin.H{
-			"code":    3002,
-			"message": fmt.Sprintf("Server got itself into trouble: %s", err),
+	tx := newTransaction()
+	if err := tx.SaveRevision(SchedulerItem, jobID, oldJob); err != nil {
+		log.Errorf("error when saving revision of job %d: %s", jobID, err)
+	}
+	if err := newJob.SaveToBatch(tx.batch, jobID); err != nil {
+		c.JSON(400, gin.H{
+			"code":    2000,
+			"message": fmt.Sprintf("converting error: %s", err),
 		})
 		return
 	}
-	jobs[jobID] = &newJob
 	if newJob.DisplayName != oldJob.DisplayName {
-		if err = ChangeNameForParent(newJob.ParentGroup, jobID, newJob.DisplayName); err != nil {
+		if err = ChangeNameForParent(tx, newJob.ParentGroup, jobID, newJob.DisplayName); err != nil {
 			log.Errorf("error when change job %d from parent group %d: %s", jobID, newJob.ParentGroup, err)
 		}
 	}
+	tx.OnCommit(func() {
+		registry.jobs[jobID] = &newJob
+		unregisterItem(SchedulerItem, jobID)
+		if entry != nil {
+			registry.entries[jobID] = entry.add()
+		}
+	})
+	if err := tx.Commit(); err != nil {
+		c.JSON(500, gin.H{
+			"code":    3002,
+			"message": fmt.Sprintf("Server got itself into trouble: %s", err),
+		})
+		return
+	}
 	c.JSON(200, gin.H{
 		"code":    0,
 		"message": "ok",
@@ -0,0 +1,81 @@
+package storage
+
+import (
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// LevelDB stores data on disk
+type LevelDB struct {
+	db *leveldb.DB
+}
+
+func OpenLevelDB(path string) (*LevelDB, error) {
+	db, err := leveldb.OpenFile(path, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &LevelDB{db: db}, nil
+}
+
+// DB returns the underlying leveldb database
+func (l *LevelDB) DB() *leveldb.DB {
+	return l.db
+}
+
+// Compact compacts the whole key range, deleted and overwritten data is dropped from disk
+func (l *LevelDB) Compact() error {
+	return l.db.CompactRange(util.Range{})
+}
+
+// Property returns a leveldb property such as "leveldb.stats"
+func (l *LevelDB) Property(name string) (string, error) {
+	return l.db.GetProperty(name)
+}
+
+func (l *LevelDB) Get(key []byte) ([]byte, error) {
+	value, err := l.db.Get(key, nil)
+	if err == leveldb.ErrNotFound {
+		return nil, ErrNotFound
+	}
+	return value, err
+}
+
+func (l *LevelDB) Has(key []byte) (bool, error) {
+	return l.db.Has(key, nil)
+}
+
+func (l *LevelDB) Put(key, value []byte) error {
+	return l.db.Put(key, value, nil)
+}
+
+func (l *LevelDB) Delete(key []byte) error {
+	return l.db.Delete(key, nil)
+}
+
+func (l *LevelDB) NewIterator(prefix []byte) Iterator {
+	if len(prefix) == 0 {
+		return l.db.NewIterator(nil, nil)
+	}
+	return l.db.NewIterator(util.BytesPrefix(prefix), nil)
+}
+
+func (l *LevelDB) Write(batch *Batch) error {
+	b := new(leveldb.Batch)
+	batch.Replay(b.Put, b.Delete)
+	return l.db.Write(b, nil)
+}
+
+func (l *LevelDB) Close() error {
+	return l.db.Close()
+}
+
+// RepairLevelDB rebuilds the manifest of a corrupted database from its table files.
+// The database must not be opened by anyone else.
+func RepairLevelDB(path string) error {
+	db, err := leveldb.RecoverFile(path, nil)
+	if err != nil {
+		return err
+	}
+	return db.Close()
+}
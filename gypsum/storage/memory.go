@@ -0,0 +1,160 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+)
+
+var errClosed = errors.New("storage: closed")
+
+// Memory keeps data in memory only, everything is lost after closing.
+// It is useful for tests and throwaway sandboxes.
+type Memory struct {
+	lock   sync.RWMutex
+	data   map[string][]byte
+	closed bool
+}
+
+func NewMemory() *Memory {
+	return &Memory{
+		data: make(map[string][]byte),
+	}
+}
+
+func (m *Memory) Get(key []byte) ([]byte, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	if m.closed {
+		return nil, errClosed
+	}
+	value, ok := m.data[string(key)]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return append([]byte{}, value...), nil
+}
+
+func (m *Memory) Has(key []byte) (bool, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	if m.closed {
+		return false, errClosed
+	}
+	_, ok := m.data[string(key)]
+	return ok, nil
+}
+
+func (m *Memory) Put(key, value []byte) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.closed {
+		return errClosed
+	}
+	m.data[string(key)] = append([]byte{}, value...)
+	return nil
+}
+
+func (m *Memory) Delete(key []byte) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.closed {
+		return errClosed
+	}
+	delete(m.data, string(key))
+	return nil
+}
+
+// NewIterator iterates over a snapshot taken when the iterator is created
+func (m *Memory) NewIterator(prefix []byte) Iterator {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	if m.closed {
+		return &memoryIterator{index: -1, err: errClosed}
+	}
+	it := &memoryIterator{index: -1}
+	for k, v := range m.data {
+		if strings.HasPrefix(k, string(prefix)) {
+			it.keys = append(it.keys, []byte(k))
+			it.values = append(it.values, v)
+		}
+	}
+	sort.Sort(it)
+	return it
+}
+
+func (m *Memory) Write(batch *Batch) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.closed {
+		return errClosed
+	}
+	batch.Replay(func(key, value []byte) {
+		m.data[string(key)] = value
+	}, func(key []byte) {
+		delete(m.data, string(key))
+	})
+	return nil
+}
+
+func (m *Memory) Close() error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.closed = true
+	m.data = nil
+	return nil
+}
+
+type memoryIterator struct {
+	keys   [][]byte
+	values [][]byte
+	index  int
+	err    error
+}
+
+func (it *memoryIterator) Len() int {
+	return len(it.keys)
+}
+
+func (it *memoryIterator) Less(i, j int) bool {
+	return bytes.Compare(it.keys[i], it.keys[j]) < 0
+}
+
+func (it *memoryIterator) Swap(i, j int) {
+	it.keys[i], it.keys[j] = it.keys[j], it.keys[i]
+	it.values[i], it.values[j] = it.values[j], it.values[i]
+}
+
+func (it *memoryIterator) Next() bool {
+	if it.index+1 >= len(it.keys) {
+		it.index = len(it.keys)
+		return false
+	}
+	it.index++
+	return true
+}
+
+func (it *memoryIterator) Key() []byte {
+	if it.index < 0 || it.index >= len(it.keys) {
+		return nil
+	}
+	return it.keys[it.index]
+}
+
+func (it *memoryIterator) Value() []byte {
+	if it.index < 0 || it.index >= len(it.values) {
+		return nil
+	}
+	return it.values[it.index]
+}
+
+func (it *memoryIterator) Release() {
+	it.keys = nil
+	it.values = nil
+}
+
+func (it *memoryIterator) Error() error {
+	return it.err
+}
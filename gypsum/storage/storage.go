@@ -0,0 +1,77 @@
+package storage
+
+import "errors"
+
+// ErrNotFound is returned by Get when the key does not exist
+var ErrNotFound = errors.New("storage: not found")
+
+// Storage is a sorted key-value store that gypsum keeps all its data in
+type Storage interface {
+	Get(key []byte) ([]byte, error)
+	Has(key []byte) (bool, error)
+	Put(key, value []byte) error
+	Delete(key []byte) error
+	// NewIterator iterates over keys with the prefix in ascending order, an empty prefix iterates over everything
+	NewIterator(prefix []byte) Iterator
+	// Write applies all operations of the batch atomically
+	Write(batch *Batch) error
+	Close() error
+}
+
+// Compactor is implemented by storages that can reclaim space of deleted and overwritten keys
+type Compactor interface {
+	Compact() error
+}
+
+// Iterator must be released after use
+type Iterator interface {
+	Next() bool
+	Key() []byte
+	Value() []byte
+	Release()
+	Error() error
+}
+
+type batchOp struct {
+	delete bool
+	key    []byte
+	value  []byte
+}
+
+// Batch records a sequence of writes which are applied together by Storage.Write
+type Batch struct {
+	ops []batchOp
+}
+
+func (b *Batch) Put(key, value []byte) {
+	b.ops = append(b.ops, batchOp{
+		key:   append([]byte{}, key...),
+		value: append([]byte{}, value...),
+	})
+}
+
+func (b *Batch) Delete(key []byte) {
+	b.ops = append(b.ops, batchOp{
+		delete: true,
+		key:    append([]byte{}, key...),
+	})
+}
+
+func (b *Batch) Len() int {
+	return len(b.ops)
+}
+
+func (b *Batch) Reset() {
+	b.ops = b.ops[:0]
+}
+
+// Replay calls put or del for every operation in order
+func (b *Batch) Replay(put func(key, value []byte), del func(key []byte)) {
+	for _, op := range b.ops {
+		if op.delete {
+			del(op.key)
+		} else {
+			put(op.key, op.value)
+		}
+	}
+}
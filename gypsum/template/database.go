@@ -1,51 +1,80 @@
 package template
 
 import (
-	"bytes"
-	"encoding/gob"
+	"errors"
+	"fmt"
+	"time"
 
+	"github.com/flosch/pongo2"
 	log "github.com/sirupsen/logrus"
-	"github.com/syndtr/goleveldb/leveldb"
 
 	"github.com/yuudi/gypsum/gypsum/helper"
+	"github.com/yuudi/gypsum/gypsum/storage"
+	"github.com/yuudi/gypsum/gypsum/userdata"
 )
 
-var db *leveldb.DB
+func keyBytes(key interface{}) ([]byte, error) {
+	switch k := key.(type) {
+	case string:
+		return []byte(k), nil
+	case int:
+		return helper.U64ToBytes(uint64(k)), nil
+	default:
+		return nil, errors.New(fmt.Sprintf("cannot use %#v (%T) as database key", key, key))
+	}
+}
 
-func SetDB(newDB *leveldb.DB) {
-	db = newDB
+// ttlArgument reads the optional time-to-live in seconds
+func ttlArgument(ttl []interface{}) (time.Duration, error) {
+	if len(ttl) == 0 {
+		return 0, nil
+	}
+	if len(ttl) > 1 {
+		return 0, errors.New("too many arguments")
+	}
+	seconds, err := helper.AnyToInt64(ttl[0])
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(seconds) * time.Second, nil
 }
 
-type ValueType int
+// Database is the user database seen by templates, keys are in the namespace of a plugin
+type Database struct {
+	namespace string
+}
 
-const (
-	IntValueType ValueType = iota
-	StrValueType
-)
+func NewDatabase(namespace string) Database {
+	return Database{namespace: namespace}
+}
+
+// GlobalDatabase works in the namespace shared by all items
+var GlobalDatabase = NewDatabase(userdata.Global)
 
-type StoredValue struct {
-	ValueType ValueType
-	IntValue  int
-	StrValue  string
+// Functions are the database functions for templates, named with the prefix, such as db_get
+func (d Database) Functions(prefix string) map[string]interface{} {
+	return map[string]interface{}{
+		prefix + "get":    d.Get,
+		prefix + "put":    d.Put,
+		prefix + "delete": d.Delete,
+		prefix + "list":   d.List,
+		prefix + "incr":   d.Incr,
+		prefix + "cas":    d.CompareAndSet,
+	}
 }
 
-func DatabaseGet(key interface{}, defaultValue ...interface{}) interface{} {
+func (d Database) Get(key interface{}, defaultValue ...interface{}) interface{} {
 	if len(defaultValue) > 1 {
 		log.Warn("too many arguments for calling db_get")
 	}
-	var bytesKey []byte
-	switch k := key.(type) {
-	case string:
-		bytesKey = []byte(k)
-	case int:
-		bytesKey = helper.U64ToBytes(uint64(k))
-	default:
-		log.Errorf("cannot use %#v (%T) as database key", key, key)
+	bytesKey, err := keyBytes(key)
+	if err != nil {
+		log.Error(err)
 		return nil
 	}
-	bytesData, err := db.Get(append([]byte("gypsum-userDB-p-"), bytesKey...), nil)
+	v, err := userdata.DataStore.Get(d.namespace, bytesKey)
 	if err != nil {
-		if err == leveldb.ErrNotFound {
+		if err == storage.ErrNotFound {
 			if len(defaultValue) == 0 {
 				log.Warnf("cannot find key in database: %v", key)
 				return nil
@@ -56,60 +85,155 @@ func DatabaseGet(key interface{}, defaultValue ...interface{}) interface{} {
 		log.Error(err)
 		return nil
 	}
-	var data StoredValue
-	buffer := bytes.Buffer{}
-	buffer.Write(bytesData)
-	decoder := gob.NewDecoder(&buffer)
-	if err := decoder.Decode(&data); err != nil {
+	value, err := userdata.DecodeValue(v)
+	if err != nil {
 		log.Errorf("error when reading data from database: %s", err)
 		return nil
 	}
-	switch data.ValueType {
-	case IntValueType:
-		return data.IntValue
-	case StrValueType:
-		return data.StrValue
-	default:
-		log.Errorf("Unknown value type from StoredValue: %v", data.ValueType)
+	return value
+}
+
+// Put writes a value, it expires after ttl seconds if ttl is given.
+// Numbers, strings, booleans, lists and maps can be saved, and lua reads them as the same values.
+func (d Database) Put(key, value interface{}, ttl ...interface{}) *int {
+	bytesKey, err := keyBytes(key)
+	if err != nil {
+		log.Error(err)
+		return nil
+	}
+	expiry, err := ttlArgument(ttl)
+	if err != nil {
+		log.Errorf("invalid ttl for db_put: %s", err)
+		return nil
+	}
+	if err := userdata.DataStore.PutValue(d.namespace, bytesKey, value, expiry); err != nil {
+		log.Errorf("error when put value to database %s", err)
 		return nil
 	}
+	return nil
 }
 
-func DatabasePut(key, value interface{}) *int {
-	var bytesKey []byte
-	switch k := key.(type) {
-	case string:
-		bytesKey = []byte(k)
-	case int:
-		bytesKey = helper.U64ToBytes(uint64(k))
-	default:
-		log.Errorf("cannot use %#v (%T) as database key", key, key)
+func (d Database) Delete(key interface{}) *int {
+	bytesKey, err := keyBytes(key)
+	if err != nil {
+		log.Error(err)
 		return nil
 	}
-	var valueStore *StoredValue
-	switch value.(type) {
-	case string:
-		valueStore = &StoredValue{
-			ValueType: StrValueType,
-			StrValue:  value.(string),
-		}
-	case int:
-		valueStore = &StoredValue{
-			ValueType: IntValueType,
-			IntValue:  value.(int),
+	if err := userdata.DataStore.Delete(d.namespace, bytesKey); err != nil {
+		log.Errorf("error when delete value from database %s", err)
+	}
+	return nil
+}
+
+// List finds string keys with the prefix in ascending order, each entry has "key" and "value"
+func (d Database) List(prefix string, limit ...int) []map[string]interface{} {
+	max := 0
+	if len(limit) != 0 {
+		max = limit[0]
+	}
+	entries, err := userdata.DataStore.List(d.namespace, []byte(prefix), max)
+	if err != nil {
+		log.Errorf("error when list keys from database: %s", err)
+		return nil
+	}
+	list := make([]map[string]interface{}, 0, len(entries))
+	for _, e := range entries {
+		value, err := userdata.DecodeValue(e.Value)
+		if err != nil {
+			log.Errorf("error when reading data from database: %s", err)
+			continue
 		}
-	default:
-		log.Errorf("cannot store %#v (%T) to database", value, value)
+		list = append(list, map[string]interface{}{
+			"key":   string(e.Key),
+			"value": value,
+		})
 	}
-	buffer := bytes.Buffer{}
-	encoder := gob.NewEncoder(&buffer)
-	if err := encoder.Encode(valueStore); err != nil {
-		log.Errorf("error when encode valueStore as bytes: %s", err)
+	return list
+}
+
+// Incr adds delta (default 1) to an integer atomically and returns the new value, a missing key counts as 0.
+// The optional ttl in seconds is set when given, otherwise the key keeps its expiry.
+func (d Database) Incr(key interface{}, args ...interface{}) interface{} {
+	bytesKey, err := keyBytes(key)
+	if err != nil {
+		log.Error(err)
 		return nil
 	}
-	if err := db.Put(append([]byte("gypsum-userDB-p-"), bytesKey...), buffer.Bytes(), nil); err != nil {
-		log.Errorf("error when put value to database %s", err)
+	delta := int64(1)
+	if len(args) != 0 {
+		if delta, err = helper.AnyToInt64(args[0]); err != nil {
+			log.Errorf("invalid delta for db_incr: %s", err)
+			return nil
+		}
+	}
+	var expiry time.Duration
+	if len(args) > 1 {
+		if expiry, err = ttlArgument(args[1:]); err != nil {
+			log.Errorf("invalid ttl for db_incr: %s", err)
+			return nil
+		}
+	}
+	var result int
+	err = userdata.DataStore.Update(d.namespace, bytesKey, expiry, func(old *userdata.Value) (*userdata.Value, error) {
+		current := 0
+		if old != nil {
+			value, err := userdata.DecodeValue(old)
+			if err != nil {
+				return nil, err
+			}
+			number, ok := value.(int)
+			if !ok {
+				return nil, errors.New(fmt.Sprintf("cannot increase non-integer value of key %v", key))
+			}
+			current = number
+		}
+		result = current + int(delta)
+		return userdata.EncodeValue(result)
+	})
+	if err != nil {
+		log.Errorf("error when increase value in database: %s", err)
 		return nil
 	}
-	return nil
+	return result
+}
+
+// CompareAndSet writes newValue only if the key still holds oldValue, nil oldValue means the key must not exist.
+// Returns whether the value is written.
+// Values are taken as *pongo2.Value, because nil cannot be passed to a function as interface{} by pongo2.
+func (d Database) CompareAndSet(key interface{}, oldValue, newValue *pongo2.Value, ttl ...interface{}) bool {
+	bytesKey, err := keyBytes(key)
+	if err != nil {
+		log.Error(err)
+		return false
+	}
+	expiry, err := ttlArgument(ttl)
+	if err != nil {
+		log.Errorf("invalid ttl for db_cas: %s", err)
+		return false
+	}
+	newStored, err := userdata.EncodeValue(newValue.Interface())
+	if err != nil {
+		log.Error(err)
+		return false
+	}
+	swapped := false
+	err = userdata.DataStore.Update(d.namespace, bytesKey, expiry, func(old *userdata.Value) (*userdata.Value, error) {
+		if old == nil {
+			if !oldValue.IsNil() {
+				return nil, nil
+			}
+		} else {
+			current, err := userdata.DecodeValue(old)
+			if err != nil || oldValue.IsNil() || !userdata.Equal(current, oldValue.Interface()) {
+				return nil, err
+			}
+		}
+		swapped = true
+		return newStored, nil
+	})
+	if err != nil {
+		log.Errorf("error when compare and set value in database: %s", err)
+		return false
+	}
+	return swapped
 }
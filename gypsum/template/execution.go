@@ -0,0 +1,48 @@
+package template
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/flosch/pongo2"
+
+	"github.com/yuudi/gypsum/gypsum/helper"
+)
+
+// Execution binds functions that wait to the context of one render, so that they stop when the render is cancelled
+type Execution struct {
+	ctx context.Context
+}
+
+func NewExecution(ctx context.Context) *Execution {
+	return &Execution{ctx: ctx}
+}
+
+// Functions replace the global functions of the same names in the execution context
+func (e *Execution) Functions() pongo2.Context {
+	return pongo2.Context{
+		"sleep":             e.Sleep,
+		"file_get_contents": e.FileGetContents,
+	}
+}
+
+func (e *Execution) Sleep(duration interface{}) (string, error) {
+	seconds, err := helper.AnyToFloat(duration)
+	if err != nil {
+		return "", errors.New(fmt.Sprintf("cannot accept %#v as seconds", duration))
+	}
+	timer := time.NewTimer(time.Duration(seconds * float64(time.Second)))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return "", nil
+	case <-e.ctx.Done():
+		return "", e.ctx.Err()
+	}
+}
+
+func (e *Execution) FileGetContents(filename string) string {
+	return fileGetContents(e.ctx, filename)
+}
@@ -1,12 +1,10 @@
 package template
 
 import (
+	"context"
 	"errors"
 	"fmt"
-	"io"
 	"math/rand"
-	"net/http"
-	"os"
 	"path"
 	"strings"
 	"time"
@@ -16,6 +14,7 @@ import (
 	log "github.com/sirupsen/logrus"
 
 	"github.com/yuudi/gypsum/gypsum/helper"
+	"github.com/yuudi/gypsum/gypsum/sandbox"
 )
 
 func At(qq ...interface{}) *pongo2.Value {
@@ -106,9 +105,14 @@ func RandomInt(input ...interface{}) (int, error) {
 	return rand.Intn(max) + min, nil
 }
 
+// FileGetContents reads a file or url allowed by the sandbox policy
 func FileGetContents(filename string) string {
+	return fileGetContents(context.Background(), filename)
+}
+
+func fileGetContents(ctx context.Context, filename string) string {
 	if strings.HasPrefix(filename, "http://") || strings.HasPrefix(filename, "https://") {
-		res, err := http.Get(filename)
+		res, content, err := sandbox.Current().Get(ctx, filename)
 		if err != nil {
 			log.Error("模板解析错误", err)
 			return ""
@@ -117,14 +121,9 @@ func FileGetContents(filename string) string {
 			log.Error("模板解析错误，网络请求返回值", res.StatusCode)
 			return ""
 		}
-		content, err := io.ReadAll(res.Body)
-		if err != nil {
-			log.Error("模板解析错误，读取网络资源", err)
-			return ""
-		}
 		return string(content)
 	}
-	content, err := os.ReadFile(filename)
+	content, err := sandbox.Current().ReadFile(filename)
 	if err != nil {
 		log.Error("模板解析错误，读取文件", err)
 		return ""
@@ -149,7 +148,7 @@ func RandomLine(c string) string {
 }
 
 func RandomFile(dirPath string) string {
-	dir, err := os.ReadDir(dirPath)
+	dir, err := sandbox.Current().ReadDir(dirPath)
 	if err != nil {
 		log.Error("模板解析错误，读取目录", err)
 		return ""
@@ -5,7 +5,8 @@ import (
 	"strings"
 
 	"github.com/flosch/pongo2"
-	zero "github.com/wdvxdr1123/ZeroBot"
+
+	"github.com/yuudi/gypsum/gypsum/outgoing"
 )
 
 type MessageType int
@@ -32,9 +33,9 @@ func (node *tagSendNode) Execute(ctx *pongo2.ExecutionContext, writer pongo2.Tem
 	}
 	switch node.targetType {
 	case PrivateMessageType:
-		zero.SendPrivateMessage(node.targetID, messageSend)
+		outgoing.SendPrivateMessage(node.targetID, messageSend)
 	case GroupMessageType:
-		zero.SendGroupMessage(node.targetID, messageSend)
+		outgoing.SendGroupMessage(node.targetID, messageSend)
 	}
 	return nil
 }
@@ -9,7 +9,6 @@ import (
 	log "github.com/sirupsen/logrus"
 	zero "github.com/wdvxdr1123/ZeroBot"
 	zeroMessage "github.com/wdvxdr1123/ZeroBot/message"
-	lua "github.com/yuin/gopher-lua"
 
 	"github.com/yuudi/gypsum/gypsum/helper"
 	"github.com/yuudi/gypsum/gypsum/luatag"
@@ -45,8 +44,12 @@ func initTemplating() error {
 	pongo2.Globals["random_file"] = template.RandomFile
 	pongo2.Globals["file_get_contents"] = template.FileGetContents
 	pongo2.Globals["parse_json"] = template.ParseJson
-	pongo2.Globals["db_get"] = template.DatabaseGet
-	pongo2.Globals["db_put"] = template.DatabasePut
+	for name, fn := range template.GlobalDatabase.Functions("db_") {
+		pongo2.Globals[name] = fn
+	}
+	for name, fn := range template.GlobalDatabase.Functions("db_global_") {
+		pongo2.Globals[name] = fn
+	}
 
 	// register tags
 	if err := pongo2.RegisterTag("lua", luatag.TagLuaParser); err != nil {
@@ -89,8 +92,8 @@ func filterSilence(_ *pongo2.Value, _ *pongo2.Value) (*pongo2.Value, *pongo2.Err
 	return pongo2.AsValue(nil), nil
 }
 
-func buildExecutionContext(matcher *zero.Matcher, event zero.Event, state zero.State, luaState *lua.LState) pongo2.Context {
-	return pongo2.Context{
+func buildExecutionContext(matcher *zero.Matcher, event zero.Event, state zero.State, exe *execution, namespace string) pongo2.Context {
+	ctx := pongo2.Context{
 		"matcher": matcher,
 		"state":   state,
 		"event": func() interface{} {
@@ -156,6 +159,6 @@ func buildExecutionContext(matcher *zero.Matcher, event zero.Event, state zero.S
 			}
 		},
 		"_event": &event,
-		"_lua":   luaState,
 	}
+	return ctx.Update(exe.Context(namespace))
 }
@@ -0,0 +1,497 @@
+package gypsum
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/yuudi/gypsum/gypsum/helper"
+)
+
+// TrashItem is a deleted item, it keeps its id so it can be restored in place
+type TrashItem struct {
+	ItemType  ItemType
+	ItemID    uint64
+	ItemBytes []byte
+	InGroup   uint64 // the group a child was in, 0 means the deleted group itself
+}
+
+// TrashEntry is saved under gypsum-trash- + item id when an item is deleted.
+// A group deleted with its items carries them as Children, including items in its subgroups.
+// A subgroup always comes before its items.
+type TrashEntry struct {
+	TrashItem
+	ParentGroup uint64
+	DeletedAt   time.Time
+	Children    []TrashItem
+}
+
+type trashInfo struct {
+	ItemID      uint64     `json:"item_id"`
+	ItemType    ItemType   `json:"item_type"`
+	DisplayName string     `json:"display_name"`
+	ParentGroup uint64     `json:"parent_group"`
+	DeletedAt   time.Time  `json:"deleted_at"`
+	ExpiresAt   *time.Time `json:"expires_at"`
+	Items       int        `json:"items"`
+}
+
+const defaultTrashRetentionDays = 30
+
+func (e *TrashEntry) ToBytes() ([]byte, error) {
+	buffer := bytes.Buffer{}
+	encoder := gob.NewEncoder(&buffer)
+	if err := encoder.Encode(e); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+func TrashEntryFromBytes(b []byte) (*TrashEntry, error) {
+	e := &TrashEntry{}
+	buffer := bytes.Buffer{}
+	buffer.Write(b)
+	decoder := gob.NewDecoder(&buffer)
+	err := decoder.Decode(e)
+	return e, err
+}
+
+func trashKey(id uint64) []byte {
+	return append([]byte("gypsum-trash-"), helper.U64ToBytes(id)...)
+}
+
+// trashRetention is how long a deleted item is kept, zero means forever
+func trashRetention() time.Duration {
+	days := defaultTrashRetentionDays
+	if Config != nil && Config.TrashRetentionDays != 0 {
+		days = Config.TrashRetentionDays
+	}
+	if days < 0 {
+		return 0
+	}
+	return time.Duration(days) * 24 * time.Hour
+}
+
+// trashRecord removes an item from database and returns it for a trash entry
+func (tx *transaction) trashRecord(itemType ItemType, id uint64, record UserRecord) (TrashItem, error) {
+	itemBytes, err := record.ToBytes()
+	if err != nil {
+		return TrashItem{}, err
+	}
+	if itemType == GroupItem {
+		tx.DeleteGroup(id)
+	} else {
+		tx.batch.Delete(itemKey(itemType, id))
+	}
+	if res, ok := record.(*Resource); ok {
+		// a trashed resource must not be found by its hash
+		if idx, ok := resourceIDByHash(res.Sha256Sum); ok && idx == id {
+			tx.batch.Delete(resourceHashKey(res.Sha256Sum))
+		}
+	}
+	return TrashItem{
+		ItemType:  itemType,
+		ItemID:    id,
+		ItemBytes: itemBytes,
+	}, nil
+}
+
+// trashGroupItems removes all items in a group from database, subgroups are removed along with their items.
+// The caller takes care of the group itself.
+func (tx *transaction) trashGroupItems(group *Group, visited map[uint64]bool) []TrashItem {
+	var children []TrashItem
+	for _, item := range group.Items {
+		it, ok := findItem(item.ItemType, item.ItemID)
+		if !ok {
+			log.Errorf("cannot find item: type:%s, id: %d", item.ItemType, item.ItemID)
+			continue
+		}
+		if item.ItemType == GroupItem && visited[item.ItemID] {
+			log.Errorf("group %d is in a cycle", item.ItemID)
+			continue
+		}
+		child, err := tx.trashRecord(item.ItemType, item.ItemID, it)
+		if err != nil {
+			log.Error(err)
+			continue
+		}
+		child.InGroup = it.GetParentID()
+		children = append(children, child)
+		if sub, ok := it.(*Group); ok {
+			visited[item.ItemID] = true
+			children = append(children, tx.trashGroupItems(sub, visited)...)
+			continue
+		}
+		item := item
+		tx.OnCommit(func() {
+			removeItem(item.ItemType, item.ItemID)
+		})
+	}
+	return children
+}
+
+// MoveToTrash deletes an item, along with children if it is a group deleted with its items.
+// The caller takes care of the parent group and the registry.
+func (tx *transaction) MoveToTrash(itemType ItemType, id uint64, record UserRecord, children []TrashItem) error {
+	item, err := tx.trashRecord(itemType, id, record)
+	if err != nil {
+		return err
+	}
+	v, err := (&TrashEntry{
+		TrashItem:   item,
+		ParentGroup: record.GetParentID(),
+		DeletedAt:   time.Now(),
+		Children:    children,
+	}).ToBytes()
+	if err != nil {
+		return err
+	}
+	tx.batch.Put(trashKey(id), v)
+	return nil
+}
+
+func loadTrashEntry(id uint64) (*TrashEntry, error) {
+	v, err := db.Get(trashKey(id))
+	if err != nil {
+		return nil, err
+	}
+	return TrashEntryFromBytes(v)
+}
+
+// trashEntries lists everything in trash
+func trashEntries() ([]*TrashEntry, error) {
+	iter := db.NewIterator([]byte("gypsum-trash-"))
+	defer iter.Release()
+	var entries []*TrashEntry
+	for iter.Next() {
+		e, err := TrashEntryFromBytes(iter.Value())
+		if err != nil {
+			log.Errorf("无法加载回收站项目%d：%s", helper.ToUint(iter.Key()[13:]), err)
+			continue
+		}
+		entries = append(entries, e)
+	}
+	return entries, iter.Error()
+}
+
+// trashedItemIDs lists ids of everything in trash, including items deleted along with a group
+func trashedItemIDs() (map[uint64]bool, error) {
+	entries, err := trashEntries()
+	if err != nil {
+		return nil, err
+	}
+	ids := make(map[uint64]bool)
+	for _, e := range entries {
+		for _, item := range append([]TrashItem{e.TrashItem}, e.Children...) {
+			ids[item.ItemID] = true
+		}
+	}
+	return ids, nil
+}
+
+// purgeTrash deletes trash entries forever, resource files no longer used by any item are removed.
+// The registry must be locked for writing.
+func purgeTrash(entries []*TrashEntry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	tx := newTransaction()
+	var files []string
+	for _, e := range entries {
+		tx.batch.Delete(trashKey(e.ItemID))
+		for _, item := range append([]TrashItem{e.TrashItem}, e.Children...) {
+			if err := tx.DeleteRevisions(item.ItemID); err != nil {
+				return err
+			}
+			if item.ItemType == ResourceItem {
+				if res, err := ResourceFromBytes(item.ItemBytes); err == nil {
+					files = append(files, res.Sha256Sum+res.Ext)
+				}
+			}
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	if len(files) == 0 {
+		return nil
+	}
+	inUse, err := resourceFilesInUse()
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		if inUse[file] {
+			continue
+		}
+		if err = os.Remove(path.Join(resDir, file)); err != nil && !os.IsNotExist(err) {
+			log.Errorf("error when removing resource file %s: %s", file, err)
+		}
+	}
+	return nil
+}
+
+// resourceFilesInUse lists resource files used by items and by the trash
+func resourceFilesInUse() (map[string]bool, error) {
+	inUse := make(map[string]bool)
+	for _, res := range registry.resources {
+		inUse[res.Sha256Sum+res.Ext] = true
+	}
+	entries, err := trashEntries()
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		for _, item := range append([]TrashItem{e.TrashItem}, e.Children...) {
+			if item.ItemType != ResourceItem {
+				continue
+			}
+			if res, err := ResourceFromBytes(item.ItemBytes); err == nil {
+				inUse[res.Sha256Sum+res.Ext] = true
+			}
+		}
+	}
+	return inUse, nil
+}
+
+// purgeExpiredTrash deletes trash entries older than the retention period
+func purgeExpiredTrash() {
+	retention := trashRetention()
+	if retention == 0 {
+		return
+	}
+	registry.Lock()
+	defer registry.Unlock()
+	entries, err := trashEntries()
+	if err != nil {
+		log.Errorf("读取回收站错误：%s", err)
+		return
+	}
+	var expired []*TrashEntry
+	for _, e := range entries {
+		if time.Since(e.DeletedAt) > retention {
+			expired = append(expired, e)
+		}
+	}
+	if err = purgeTrash(expired); err != nil {
+		log.Errorf("清理回收站错误：%s", err)
+		return
+	}
+	if len(expired) != 0 {
+		log.Infof("已从回收站中永久删除%d个过期项目", len(expired))
+	}
+}
+
+// initTrash purges expired items at startup and then every day
+func initTrash() {
+	purgeExpiredTrash()
+	if _, err := scheduler.AddFunc("@daily", purgeExpiredTrash); err != nil {
+		log.Errorf("无法设置回收站清理任务：%s", err)
+	}
+}
+
+// restoreTrashItem puts a trashed item back to database under its old id
+func (tx *transaction) restoreTrashItem(item TrashItem, parentID uint64) (UserRecord, error) {
+	record, err := itemFromBytes(item.ItemType, item.ItemBytes)
+	if err != nil {
+		return nil, err
+	}
+	setRecordParent(record, parentID)
+	if g, ok := record.(*Group); ok {
+		g.Items = []Item{}
+		tx.PutGroup(item.ItemID, g)
+		return record, nil
+	}
+	if err = record.SaveToBatch(tx.batch, item.ItemID); err != nil {
+		return nil, err
+	}
+	if res, ok := record.(*Resource); ok {
+		if _, exists := resourceIDByHash(res.Sha256Sum); !exists {
+			tx.batch.Put(resourceHashKey(res.Sha256Sum), helper.U64ToBytes(item.ItemID))
+		}
+	}
+	tx.OnCommit(func() {
+		replaceItem(item.ItemType, item.ItemID, record, true)
+	})
+	return record, nil
+}
+
+func getTrash(c *gin.Context) {
+	registry.RLock()
+	defer registry.RUnlock()
+	entries, err := trashEntries()
+	if err != nil {
+		c.JSON(500, gin.H{
+			"code":    3000,
+			"message": fmt.Sprintf("Server got itself into trouble: %s", err),
+		})
+		return
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].DeletedAt.After(entries[j].DeletedAt)
+	})
+	retention := trashRetention()
+	infos := make([]trashInfo, 0, len(entries))
+	for _, e := range entries {
+		info := trashInfo{
+			ItemID:      e.ItemID,
+			ItemType:    e.ItemType,
+			ParentGroup: e.ParentGroup,
+			DeletedAt:   e.DeletedAt,
+			Items:       len(e.Children),
+		}
+		if record, err := itemFromBytes(e.ItemType, e.ItemBytes); err == nil {
+			info.DisplayName = record.GetDisplayName()
+		}
+		if retention != 0 {
+			expiresAt := e.DeletedAt.Add(retention)
+			info.ExpiresAt = &expiresAt
+		}
+		infos = append(infos, info)
+	}
+	c.JSON(200, infos)
+}
+
+func restoreTrash(c *gin.Context) {
+	itemID, err := strconv.ParseUint(c.Param("iid"), 10, 64)
+	if err != nil {
+		c.JSON(404, gin.H{
+			"code":    1000,
+			"message": "no such item in trash",
+		})
+		return
+	}
+	registry.Lock()
+	defer registry.Unlock()
+	entry, err := loadTrashEntry(itemID)
+	if err != nil {
+		c.JSON(404, gin.H{
+			"code":    1000,
+			"message": "no such item in trash",
+		})
+		return
+	}
+	if _, exists := itemTypeByID(itemID); exists {
+		c.JSON(409, gin.H{
+			"code":    3030,
+			"message": fmt.Sprintf("item %d already exists", itemID),
+		})
+		return
+	}
+	tx := newTransaction()
+	// restore into the original parent, or the root group if it is gone
+	parentID := entry.ParentGroup
+	parentGroup, ok := tx.Group(parentID)
+	if !ok {
+		parentID = 0
+		parentGroup, _ = tx.Group(0)
+	}
+	record, err := tx.restoreTrashItem(entry.TrashItem, parentID)
+	if err != nil {
+		c.JSON(500, gin.H{
+			"code":    3000,
+			"message": fmt.Sprintf("Server got itself into trouble: %s", err),
+		})
+		return
+	}
+	parentGroup.Items = append(parentGroup.Items, Item{
+		ItemType:    entry.ItemType,
+		DisplayName: record.GetDisplayName(),
+		ItemID:      itemID,
+	})
+	for _, child := range entry.Children {
+		groupID := child.InGroup
+		if groupID == 0 {
+			groupID = itemID
+		}
+		group, ok := tx.Group(groupID)
+		if !ok {
+			log.Errorf("无法恢复%s %d：组%d不存在", child.ItemType, child.ItemID, groupID)
+			continue
+		}
+		childRecord, err := tx.restoreTrashItem(child, groupID)
+		if err != nil {
+			log.Errorf("无法恢复%s %d：%s", child.ItemType, child.ItemID, err)
+			continue
+		}
+		group.Items = append(group.Items, Item{
+			ItemType:    child.ItemType,
+			DisplayName: childRecord.GetDisplayName(),
+			ItemID:      child.ItemID,
+		})
+	}
+	tx.batch.Delete(trashKey(itemID))
+	if err = tx.Commit(); err != nil {
+		c.JSON(500, gin.H{
+			"code":    3000,
+			"message": fmt.Sprintf("Server got itself into trouble: %s", err),
+		})
+		return
+	}
+	c.JSON(200, gin.H{
+		"code":         0,
+		"message":      "ok",
+		"parent_group": parentID,
+	})
+}
+
+func purgeTrashItem(c *gin.Context) {
+	itemID, err := strconv.ParseUint(c.Param("iid"), 10, 64)
+	if err != nil {
+		c.JSON(404, gin.H{
+			"code":    1000,
+			"message": "no such item in trash",
+		})
+		return
+	}
+	registry.Lock()
+	defer registry.Unlock()
+	entry, err := loadTrashEntry(itemID)
+	if err != nil {
+		c.JSON(404, gin.H{
+			"code":    1000,
+			"message": "no such item in trash",
+		})
+		return
+	}
+	if err = purgeTrash([]*TrashEntry{entry}); err != nil {
+		c.JSON(500, gin.H{
+			"code":    3001,
+			"message": fmt.Sprintf("Server got itself into trouble: %s", err),
+		})
+		return
+	}
+	c.JSON(200, gin.H{
+		"code":    0,
+		"message": "deleted",
+	})
+}
+
+func emptyTrash(c *gin.Context) {
+	registry.Lock()
+	defer registry.Unlock()
+	entries, err := trashEntries()
+	if err == nil {
+		err = purgeTrash(entries)
+	}
+	if err != nil {
+		c.JSON(500, gin.H{
+			"code":    3001,
+			"message": fmt.Sprintf("Server got itself into trouble: %s", err),
+		})
+		return
+	}
+	c.JSON(200, gin.H{
+		"code":    0,
+		"message": "deleted",
+		"count":   len(entries),
+	})
+}
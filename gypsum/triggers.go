@@ -3,6 +3,7 @@ package gypsum
 import (
 	"bytes"
 	"encoding/gob"
+	"errors"
 	"fmt"
 	"strconv"
 	"strings"
@@ -10,39 +11,42 @@ import (
 	"github.com/flosch/pongo2"
 	"github.com/gin-gonic/gin"
 	log "github.com/sirupsen/logrus"
-	"github.com/syndtr/goleveldb/leveldb/util"
 	zero "github.com/wdvxdr1123/ZeroBot"
-	lua "github.com/yuin/gopher-lua"
 
 	"github.com/yuudi/gypsum/gypsum/helper"
+	"github.com/yuudi/gypsum/gypsum/outgoing"
+	"github.com/yuudi/gypsum/gypsum/storage"
 )
 
 type TriggerCategory int
 
 type Trigger struct {
-	DisplayName string   `json:"display_name"`
-	Active      bool     `json:"active"`
-	GroupsID    []int64  `json:"groups_id"`
-	UsersID     []int64  `json:"users_id"`
-	TriggerType []string `json:"trigger_type"`
-	Response    string   `json:"response"`
-	Priority    int      `json:"priority"`
-	Block       bool     `json:"block"`
-	ParentGroup uint64   `json:"-"`
+	DisplayName      string          `json:"display_name" yaml:"display_name"`
+	Active           bool            `json:"active" yaml:"active"`
+	GroupsID         []int64         `json:"groups_id" yaml:"groups_id"`
+	UsersID          []int64         `json:"users_id" yaml:"users_id"`
+	ExcludedGroupsID []int64         `json:"excluded_groups_id" yaml:"excluded_groups_id"`
+	ExcludedUsersID  []int64         `json:"excluded_users_id" yaml:"excluded_users_id"`
+	Roles            []string        `json:"roles" yaml:"roles"`
+	Window           ActiveWindow    `json:"window" yaml:"window"`
+	Probability      float64         `json:"probability" yaml:"probability"`
+	TriggerType      []string        `json:"trigger_type" yaml:"trigger_type"`
+	Response         string          `json:"response" yaml:"response"`
+	Priority         int             `json:"priority" yaml:"priority"`
+	Overrides        FilterOverrides `json:"overrides" yaml:"overrides,omitempty"`
+	Block            bool            `json:"block" yaml:"block"`
+	Limits           ExecutionLimits `json:"limits" yaml:"limits"`
+	Cooldown         Cooldown        `json:"cooldown" yaml:"cooldown"`
+	ParentGroup      uint64          `json:"-" yaml:"-"`
 }
 
-var (
-	triggers    map[uint64]*Trigger
-	zeroTrigger map[uint64]*zero.Matcher
-)
-
 func (t *Trigger) ToBytes() ([]byte, error) {
 	buffer := bytes.Buffer{}
 	encoder := gob.NewEncoder(&buffer)
 	if err := encoder.Encode(t); err != nil {
 		return nil, err
 	}
-	return buffer.Bytes(), nil
+	return sealRecord(TriggerItem, buffer.Bytes()), nil
 }
 
 func TriggerFromByte(b []byte) (*Trigger, error) {
@@ -51,10 +55,14 @@ func TriggerFromByte(b []byte) (*Trigger, error) {
 		UsersID:     []int64{},
 		TriggerType: []string{},
 	}
+	payload, err := openRecord(TriggerItem, b)
+	if err != nil {
+		return t, err
+	}
 	buffer := bytes.Buffer{}
-	buffer.Write(b)
+	buffer.Write(payload)
 	decoder := gob.NewDecoder(&buffer)
-	err := decoder.Decode(t)
+	err = decoder.Decode(t)
 	return t, err
 }
 
@@ -82,28 +90,105 @@ func noticeRule(noticeTypeCas []string) zero.Rule {
 }
 
 func (t *Trigger) Register(id uint64) error {
-	if !t.Active {
-		return nil
+	matcher, err := t.newMatcher(id)
+	if err != nil {
+		return err
+	}
+	if matcher != nil {
+		registry.zeroTrigger[id] = zero.StoreMatcher(matcher)
+	}
+	return nil
+}
+
+// check validates a trigger from a request or a manifest, code is the error code of api
+func (t *Trigger) check() (int, error) {
+	if len(t.TriggerType) < 1 || len(t.TriggerType) > 2 {
+		return 2042, errors.New("trigger_type must have 1 or 2 elements")
+	}
+	if err := checkTemplate(t.Response); err != nil {
+		return 2041, errors.New(fmt.Sprintf("template error: %s", err))
+	}
+	if err := t.Limits.check(); err != nil {
+		return 2043, errors.New(fmt.Sprintf("limits error: %s", err))
+	}
+	if err := t.Cooldown.check(); err != nil {
+		return 2044, errors.New(fmt.Sprintf("cooldown error: %s", err))
+	}
+	if err := checkRoles(t.Roles); err != nil {
+		return 2045, errors.New(fmt.Sprintf("roles error: %s", err))
+	}
+	if err := t.Window.check(); err != nil {
+		return 2046, errors.New(fmt.Sprintf("window error: %s", err))
+	}
+	if err := checkProbability(t.Probability); err != nil {
+		return 2047, errors.New(fmt.Sprintf("probability error: %s", err))
+	}
+	if err := t.ownFilters().check(); err != nil {
+		return 2049, errors.New(fmt.Sprintf("filters error: %s", err))
+	}
+	return 0, nil
+}
+
+// newMatcher builds the matcher of the trigger without registering it, nil if the trigger is not effective
+func (t *Trigger) newMatcher(id uint64) (*zero.Matcher, error) {
+	if !t.Active || !groupEffective(t.ParentGroup) {
+		return nil, nil
 	}
 	tmpl, err := pongo2.FromString(t.Response)
 	if err != nil {
 		log.Errorf("模板预处理出错：%s", err)
-		return err
+		return nil, err
 	}
-	zeroTrigger[id] = zero.OnNotice(noticeRule(t.TriggerType), groupsRule(t.GroupsID), usersRule(t.UsersID)).SetPriority(t.Priority).SetBlock(t.Block).Handle(templateTriggerHandler(*tmpl, zero.Send, log.Error))
-	return nil
+	filters := t.filters()
+	rules := []zero.Rule{noticeRule(t.TriggerType), groupsRule(filters.GroupsID), usersRule(filters.UsersID)}
+	if len(t.ExcludedGroupsID) != 0 {
+		rules = append(rules, excludedGroupsRule(t.ExcludedGroupsID))
+	}
+	if len(t.ExcludedUsersID) != 0 {
+		rules = append(rules, excludedUsersRule(t.ExcludedUsersID))
+	}
+	if len(t.Roles) != 0 {
+		rules = append(rules, rolesRule(t.Roles))
+	}
+	if t.Window.enabled() {
+		windowRule, err := t.Window.rule()
+		if err != nil {
+			log.Errorf("无法创建时间窗口：%s", err)
+			return nil, err
+		}
+		rules = append(rules, windowRule)
+	}
+	if t.Probability < 1 {
+		rules = append(rules, probabilityRule(t.Probability))
+	}
+	item := fmt.Sprintf("%s %d", TriggerItem, id)
+	newHandler := func(tmpl pongo2.Template) zero.Handler {
+		return templateTriggerHandler(tmpl, item, t.Limits, itemNamespace(TriggerItem, id), outgoing.Send, log.Error)
+	}
+	handler := newHandler(*tmpl)
+	if t.Cooldown.enabled() {
+		rules = append(rules, t.Cooldown.rule(item))
+		if handler, err = t.Cooldown.handler(handler, newHandler); err != nil {
+			log.Errorf("模板预处理出错：%s", err)
+			return nil, err
+		}
+	}
+	return &zero.Matcher{
+		State:    zero.State{},
+		Type:     zero.Type("notice"),
+		Rules:    rules,
+		Priority: filters.Priority,
+		Block:    t.Block,
+		Handler:  handler,
+	}, nil
 }
 
-func templateTriggerHandler(tmpl pongo2.Template, send func(event zero.Event, msg interface{}) int64, errLogger func(...interface{})) zero.Handler {
+func templateTriggerHandler(tmpl pongo2.Template, item string, limits ExecutionLimits, namespace func() string, send func(event zero.Event, msg interface{}) int64, errLogger func(...interface{})) zero.Handler {
 	return func(matcher *zero.Matcher, event zero.Event, state zero.State) zero.Response {
-		var luaState *lua.LState
-		defer func() {
-			if luaState != nil {
-				luaState.Close()
-			}
-		}()
-		reply, err := tmpl.Execute(buildExecutionContext(matcher, event, state, luaState))
-		if err != nil {
+		exe := newExecution(item, limits)
+		defer exe.Close()
+		reply, err := tmpl.Execute(buildExecutionContext(matcher, event, state, exe, namespace()))
+		if err = exe.Check(err); err != nil {
 			errLogger("渲染模板出错：" + err.Error())
 			return zero.FinishResponse
 		}
@@ -115,10 +200,8 @@ func templateTriggerHandler(tmpl pongo2.Template, send func(event zero.Event, ms
 	}
 }
 
-func loadTriggers() {
-	triggers = make(map[uint64]*Trigger)
-	zeroTrigger = make(map[uint64]*zero.Matcher)
-	iter := db.NewIterator(util.BytesPrefix([]byte("gypsum-triggers-")), nil)
+func loadTriggers(register bool) {
+	iter := db.NewIterator([]byte("gypsum-triggers-"))
 	defer func() {
 		iter.Release()
 		if err := iter.Error(); err != nil {
@@ -133,7 +216,10 @@ func loadTriggers() {
 			log.Errorf("无法加载规则%d：%s", key, e)
 			continue
 		}
-		triggers[key] = t
+		registry.triggers[key] = t
+		if !register {
+			continue
+		}
 		if e := t.Register(key); e != nil {
 			log.Errorf("无法注册规则%d：%s", key, e)
 			continue
@@ -149,29 +235,48 @@ func (t *Trigger) GetDisplayName() string {
 	return t.DisplayName
 }
 
+func triggerKey(idx uint64) []byte {
+	return append([]byte("gypsum-triggers-"), helper.U64ToBytes(idx)...)
+}
+
 func (t *Trigger) SaveToDB(idx uint64) error {
 	v, err := t.ToBytes()
 	if err != nil {
 		return err
 	}
-	return db.Put(append([]byte("gypsum-triggers-"), helper.U64ToBytes(idx)...), v, nil)
+	return db.Put(triggerKey(idx), v)
 }
 
-func (t *Trigger) NewParent(selfID, parentID uint64) error {
-	t.ParentGroup = parentID
+func (t *Trigger) SaveToBatch(batch *storage.Batch, idx uint64) error {
 	v, err := t.ToBytes()
 	if err != nil {
 		return err
 	}
-	err = db.Put(append([]byte("gypsum-triggers-"), helper.U64ToBytes(selfID)...), v, nil)
-	return err
+	batch.Put(triggerKey(idx), v)
+	return nil
+}
+
+func (t *Trigger) NewParent(tx *transaction, selfID, parentID uint64) error {
+	moved := *t
+	moved.ParentGroup = parentID
+	if err := moved.SaveToBatch(tx.batch, selfID); err != nil {
+		return err
+	}
+	tx.OnCommit(func() {
+		t.ParentGroup = parentID
+	})
+	return nil
 }
 
 func getTriggers(c *gin.Context) {
-	c.JSON(200, triggers)
+	registry.RLock()
+	defer registry.RUnlock()
+	c.JSON(200, registry.triggers)
 }
 
 func getTriggerByID(c *gin.Context) {
+	registry.RLock()
+	defer registry.RUnlock()
 	triggerIDStr := c.Param("tid")
 	triggerID, err := strconv.ParseUint(triggerIDStr, 10, 64)
 	if err != nil {
@@ -180,7 +285,7 @@ func getTriggerByID(c *gin.Context) {
 			"message": "no such trigger",
 		})
 	} else {
-		t, ok := triggers[triggerID]
+		t, ok := registry.triggers[triggerID]
 		if ok {
 			c.JSON(200, t)
 		} else {
@@ -193,7 +298,7 @@ func getTriggerByID(c *gin.Context) {
 }
 
 func createTrigger(c *gin.Context) {
-	var trigger Trigger
+	trigger := Trigger{Probability: 1}
 	if err := c.BindJSON(&trigger); err != nil {
 		c.JSON(400, gin.H{
 			"code":    2000,
@@ -216,7 +321,10 @@ func createTrigger(c *gin.Context) {
 			return
 		}
 	}
-	parentGroup, ok := groups[parentID]
+	registry.Lock()
+	defer registry.Unlock()
+	tx := newTransaction()
+	parentGroup, ok := tx.Group(parentID)
 	if !ok {
 		c.JSON(404, gin.H{
 			"code":    1000,
@@ -227,66 +335,50 @@ func createTrigger(c *gin.Context) {
 
 	trigger.ParentGroup = parentID
 	// syntax check
-	if len(trigger.TriggerType) < 1 || len(trigger.TriggerType) > 2 {
+	if code, err := trigger.check(); err != nil {
 		c.JSON(422, gin.H{
-			"code":    2042,
-			"message": "trigger_type must have 1 or 2 elements",
+			"code":    code,
+			"message": err.Error(),
 		})
 		return
 	}
-	if err := checkTemplate(trigger.Response); err != nil {
-		c.JSON(422, gin.H{
-			"code":    2041,
-			"message": fmt.Sprintf("template error: %s", err),
+	// build the matcher before saving, so that a broken trigger is never stored
+	cursor := tx.NewItemID()
+	matcher, err := trigger.newMatcher(cursor)
+	if err != nil {
+		c.JSON(400, gin.H{
+			"code":    2001,
+			"message": fmt.Sprintf("trigger error: %s", err),
 		})
 		return
 	}
 	//save
-	itemCursor++
-	cursor := itemCursor
 	parentGroup.Items = append(parentGroup.Items, Item{
 		ItemType:    TriggerItem,
 		DisplayName: trigger.DisplayName,
 		ItemID:      cursor,
 	})
-	if err := parentGroup.SaveToDB(parentID); err != nil {
-		log.Error(err)
-		c.JSON(500, gin.H{
-			"code":    3000,
-			"message": fmt.Sprintf("Server got itself into trouble: %s", err),
-		})
-		return
-	}
-	if err := db.Put([]byte("gypsum-$meta-cursor"), helper.U64ToBytes(cursor), nil); err != nil {
-		c.JSON(500, gin.H{
-			"code":    3000,
-			"message": fmt.Sprintf("Server got itself into trouble: %s", err),
-		})
-		return
-	}
-	v, err := trigger.ToBytes()
-	if err != nil {
+	if err := trigger.SaveToBatch(tx.batch, cursor); err != nil {
 		c.JSON(400, gin.H{
 			"code":    2000,
 			"message": fmt.Sprintf("converting error: %s", err),
 		})
 		return
 	}
-	if err := trigger.Register(cursor); err != nil {
-		c.JSON(400, gin.H{
-			"code":    2001,
-			"message": fmt.Sprintf("trigger error: %s", err),
-		})
-		return
-	}
-	if err := db.Put(append([]byte("gypsum-triggers-"), helper.U64ToBytes(cursor)...), v, nil); err != nil {
+	tx.OnCommit(func() {
+		registry.triggers[cursor] = &trigger
+		if matcher != nil {
+			registry.zeroTrigger[cursor] = zero.StoreMatcher(matcher)
+		}
+	})
+	if err := tx.Commit(); err != nil {
+		log.Error(err)
 		c.JSON(500, gin.H{
 			"code":    3000,
 			"message": fmt.Sprintf("Server got itself into trouble: %s", err),
 		})
 		return
 	}
-	triggers[cursor] = &trigger
 	c.JSON(201, gin.H{
 		"code":       0,
 		"message":    "ok",
@@ -305,7 +397,9 @@ func deleteTrigger(c *gin.Context) {
 		})
 		return
 	}
-	oldTrigger, ok := triggers[triggerID]
+	registry.Lock()
+	defer registry.Unlock()
+	oldTrigger, ok := registry.triggers[triggerID]
 	if !ok {
 		c.JSON(404, gin.H{
 			"code":    1000,
@@ -314,22 +408,33 @@ func deleteTrigger(c *gin.Context) {
 		return
 	}
 
+	tx := newTransaction()
 	// remove self from parent
-	if err := DeleteFromParent(oldTrigger.ParentGroup, triggerID); err != nil {
+	if err := DeleteFromParent(tx, oldTrigger.ParentGroup, triggerID); err != nil {
 		log.Errorf("error when delete group %d from parent group %d: %s", triggerID, oldTrigger.ParentGroup, err)
 	}
 
-	// remove self from database
-	delete(triggers, triggerID)
-	if err := db.Delete(append([]byte("gypsum-triggers-"), helper.U64ToBytes(triggerID)...), nil); err != nil {
+	// move self into trash
+	if err := tx.MoveToTrash(TriggerItem, triggerID, oldTrigger, nil); err != nil {
+		c.JSON(500, gin.H{
+			"code":    3001,
+			"message": fmt.Sprintf("Server got itself into trouble: %s", err),
+		})
+		return
+	}
+	tx.OnCommit(func() {
+		delete(registry.triggers, triggerID)
+	})
+	if err := tx.Commit(); err != nil {
 		c.JSON(500, gin.H{
 			"code":    3001,
 			"message": fmt.Sprintf("Server got itself into trouble: %s", err),
 		})
 		return
 	}
-	if oldTrigger.Active {
-		zeroTrigger[triggerID].Delete()
+	if matcher, ok := registry.zeroTrigger[triggerID]; ok {
+		matcher.Delete()
+		delete(registry.zeroTrigger, triggerID)
 	}
 	c.JSON(200, gin.H{
 		"code":    0,
@@ -348,7 +453,9 @@ func modifyTrigger(c *gin.Context) {
 		})
 		return
 	}
-	oldTrigger, ok := triggers[triggerID]
+	registry.Lock()
+	defer registry.Unlock()
+	oldTrigger, ok := registry.triggers[triggerID]
 	if !ok {
 		c.JSON(404, gin.H{
 			"code":    100,
@@ -356,7 +463,7 @@ func modifyTrigger(c *gin.Context) {
 		})
 		return
 	}
-	var newTrigger Trigger
+	newTrigger := Trigger{Probability: 1}
 	if err := c.BindJSON(&newTrigger); err != nil {
 		c.JSON(400, gin.H{
 			"code":    2000,
@@ -365,52 +472,53 @@ func modifyTrigger(c *gin.Context) {
 		return
 	}
 	// check syntax
-	if len(newTrigger.TriggerType) < 1 || len(newTrigger.TriggerType) > 2 {
+	if code, err := newTrigger.check(); err != nil {
 		c.JSON(422, gin.H{
-			"code":    2042,
-			"message": "trigger_type must have 1 or 2 elements",
+			"code":    code,
+			"message": err.Error(),
 		})
 		return
 	}
-	if err := checkTemplate(newTrigger.Response); err != nil {
-		c.JSON(422, gin.H{
-			"code":    2041,
-			"message": fmt.Sprintf("template error: %s", err),
-		})
-		return
-	}
-	oldMatcher, ok := zeroTrigger[triggerID]
 	newTrigger.ParentGroup = oldTrigger.ParentGroup
-	if oldTrigger.Active {
-		if !ok {
-			c.JSON(500, gin.H{
-				"code":    7012,
-				"message": "error when delete old rule: matcher not found",
-			})
-			return
-		}
-		oldMatcher.Delete()
-	}
-	if err := newTrigger.Register(triggerID); err != nil {
+	// build the matcher before saving, so that a failed edit keeps the old trigger working
+	matcher, err := newTrigger.newMatcher(triggerID)
+	if err != nil {
 		c.JSON(400, gin.H{
 			"code":    2001,
 			"message": fmt.Sprintf("trigger error: %s", err),
 		})
 		return
 	}
-	if err := newTrigger.SaveToDB(triggerID); err != nil {
-		c.JSON(500, gin.H{
-			"code":    3002,
-			"message": fmt.Sprintf("Server got itself into trouble: %s", err),
+	tx := newTransaction()
+	if err := tx.SaveRevision(TriggerItem, triggerID, oldTrigger); err != nil {
+		log.Errorf("error when saving revision of trigger %d: %s", triggerID, err)
+	}
+	if err := newTrigger.SaveToBatch(tx.batch, triggerID); err != nil {
+		c.JSON(400, gin.H{
+			"code":    2000,
+			"message": fmt.Sprintf("converting error: %s", err),
 		})
 		return
 	}
-	triggers[triggerID] = &newTrigger
 	if newTrigger.DisplayName != oldTrigger.DisplayName {
-		if err = ChangeNameForParent(newTrigger.ParentGroup, triggerID, newTrigger.DisplayName); err != nil {
+		if err = ChangeNameForParent(tx, newTrigger.ParentGroup, triggerID, newTrigger.DisplayName); err != nil {
 			log.Errorf("error when change trigger %d from parent group %d: %s", triggerID, newTrigger.ParentGroup, err)
 		}
 	}
+	tx.OnCommit(func() {
+		registry.triggers[triggerID] = &newTrigger
+		unregisterItem(TriggerItem, triggerID)
+		if matcher != nil {
+			registry.zeroTrigger[triggerID] = zero.StoreMatcher(matcher)
+		}
+	})
+	if err := tx.Commit(); err != nil {
+		c.JSON(500, gin.H{
+			"code":    3002,
+			"message": fmt.Sprintf("Server got itself into trouble: %s", err),
+		})
+		return
+	}
 	c.JSON(200, gin.H{
 		"code":    0,
 		"message": "ok",
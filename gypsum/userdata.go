@@ -0,0 +1,566 @@
+package gypsum
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/yuudi/gypsum/gypsum/helper"
+	"github.com/yuudi/gypsum/gypsum/luatag"
+	"github.com/yuudi/gypsum/gypsum/storage"
+	"github.com/yuudi/gypsum/gypsum/userdata"
+)
+
+// ArchiveUserData is a key saved by a plugin, kept in plugin archive without its namespace
+type ArchiveUserData struct {
+	Store userdata.Store
+	Key   []byte
+	Value []byte
+}
+
+// pluginNamespace is the namespace of user data for items in the group.
+// Items in a plugin group (or any group inside it) use the plugin name, other items use the global namespace.
+// The registry must be locked for reading.
+func pluginNamespace(gid uint64) string {
+	for depth := 0; depth <= len(registry.groups); depth++ {
+		g, ok := registry.groups[gid]
+		if !ok {
+			break
+		}
+		if g.PluginName != "" {
+			return g.PluginName
+		}
+		if gid == 0 {
+			break
+		}
+		gid = g.ParentGroup
+	}
+	return userdata.Global
+}
+
+// itemNamespace finds the namespace of an item each time it is executed, since the item may be moved
+func itemNamespace(itemType ItemType, id uint64) func() string {
+	return func() string {
+		registry.RLock()
+		defer registry.RUnlock()
+		item, ok := findItem(itemType, id)
+		if !ok {
+			return userdata.Global
+		}
+		return pluginNamespace(item.GetParentID())
+	}
+}
+
+func globalNamespace() string {
+	return userdata.Global
+}
+
+// pluginUserData collects all keys in the namespace of a plugin
+func pluginUserData(namespace string) ([]ArchiveUserData, error) {
+	var data []ArchiveUserData
+	prefix := userdata.DataStore.Prefix(namespace)
+	iter := db.NewIterator(prefix)
+	defer iter.Release()
+	for iter.Next() {
+		data = append(data, ArchiveUserData{
+			Store: userdata.DataStore,
+			Key:   append([]byte{}, iter.Key()[len(prefix):]...),
+			Value: append([]byte{}, iter.Value()...),
+		})
+	}
+	return data, iter.Error()
+}
+
+// restorePluginUserData writes data from a plugin archive into the namespace, keys already existing are kept.
+// Lua data in archives exported before lua shared DataStore is converted.
+func (tx *transaction) restorePluginUserData(namespace string, data []ArchiveUserData) error {
+	for _, d := range data {
+		value := d.Value
+		switch d.Store {
+		case userdata.DataStore:
+		case userdata.LegacyLuaStore:
+			converted, err := userdata.ConvertToJSON(d.Value, luatag.DecodeLegacyValue)
+			if err != nil {
+				log.Warnf("无法转换插件%s中lua数据%q：%s", namespace, d.Key, err)
+				continue
+			}
+			value = converted
+		default:
+			continue
+		}
+		key := userdata.DataStore.Key(namespace, d.Key)
+		exists, err := db.Has(key)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			tx.batch.Put(key, value)
+		}
+	}
+	return nil
+}
+
+// migrateLegacyLuaUserData moves keys saved by lua before lua shared DataStore, values are converted into JSON.
+// A key also existing in DataStore is kept in the legacy store and reported as failure.
+// The moved keys are put into moved, by their new keys.
+func migrateLegacyLuaUserData(report *MigrationReport, batch *storage.Batch, dryRun bool, moved map[string][]byte) error {
+	legacyRoot := userdata.LegacyLuaStore.Root()
+	iter := db.NewIterator(legacyRoot)
+	defer iter.Release()
+	for iter.Next() {
+		report.Scanned++
+		legacyKey := append([]byte{}, iter.Key()...)
+		key := append(userdata.DataStore.Root(), legacyKey[len(legacyRoot):]...)
+		exists, err := db.Has(key)
+		if err != nil {
+			return err
+		}
+		if exists {
+			report.Failures = append(report.Failures, fmt.Sprintf("lua userdata %q: key already exists in shared userdata, kept unchanged", legacyKey))
+			continue
+		}
+		converted, err := userdata.ConvertToJSON(iter.Value(), luatag.DecodeLegacyValue)
+		if err != nil {
+			report.Failures = append(report.Failures, fmt.Sprintf("lua userdata %q: %s", legacyKey, err))
+			continue
+		}
+		report.Upgraded++
+		report.MovedUserData++
+		moved[string(key)] = converted
+		if !dryRun {
+			batch.Put(key, converted)
+			batch.Delete(legacyKey)
+		}
+	}
+	return iter.Error()
+}
+
+// metaScopedUserDataKey is saved once global user data has been copied into the namespaces of plugins
+var metaScopedUserDataKey = []byte("gypsum-$meta-userdata-scoped")
+
+// migratePluginUserData runs once when upgrading from a version where plugins shared the global namespace.
+// Which plugin wrote which key is not known, so every plugin gets a copy of all global keys, keys already in its namespace are kept.
+// Global keys stay where they are, for items outside plugins and for db_global_get.
+// Keys just moved from legacy lua store are in moved.
+func migratePluginUserData(report *MigrationReport, batch *storage.Batch, dryRun bool, moved map[string][]byte) error {
+	done, err := db.Has(metaScopedUserDataKey)
+	if err != nil || done {
+		return err
+	}
+	plugins, err := pluginNames()
+	if err != nil {
+		return err
+	}
+	if len(plugins) != 0 {
+		globalPrefix := userdata.DataStore.Prefix(userdata.Global)
+		global := make(map[string][]byte)
+		iter := db.NewIterator(globalPrefix)
+		for iter.Next() {
+			global[string(iter.Key()[len(globalPrefix):])] = append([]byte{}, iter.Value()...)
+		}
+		iter.Release()
+		if err := iter.Error(); err != nil {
+			return err
+		}
+		for key, value := range moved {
+			if strings.HasPrefix(key, string(globalPrefix)) {
+				global[key[len(globalPrefix):]] = value
+			}
+		}
+		for _, plugin := range plugins {
+			copied := 0
+			for key, value := range global {
+				pluginKey := userdata.DataStore.Key(plugin, []byte(key))
+				if _, ok := moved[string(pluginKey)]; ok {
+					continue
+				}
+				exists, err := db.Has(pluginKey)
+				if err != nil {
+					return err
+				}
+				if exists {
+					continue
+				}
+				copied++
+				if !dryRun {
+					batch.Put(pluginKey, value)
+				}
+			}
+			if copied != 0 {
+				report.CopiedUserData = append(report.CopiedUserData, PluginUserDataCopy{
+					Plugin: plugin,
+					Keys:   copied,
+				})
+			}
+		}
+	}
+	if !dryRun {
+		batch.Put(metaScopedUserDataKey, []byte{1})
+	}
+	return nil
+}
+
+// pluginNames lists the plugin names of all saved groups, sorted
+func pluginNames() ([]string, error) {
+	names := make(map[string]bool)
+	iter := db.NewIterator([]byte("gypsum-groups-"))
+	defer iter.Release()
+	for iter.Next() {
+		g, err := GroupFromBytes(iter.Value())
+		if err != nil {
+			// reported when migrating records
+			continue
+		}
+		if g.PluginName != "" {
+			names[g.PluginName] = true
+		}
+	}
+	if err := iter.Error(); err != nil {
+		return nil, err
+	}
+	plugins := make([]string, 0, len(names))
+	for name := range names {
+		plugins = append(plugins, name)
+	}
+	sort.Strings(plugins)
+	return plugins, nil
+}
+
+func purgeExpiredUserData() {
+	count, err := userdata.PurgeExpired()
+	if err != nil {
+		log.Errorf("清理过期数据出错：%s", err)
+	}
+	if count != 0 {
+		log.Infof("已清理%d条过期数据", count)
+	}
+}
+
+// initUserData purges expired keys at startup and then every day, expired keys are also ignored when read
+func initUserData() {
+	purgeExpiredUserData()
+	if _, err := scheduler.AddFunc("@daily", purgeExpiredUserData); err != nil {
+		log.Errorf("无法设置过期数据清理任务：%s", err)
+	}
+}
+
+// userDataEntry is a key of user data in api, key_type tells how the key is written:
+// "string" for string keys, "int" for integer keys written by templates, "hex" for any other binary key
+type userDataEntry struct {
+	Namespace string      `json:"namespace"`
+	Key       string      `json:"key"`
+	KeyType   string      `json:"key_type"`
+	Value     interface{} `json:"value"`
+	ExpiresAt *time.Time  `json:"expires_at"`
+	Error     string      `json:"error,omitempty"`
+}
+
+func userDataKey(key, keyType string) ([]byte, error) {
+	switch keyType {
+	case "", "string":
+		return []byte(key), nil
+	case "int":
+		i, err := strconv.ParseInt(key, 10, 64)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("invalid int key %q", key))
+		}
+		return helper.U64ToBytes(uint64(i)), nil
+	case "hex":
+		b, err := hex.DecodeString(key)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("invalid hex key %q", key))
+		}
+		return b, nil
+	default:
+		return nil, errors.New(fmt.Sprintf("unknown key type %q", keyType))
+	}
+}
+
+func formatUserDataKey(key []byte) (string, string) {
+	if utf8.Valid(key) && strings.IndexFunc(string(key), func(r rune) bool { return r < 0x20 }) < 0 {
+		return string(key), "string"
+	}
+	if len(key) == 8 {
+		return strconv.FormatInt(int64(helper.ToUint(key)), 10), "int"
+	}
+	return hex.EncodeToString(key), "hex"
+}
+
+func newUserDataEntry(namespace string, key []byte, v *userdata.Value) userDataEntry {
+	entry := userDataEntry{Namespace: namespace}
+	entry.Key, entry.KeyType = formatUserDataKey(key)
+	if !v.ExpiresAt.IsZero() {
+		expiresAt := v.ExpiresAt
+		entry.ExpiresAt = &expiresAt
+	}
+	value, err := userdata.DecodeValue(v)
+	if err != nil {
+		entry.Error = err.Error()
+	} else {
+		entry.Value = value
+	}
+	return entry
+}
+
+func getUserDataNamespaces(c *gin.Context) {
+	namespaces, err := userdata.DataStore.Namespaces()
+	if err != nil {
+		c.JSON(500, gin.H{
+			"code":    3000,
+			"message": fmt.Sprintf("Server got itself into trouble: %s", err),
+		})
+		return
+	}
+	if namespaces == nil {
+		namespaces = []userdata.NamespaceInfo{}
+	}
+	c.JSON(200, namespaces)
+}
+
+func listUserData(c *gin.Context) {
+	namespace := c.Query("namespace")
+	limit := 0
+	if limitStr := c.Query("limit"); limitStr != "" {
+		var err error
+		if limit, err = strconv.Atoi(limitStr); err != nil || limit < 0 {
+			c.JSON(400, gin.H{
+				"code":    2000,
+				"message": fmt.Sprintf("invalid limit %q", limitStr),
+			})
+			return
+		}
+	}
+	entries, err := userdata.DataStore.List(namespace, []byte(c.Query("prefix")), limit)
+	if err != nil {
+		c.JSON(500, gin.H{
+			"code":    3000,
+			"message": fmt.Sprintf("Server got itself into trouble: %s", err),
+		})
+		return
+	}
+	list := make([]userDataEntry, 0, len(entries))
+	for _, e := range entries {
+		list = append(list, newUserDataEntry(namespace, e.Key, e.Value))
+	}
+	c.JSON(200, list)
+}
+
+func getUserDataValue(c *gin.Context) {
+	namespace := c.Query("namespace")
+	key, err := userDataKey(c.Query("key"), c.Query("key_type"))
+	if err != nil {
+		c.JSON(400, gin.H{
+			"code":    2000,
+			"message": err.Error(),
+		})
+		return
+	}
+	v, err := userdata.DataStore.Get(namespace, key)
+	if err == storage.ErrNotFound {
+		c.JSON(404, gin.H{
+			"code":    1000,
+			"message": "no such key",
+		})
+		return
+	} else if err != nil {
+		c.JSON(500, gin.H{
+			"code":    3000,
+			"message": fmt.Sprintf("Server got itself into trouble: %s", err),
+		})
+		return
+	}
+	c.JSON(200, newUserDataEntry(namespace, key, v))
+}
+
+// bindJSONNumbers decodes the request body with numbers kept as json.Number, so large integers in values stay exact
+func bindJSONNumbers(c *gin.Context, obj interface{}) error {
+	decoder := json.NewDecoder(c.Request.Body)
+	decoder.UseNumber()
+	return decoder.Decode(obj)
+}
+
+type userDataPatch struct {
+	Namespace string      `json:"namespace"`
+	Key       string      `json:"key"`
+	KeyType   string      `json:"key_type"`
+	Value     interface{} `json:"value"`
+	TTL       int64       `json:"ttl"`
+}
+
+func putUserDataValue(c *gin.Context) {
+	var patch userDataPatch
+	if err := bindJSONNumbers(c, &patch); err != nil {
+		c.JSON(400, gin.H{
+			"code":    2000,
+			"message": fmt.Sprintf("converting error: %s", err),
+		})
+		return
+	}
+	key, err := userDataKey(patch.Key, patch.KeyType)
+	if err != nil {
+		c.JSON(400, gin.H{
+			"code":    2000,
+			"message": err.Error(),
+		})
+		return
+	}
+	if err := userdata.DataStore.PutValue(patch.Namespace, key, patch.Value, time.Duration(patch.TTL)*time.Second); err != nil {
+		c.JSON(500, gin.H{
+			"code":    3000,
+			"message": fmt.Sprintf("Server got itself into trouble: %s", err),
+		})
+		return
+	}
+	c.JSON(200, gin.H{
+		"code":    0,
+		"message": "ok",
+	})
+}
+
+func deleteUserDataValue(c *gin.Context) {
+	key, err := userDataKey(c.Query("key"), c.Query("key_type"))
+	if err != nil {
+		c.JSON(400, gin.H{
+			"code":    2000,
+			"message": err.Error(),
+		})
+		return
+	}
+	if err := userdata.DataStore.Delete(c.Query("namespace"), key); err != nil {
+		c.JSON(500, gin.H{
+			"code":    3000,
+			"message": fmt.Sprintf("Server got itself into trouble: %s", err),
+		})
+		return
+	}
+	c.JSON(200, gin.H{
+		"code":    0,
+		"message": "ok",
+	})
+}
+
+// UserDataExport is the json file of exported user data
+type UserDataExport struct {
+	ExportedAt time.Time       `json:"exported_at"`
+	Entries    []userDataEntry `json:"entries"`
+}
+
+// exportUserData exports the namespace given by query, or all namespaces if not given
+func exportUserData(c *gin.Context) {
+	var namespaces []string
+	if namespace, ok := c.GetQuery("namespace"); ok {
+		namespaces = []string{namespace}
+	} else {
+		infos, err := userdata.DataStore.Namespaces()
+		if err != nil {
+			c.JSON(500, gin.H{
+				"code":    3000,
+				"message": fmt.Sprintf("Server got itself into trouble: %s", err),
+			})
+			return
+		}
+		for _, info := range infos {
+			namespaces = append(namespaces, info.Namespace)
+		}
+	}
+	export := UserDataExport{
+		ExportedAt: time.Now(),
+		Entries:    []userDataEntry{},
+	}
+	for _, namespace := range namespaces {
+		entries, err := userdata.DataStore.List(namespace, nil, 0)
+		if err != nil {
+			c.JSON(500, gin.H{
+				"code":    3000,
+				"message": fmt.Sprintf("Server got itself into trouble: %s", err),
+			})
+			return
+		}
+		for _, e := range entries {
+			export.Entries = append(export.Entries, newUserDataEntry(namespace, e.Key, e.Value))
+		}
+	}
+	c.Header("Content-Description", "File Transfer")
+	c.Header("Content-Disposition", "attachment; filename=gypsum-userdata.json")
+	c.JSON(200, export)
+}
+
+// importUserData writes entries of an exported file, existing keys are kept unless overwrite=true.
+// Entries that could not be read when exporting, and entries already expired, are skipped.
+func importUserData(c *gin.Context) {
+	var export UserDataExport
+	if err := bindJSONNumbers(c, &export); err != nil {
+		c.JSON(400, gin.H{
+			"code":    2000,
+			"message": fmt.Sprintf("converting error: %s", err),
+		})
+		return
+	}
+	overwrite := c.Query("overwrite") == "true"
+	type pendingEntry struct {
+		namespace string
+		key       []byte
+		value     *userdata.Value
+	}
+	pending := make([]pendingEntry, 0, len(export.Entries))
+	skipped := 0
+	now := time.Now()
+	for i, e := range export.Entries {
+		if e.Error != "" || (e.ExpiresAt != nil && !now.Before(*e.ExpiresAt)) {
+			skipped++
+			continue
+		}
+		key, err := userDataKey(e.Key, e.KeyType)
+		if err != nil {
+			c.JSON(422, gin.H{
+				"code":    2000,
+				"message": fmt.Sprintf("entry %d: %s", i, err),
+			})
+			return
+		}
+		v, err := userdata.EncodeValue(e.Value)
+		if err != nil {
+			c.JSON(422, gin.H{
+				"code":    2000,
+				"message": fmt.Sprintf("entry %d: %s", i, err),
+			})
+			return
+		}
+		if e.ExpiresAt != nil {
+			v.ExpiresAt = *e.ExpiresAt
+		}
+		pending = append(pending, pendingEntry{e.Namespace, key, v})
+	}
+	imported := 0
+	for _, p := range pending {
+		written, err := userdata.DataStore.Restore(p.namespace, p.key, p.value, overwrite)
+		if err != nil {
+			c.JSON(500, gin.H{
+				"code":     3000,
+				"message":  fmt.Sprintf("Server got itself into trouble: %s", err),
+				"imported": imported,
+			})
+			return
+		}
+		if written {
+			imported++
+		} else {
+			skipped++
+		}
+	}
+	c.JSON(200, gin.H{
+		"code":     0,
+		"message":  "ok",
+		"imported": imported,
+		"skipped":  skipped,
+	})
+}
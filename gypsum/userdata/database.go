@@ -0,0 +1,308 @@
+package userdata
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"sync"
+	"time"
+
+	"github.com/yuudi/gypsum/gypsum/storage"
+)
+
+var db storage.Storage
+
+func SetDB(newDB storage.Storage) {
+	db = newDB
+}
+
+// valueMagic starts every value saved with an envelope, values saved before have no envelope.
+// A gob stream never starts with a zero byte, so the two are told apart.
+var valueMagic = []byte{0x00, 'g', 'u', 'd'}
+
+const valueHeaderLength = 4 + 1 + 8
+
+// Format is how the payload of a value is encoded
+type Format byte
+
+const (
+	GobFormat Format = iota
+	JSONFormat
+)
+
+// Value is a decoded envelope, ExpiresAt is zero when the key never expires
+type Value struct {
+	Format    Format
+	ExpiresAt time.Time
+	Payload   []byte
+}
+
+func (v *Value) Expired(now time.Time) bool {
+	return !v.ExpiresAt.IsZero() && !now.Before(v.ExpiresAt)
+}
+
+func (v *Value) toBytes() []byte {
+	b := make([]byte, valueHeaderLength, valueHeaderLength+len(v.Payload))
+	copy(b, valueMagic)
+	b[4] = byte(v.Format)
+	if !v.ExpiresAt.IsZero() {
+		binary.BigEndian.PutUint64(b[5:], uint64(v.ExpiresAt.UnixNano()))
+	}
+	return append(b, v.Payload...)
+}
+
+// ValueFromBytes reads a saved value, values saved before the envelope are read as GobFormat
+func ValueFromBytes(b []byte) *Value {
+	if len(b) < valueHeaderLength || !bytes.Equal(b[:4], valueMagic) {
+		// saved before expiry was supported
+		return &Value{
+			Format:  GobFormat,
+			Payload: b,
+		}
+	}
+	v := &Value{
+		Format:  Format(b[4]),
+		Payload: b[valueHeaderLength:],
+	}
+	if nanos := binary.BigEndian.Uint64(b[5:valueHeaderLength]); nanos != 0 {
+		v.ExpiresAt = time.Unix(0, int64(nanos))
+	}
+	return v
+}
+
+// expiresAt turns a time-to-live into an expiry time, zero ttl means never
+func expiresAt(ttl time.Duration) time.Time {
+	if ttl <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(ttl)
+}
+
+// keyLocks serialize writes to the same key, so that Update is atomic
+var keyLocks [64]sync.Mutex
+
+func lockKey(key []byte) *sync.Mutex {
+	h := fnv.New32a()
+	_, _ = h.Write(key)
+	return &keyLocks[h.Sum32()%uint32(len(keyLocks))]
+}
+
+// Get reads a key, storage.ErrNotFound is returned if it does not exist or has expired
+func (s Store) Get(namespace string, key []byte) (*Value, error) {
+	b, err := db.Get(s.Key(namespace, key))
+	if err != nil {
+		return nil, err
+	}
+	v := ValueFromBytes(b)
+	if v.Expired(time.Now()) {
+		return nil, storage.ErrNotFound
+	}
+	return v, nil
+}
+
+// Put writes a key, it expires after ttl if ttl is positive
+func (s Store) Put(namespace string, key []byte, format Format, payload []byte, ttl time.Duration) error {
+	fullKey := s.Key(namespace, key)
+	lock := lockKey(fullKey)
+	lock.Lock()
+	defer lock.Unlock()
+	return db.Put(fullKey, (&Value{
+		Format:    format,
+		ExpiresAt: expiresAt(ttl),
+		Payload:   payload,
+	}).toBytes())
+}
+
+// PutValue encodes a Go value as JSON and writes it
+func (s Store) PutValue(namespace string, key []byte, value interface{}, ttl time.Duration) error {
+	b, err := Encode(value)
+	if err != nil {
+		return err
+	}
+	return s.Put(namespace, key, JSONFormat, b, ttl)
+}
+
+func (s Store) Delete(namespace string, key []byte) error {
+	fullKey := s.Key(namespace, key)
+	lock := lockKey(fullKey)
+	lock.Lock()
+	defer lock.Unlock()
+	return db.Delete(fullKey)
+}
+
+// Update reads a key and writes back what fn returns, no other write to the key can happen in between.
+// fn gets nil if the key does not exist, and returns nil to leave the key unchanged.
+// A positive ttl sets a new expiry, otherwise the key keeps its expiry.
+func (s Store) Update(namespace string, key []byte, ttl time.Duration, fn func(old *Value) (*Value, error)) error {
+	fullKey := s.Key(namespace, key)
+	lock := lockKey(fullKey)
+	lock.Lock()
+	defer lock.Unlock()
+	var old *Value
+	b, err := db.Get(fullKey)
+	if err == nil {
+		old = ValueFromBytes(b)
+		if old.Expired(time.Now()) {
+			old = nil
+		}
+	} else if err != storage.ErrNotFound {
+		return err
+	}
+	v, err := fn(old)
+	if err != nil || v == nil {
+		return err
+	}
+	if ttl > 0 {
+		v.ExpiresAt = expiresAt(ttl)
+	} else if old != nil {
+		v.ExpiresAt = old.ExpiresAt
+	} else {
+		v.ExpiresAt = time.Time{}
+	}
+	return db.Put(fullKey, v.toBytes())
+}
+
+// Entry is a key found by List, the key is without namespace
+type Entry struct {
+	Key   []byte
+	Value *Value
+}
+
+// List finds keys with the prefix in ascending order, at most limit keys are returned if limit is positive
+func (s Store) List(namespace string, prefix []byte, limit int) ([]Entry, error) {
+	nsPrefix := s.Prefix(namespace)
+	iter := db.NewIterator(append(append([]byte{}, nsPrefix...), prefix...))
+	defer iter.Release()
+	now := time.Now()
+	var entries []Entry
+	for iter.Next() {
+		v := ValueFromBytes(append([]byte{}, iter.Value()...))
+		if v.Expired(now) {
+			continue
+		}
+		entries = append(entries, Entry{
+			Key:   append([]byte{}, iter.Key()[len(nsPrefix):]...),
+			Value: v,
+		})
+		if limit > 0 && len(entries) >= limit {
+			break
+		}
+	}
+	return entries, iter.Error()
+}
+
+// PurgeExpired deletes expired keys of all stores and namespaces, returns how many are deleted
+func PurgeExpired() (int, error) {
+	now := time.Now()
+	var expired [][]byte
+	iter := db.NewIterator([]byte("gypsum-userDB-"))
+	for iter.Next() {
+		if ValueFromBytes(iter.Value()).Expired(now) {
+			expired = append(expired, append([]byte{}, iter.Key()...))
+		}
+	}
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		return 0, err
+	}
+	count := 0
+	for _, key := range expired {
+		if err := deleteIfExpired(key, now); err != nil {
+			return count, err
+		}
+		count++
+	}
+	return count, nil
+}
+
+// deleteIfExpired checks again under lock, the key may have been written after iterating
+func deleteIfExpired(key []byte, now time.Time) error {
+	lock := lockKey(key)
+	lock.Lock()
+	defer lock.Unlock()
+	b, err := db.Get(key)
+	if err == storage.ErrNotFound {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if !ValueFromBytes(b).Expired(now) {
+		return nil
+	}
+	return db.Delete(key)
+}
+
+// ConvertToJSON re-encodes a saved value as JSON keeping its expiry, decodeGob reads the payload of a GobFormat value
+func ConvertToJSON(b []byte, decodeGob func(payload []byte) (interface{}, error)) ([]byte, error) {
+	v := ValueFromBytes(b)
+	if v.Format == JSONFormat {
+		return b, nil
+	}
+	if v.Format != GobFormat {
+		return nil, errors.New(fmt.Sprintf("unknown value format %d", v.Format))
+	}
+	value, err := decodeGob(v.Payload)
+	if err != nil {
+		return nil, err
+	}
+	converted, err := EncodeValue(value)
+	if err != nil {
+		return nil, err
+	}
+	converted.ExpiresAt = v.ExpiresAt
+	return converted.toBytes(), nil
+}
+
+// Restore writes a value with its expiry, an existing key is kept unless overwrite. Returns whether the value is written.
+func (s Store) Restore(namespace string, key []byte, v *Value, overwrite bool) (bool, error) {
+	fullKey := s.Key(namespace, key)
+	lock := lockKey(fullKey)
+	lock.Lock()
+	defer lock.Unlock()
+	if !overwrite {
+		b, err := db.Get(fullKey)
+		if err == nil && !ValueFromBytes(b).Expired(time.Now()) {
+			return false, nil
+		} else if err != nil && err != storage.ErrNotFound {
+			return false, err
+		}
+	}
+	return true, db.Put(fullKey, v.toBytes())
+}
+
+// NamespaceInfo is a namespace having keys in a store
+type NamespaceInfo struct {
+	Namespace string `json:"namespace"`
+	Keys      int    `json:"keys"`
+}
+
+// Namespaces lists namespaces having keys that are not expired, the global namespace comes first and the others are in ascending order
+func (s Store) Namespaces() ([]NamespaceInfo, error) {
+	root := s.Root()
+	iter := db.NewIterator(root)
+	defer iter.Release()
+	now := time.Now()
+	var namespaces []NamespaceInfo
+	for iter.Next() {
+		rest := iter.Key()[len(root):]
+		namespace := Global
+		switch {
+		case bytes.HasPrefix(rest, []byte("-")):
+		case bytes.HasPrefix(rest, []byte("@")) && bytes.IndexByte(rest, 0) > 0:
+			namespace = string(rest[1:bytes.IndexByte(rest, 0)])
+		default:
+			continue
+		}
+		if ValueFromBytes(iter.Value()).Expired(now) {
+			continue
+		}
+		if n := len(namespaces); n != 0 && namespaces[n-1].Namespace == namespace {
+			namespaces[n-1].Keys++
+		} else {
+			namespaces = append(namespaces, NamespaceInfo{Namespace: namespace, Keys: 1})
+		}
+	}
+	return namespaces, iter.Error()
+}
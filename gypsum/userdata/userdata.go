@@ -0,0 +1,32 @@
+package userdata
+
+// Store is a keyspace of user data
+type Store string
+
+const (
+	// DataStore is shared by templates and lua
+	DataStore Store = "p"
+	// LegacyLuaStore is where lua saved data before sharing DataStore, it is moved into DataStore when migrating
+	LegacyLuaStore Store = "lua"
+)
+
+// Global is the namespace shared by all items, items outside any plugin use it
+const Global = ""
+
+// Root is the database prefix of keys in the store, in any namespace
+func (s Store) Root() []byte {
+	return []byte("gypsum-userDB-" + string(s))
+}
+
+// Prefix is the database prefix of keys in the namespace.
+// Global keys are saved as they were before namespacing, so old data is kept.
+func (s Store) Prefix(namespace string) []byte {
+	if namespace == Global {
+		return append(s.Root(), '-')
+	}
+	return append(s.Root(), []byte("@"+namespace+"\x00")...)
+}
+
+func (s Store) Key(namespace string, key []byte) []byte {
+	return append(s.Prefix(namespace), key...)
+}
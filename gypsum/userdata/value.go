@@ -0,0 +1,193 @@
+package userdata
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+)
+
+// Values shared by templates and lua are JSON-compatible:
+// nil, bool, int, float64, string, []interface{} and map[string]interface{}.
+// Integral numbers are decoded as int and other numbers as float64.
+
+// Encode saves a value as JSON, the value is normalized first so that maps and integers are encoded the same way everywhere
+func Encode(value interface{}) ([]byte, error) {
+	normalized, err := Normalize(value)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(normalized)
+}
+
+func Decode(b []byte) (interface{}, error) {
+	decoder := json.NewDecoder(bytes.NewReader(b))
+	decoder.UseNumber()
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return nil, err
+	}
+	return Normalize(value)
+}
+
+// Normalize converts a Go value into the shared value model, it fails for values that cannot be saved
+func Normalize(value interface{}) (interface{}, error) {
+	switch v := value.(type) {
+	case nil:
+		return nil, nil
+	case bool, string:
+		return v, nil
+	case int:
+		return v, nil
+	case json.Number:
+		if i, err := v.Int64(); err == nil && int64(int(i)) == i {
+			return int(i), nil
+		}
+		f, err := v.Float64()
+		if err != nil {
+			return nil, err
+		}
+		return normalizeFloat(f)
+	case float64:
+		return normalizeFloat(v)
+	case []interface{}:
+		list := make([]interface{}, len(v))
+		for i, item := range v {
+			n, err := Normalize(item)
+			if err != nil {
+				return nil, err
+			}
+			list[i] = n
+		}
+		return list, nil
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			n, err := Normalize(item)
+			if err != nil {
+				return nil, err
+			}
+			m[key] = n
+		}
+		return m, nil
+	}
+	// other numbers, slices and maps with string keys
+	rv := reflect.ValueOf(value)
+	switch rv.Kind() {
+	case reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return normalizeInt64(rv.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		if rv.Uint() > math.MaxInt64 {
+			return normalizeFloat(float64(rv.Uint()))
+		}
+		return normalizeInt64(int64(rv.Uint()))
+	case reflect.Float32:
+		return normalizeFloat(rv.Float())
+	case reflect.Slice, reflect.Array:
+		list := make([]interface{}, rv.Len())
+		for i := range list {
+			n, err := Normalize(rv.Index(i).Interface())
+			if err != nil {
+				return nil, err
+			}
+			list[i] = n
+		}
+		return list, nil
+	case reflect.Map:
+		if rv.Type().Key().Kind() != reflect.String {
+			return nil, errors.New(fmt.Sprintf("cannot save map with %s keys", rv.Type().Key()))
+		}
+		m := make(map[string]interface{}, rv.Len())
+		iter := rv.MapRange()
+		for iter.Next() {
+			n, err := Normalize(iter.Value().Interface())
+			if err != nil {
+				return nil, err
+			}
+			m[iter.Key().String()] = n
+		}
+		return m, nil
+	case reflect.Ptr, reflect.Interface:
+		if rv.IsNil() {
+			return nil, nil
+		}
+		return Normalize(rv.Elem().Interface())
+	}
+	return nil, errors.New(fmt.Sprintf("cannot save %#v (%T) to database", value, value))
+}
+
+func normalizeInt64(i int64) (interface{}, error) {
+	if int64(int(i)) != i {
+		return float64(i), nil
+	}
+	return int(i), nil
+}
+
+// normalizeFloat turns integral floats into int, so 3.0 saved from lua is 3 in templates
+func normalizeFloat(f float64) (interface{}, error) {
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return nil, errors.New(fmt.Sprintf("cannot save %v to database", f))
+	}
+	if f == math.Trunc(f) && f >= math.MinInt64 && f < math.MaxInt64 && int64(int(f)) == int64(f) {
+		return int(f), nil
+	}
+	return f, nil
+}
+
+// Equal tells whether two values are the same after normalizing
+func Equal(a, b interface{}) bool {
+	na, err := Normalize(a)
+	if err != nil {
+		return false
+	}
+	nb, err := Normalize(b)
+	if err != nil {
+		return false
+	}
+	return reflect.DeepEqual(na, nb)
+}
+
+// legacyStoredValue is how templates saved values before JSON, gob matches it by field names
+type legacyStoredValue struct {
+	ValueType int
+	IntValue  int
+	StrValue  string
+}
+
+// DecodeValue reads the payload of a value in DataStore
+func DecodeValue(v *Value) (interface{}, error) {
+	switch v.Format {
+	case JSONFormat:
+		return Decode(v.Payload)
+	case GobFormat:
+		var data legacyStoredValue
+		if err := gob.NewDecoder(bytes.NewReader(v.Payload)).Decode(&data); err != nil {
+			return nil, err
+		}
+		switch data.ValueType {
+		case 0:
+			return data.IntValue, nil
+		case 1:
+			return data.StrValue, nil
+		default:
+			return nil, errors.New(fmt.Sprintf("Unknown value type from StoredValue: %v", data.ValueType))
+		}
+	default:
+		return nil, errors.New(fmt.Sprintf("unknown value format %d", v.Format))
+	}
+}
+
+// EncodeValue makes a value of DataStore from a Go value
+func EncodeValue(value interface{}) (*Value, error) {
+	b, err := Encode(value)
+	if err != nil {
+		return nil, err
+	}
+	return &Value{
+		Format:  JSONFormat,
+		Payload: b,
+	}, nil
+}
@@ -0,0 +1,208 @@
+package gypsum
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"math/rand"
+	"regexp"
+	"strconv"
+	"time"
+	_ "time/tzdata" // timezones should work on systems without tzdata
+
+	"github.com/robfig/cron/v3"
+	zero "github.com/wdvxdr1123/ZeroBot"
+)
+
+// TimeRange is a daily time range on some weekdays
+type TimeRange struct {
+	// Weekdays are 0 (Sunday) to 6 (Saturday), 7 is also Sunday. Empty means every day.
+	Weekdays []int `json:"weekdays" yaml:"weekdays"`
+	// Start and End are "HH:MM", empty Start means 00:00 and empty End means 24:00.
+	// If End is before Start, the range ends on the next day.
+	Start string `json:"start" yaml:"start"`
+	End   string `json:"end" yaml:"end"`
+}
+
+// ActiveWindow limits when a rule or trigger works, it is active if the time matches Cron or any of Ranges.
+// An empty window is always active.
+type ActiveWindow struct {
+	// Timezone is an IANA name like "Asia/Shanghai", empty means the local timezone
+	Timezone string `json:"timezone" yaml:"timezone"`
+	// Cron is a cron spec, it is active in every minute the spec matches, e.g. "* 9-17 * * 1-5"
+	Cron   string      `json:"cron" yaml:"cron"`
+	Ranges []TimeRange `json:"ranges" yaml:"ranges"`
+}
+
+func (w *ActiveWindow) enabled() bool {
+	return w.Cron != "" || len(w.Ranges) != 0
+}
+
+// clockPattern is "HH:MM", the hour may have one digit
+var clockPattern = regexp.MustCompile(`^(\d{1,2}):(\d{2})$`)
+
+func parseClock(clock string, empty int) (int, error) {
+	if clock == "" {
+		return empty, nil
+	}
+	parts := clockPattern.FindStringSubmatch(clock)
+	if parts == nil {
+		return 0, errors.New(fmt.Sprintf("invalid time: %s", clock))
+	}
+	hour, _ := strconv.Atoi(parts[1])
+	minute, _ := strconv.Atoi(parts[2])
+	if minute > 59 || hour*60+minute > 24*60 {
+		return 0, errors.New(fmt.Sprintf("invalid time: %s", clock))
+	}
+	return hour*60 + minute, nil
+}
+
+type compiledRange struct {
+	weekdays   [7]bool
+	start, end int // minutes of the day
+}
+
+func (r *TimeRange) compile() (compiledRange, error) {
+	var c compiledRange
+	var err error
+	if c.start, err = parseClock(r.Start, 0); err != nil {
+		return c, err
+	}
+	if c.end, err = parseClock(r.End, 24*60); err != nil {
+		return c, err
+	}
+	if len(r.Weekdays) == 0 {
+		c.weekdays = [7]bool{true, true, true, true, true, true, true}
+	}
+	for _, day := range r.Weekdays {
+		if day < 0 || day > 7 {
+			return c, errors.New(fmt.Sprintf("invalid weekday: %d", day))
+		}
+		c.weekdays[day%7] = true
+	}
+	return c, nil
+}
+
+func (c *compiledRange) contains(t time.Time) bool {
+	now := t.Hour()*60 + t.Minute()
+	today := int(t.Weekday())
+	if c.start <= c.end {
+		return c.weekdays[today] && c.start <= now && now < c.end
+	}
+	// across midnight, the part after midnight belongs to the day before
+	if now >= c.start {
+		return c.weekdays[today]
+	}
+	return now < c.end && c.weekdays[(today+6)%7]
+}
+
+type compiledWindow struct {
+	location *time.Location
+	cron     cron.Schedule
+	ranges   []compiledRange
+}
+
+func (w *ActiveWindow) compile() (*compiledWindow, error) {
+	c := &compiledWindow{location: time.Local}
+	if w.Timezone != "" {
+		location, err := time.LoadLocation(w.Timezone)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("unknown timezone: %s", w.Timezone))
+		}
+		c.location = location
+	}
+	if w.Cron != "" {
+		schedule, err := specParser.Parse(w.Cron)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("cron syntax error: %s", err))
+		}
+		c.cron = schedule
+	}
+	for _, r := range w.Ranges {
+		compiled, err := r.compile()
+		if err != nil {
+			return nil, err
+		}
+		c.ranges = append(c.ranges, compiled)
+	}
+	return c, nil
+}
+
+func (c *compiledWindow) contains(t time.Time) bool {
+	t = t.In(c.location)
+	if c.cron != nil {
+		minute := t.Truncate(time.Minute)
+		if c.cron.Next(minute.Add(-time.Second)).Equal(minute) {
+			return true
+		}
+	}
+	for i := range c.ranges {
+		if c.ranges[i].contains(t) {
+			return true
+		}
+	}
+	return false
+}
+
+func (w *ActiveWindow) check() error {
+	_, err := w.compile()
+	return err
+}
+
+func (w *ActiveWindow) rule() (zero.Rule, error) {
+	c, err := w.compile()
+	if err != nil {
+		return nil, err
+	}
+	return func(_ *zero.Event, _ zero.State) bool {
+		return c.contains(time.Now())
+	}, nil
+}
+
+// Probability is the chance a matched rule or trigger responds, 1 means always and 0 means never.
+// Requests and manifests without probability get 1.
+func checkProbability(probability float64) error {
+	if probability < 0 || probability > 1 {
+		return errors.New("probability must be between 0 and 1")
+	}
+	return nil
+}
+
+func probabilityRule(probability float64) zero.Rule {
+	return func(_ *zero.Event, _ zero.State) bool {
+		return rand.Float64() < probability
+	}
+}
+
+// respondAlwaysRule upgrades rules saved when probability 0 meant always, it is 1 now
+func respondAlwaysRule(payload []byte) ([]byte, error) {
+	r := &Rule{}
+	if err := gob.NewDecoder(bytes.NewReader(payload)).Decode(r); err != nil {
+		return nil, err
+	}
+	if r.Probability == 0 {
+		r.Probability = 1
+	}
+	buffer := bytes.Buffer{}
+	if err := gob.NewEncoder(&buffer).Encode(r); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+// respondAlwaysTrigger upgrades triggers saved when probability 0 meant always, it is 1 now
+func respondAlwaysTrigger(payload []byte) ([]byte, error) {
+	t := &Trigger{}
+	if err := gob.NewDecoder(bytes.NewReader(payload)).Decode(t); err != nil {
+		return nil, err
+	}
+	if t.Probability == 0 {
+		t.Probability = 1
+	}
+	buffer := bytes.Buffer{}
+	if err := gob.NewEncoder(&buffer).Encode(t); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
@@ -0,0 +1,81 @@
+package gypsum
+
+import (
+	"encoding/json"
+	"testing"
+
+	zero "github.com/wdvxdr1123/ZeroBot"
+	zeroMessage "github.com/wdvxdr1123/ZeroBot/message"
+)
+
+// matches runs all rules of a matcher on a private message
+func matches(m *zero.Matcher, text string) bool {
+	event := &zero.Event{
+		PostType:    "message",
+		MessageType: "private",
+		SubType:     "friend",
+		UserID:      10000,
+		RawMessage:  text,
+		Message:     zeroMessage.ParseMessageFromString(text),
+	}
+	state := zero.State{}
+	for _, rule := range m.Rules {
+		if !rule(event, state) {
+			return false
+		}
+	}
+	return true
+}
+
+func TestProbability(t *testing.T) {
+	useTestMemory(t)
+	openTestRegistry(t)
+	cases := []struct {
+		name     string
+		field    string
+		want     float64
+		responds bool
+	}{
+		{"unset", ``, 1, true},
+		{"zero", `,"probability":0`, 0, false},
+		{"one", `,"probability":1`, 1, true},
+	}
+	for _, c := range cases {
+		code, body := callHandler(createRule, "POST", "/", `{"display_name":"`+c.name+`","active":true,"message_type":4294967295,"patterns":["hi"],"response":"hello"`+c.field+`}`)
+		if code != 201 {
+			t.Fatalf("%s: create rule: %d %s", c.name, code, body)
+		}
+		var created struct {
+			RuleID uint64 `json:"rule_id"`
+		}
+		if err := json.Unmarshal([]byte(body), &created); err != nil {
+			t.Fatal(err)
+		}
+		r := registry.rules[created.RuleID]
+		if r.Probability != c.want {
+			t.Errorf("%s: probability: got %v, want %v", c.name, r.Probability, c.want)
+		}
+		// the probability is saved as it is, 0 is not lost when encoding
+		b, err := r.ToBytes()
+		if err != nil {
+			t.Fatal(err)
+		}
+		saved, err := RuleFromBytes(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if saved.Probability != c.want {
+			t.Errorf("%s: saved probability: got %v, want %v", c.name, saved.Probability, c.want)
+		}
+		m, err := r.newMatcher(created.RuleID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 100; i++ {
+			if got := matches(m, "hi"); got != c.responds {
+				t.Errorf("%s: responds: got %v, want %v", c.name, got, c.responds)
+				break
+			}
+		}
+	}
+}